@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Addressing styles of upstream requests
+const (
+	addressingStyleClient  = ""        // Same style as the client request
+	addressingStylePath    = "path"    // https://endpoint/bucket/key
+	addressingStyleVirtual = "virtual" // https://bucket.endpoint/key
+	addressingStyleAuto    = "auto"    // Virtual-hosted when the endpoint and the bucket allow it
+)
+
+// Bucket names usable as a single DNS label, covered by wildcard certificates
+var dnsBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+func validAddressingStyle(style string) bool {
+	switch style {
+	case addressingStyleClient, addressingStylePath, addressingStyleVirtual, addressingStyleAuto:
+		return true
+	}
+	return false
+}
+
+// upstreamVirtualHosted tells if a request to an upstream for a bucket puts
+// it in the hostname, by the style of the upstream. Only upstreams without a
+// style follow the client.
+func upstreamVirtualHosted(style string, endpoint *url.URL, bucket string, clientVirtualHosted bool) bool {
+	if bucket == "" {
+		return false
+	}
+	switch style {
+	case addressingStylePath:
+		return false
+	case addressingStyleVirtual:
+		return true
+	case addressingStyleAuto:
+		return autoVirtualHosted(endpoint, bucket)
+	}
+	return clientVirtualHosted
+}
+
+// autoVirtualHosted picks virtual-hosted requests unless they can't resolve
+// or be verified: IP endpoints and single-label hosts (service names,
+// localhost) have no wildcard DNS, and dotted bucket names break wildcard
+// certificates
+func autoVirtualHosted(endpoint *url.URL, bucket string) bool {
+	host := endpoint.Hostname()
+	if net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return false
+	}
+	return dnsBucketName.MatchString(bucket)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Address of the admin listener (metrics, health), empty disables it
+var adminAddr string
+
+func loadAdminConfig() {
+	adminAddr = getEnvOrDefault("ADMIN_ADDR", ":9090")
+	if adminAddr == "off" {
+		adminAddr = ""
+	}
+}
+
+// startAdminServer serves operational endpoints on a separate port so they
+// can never collide with bucket names on the proxy port
+func startAdminServer() {
+	if adminAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/presign", handlePresign)
+
+	go func() {
+		log.Infof("Starting admin server on %s...", adminAddr)
+		if err := http.ListenAndServe(adminAddr, mux); err != nil {
+			log.Fatalf("Admin server failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Optional JSON-lines file receiving audit records, they are always logged
+	auditLogFile  string
+	auditLogMutex sync.Mutex
+)
+
+func loadAuditConfig() {
+	auditLogFile = getEnv("AUDIT_LOG_FILE")
+}
+
+// recordAudit keeps track of a privileged operation and who performed it
+func recordAudit(action, actor string, fields log.Fields) {
+	record := log.Fields{
+		"time":   time.Now().UTC().Format(time.RFC3339),
+		"action": action,
+		"actor":  actor,
+	}
+	for k, v := range fields {
+		record[k] = v
+	}
+
+	log.WithFields(fields).WithField("audit", true).WithField("actor", actor).Infof("Audit: %s", action)
+
+	if auditLogFile == "" {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("Failed to encode audit record: %v", err)
+		return
+	}
+
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+	file, err := os.OpenFile(auditLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Errorf("Failed to open audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Errorf("Failed to write audit record: %v", err)
+	}
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// clientCredential is a key pair clients use to sign requests to the proxy,
+// optionally mapped to its own upstream accounts and buckets
+type clientCredential struct {
+	Name      string `json:"name"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+
+	Main          *upstreamCredentials            `json:"main"`          // Credentials for the primary main backend, defaults to its own
+	Mirror        *upstreamCredentials            `json:"mirror"`        // Credentials for the primary mirror target, defaults to its own
+	MainBackends  map[string]*upstreamCredentials `json:"mainBackends"`  // Credentials per main backend name
+	MirrorTargets map[string]*upstreamCredentials `json:"mirrorTargets"` // Credentials per mirror target name
+	Buckets       []string                        `json:"buckets"`       // Allowed bucket names or globs, empty allows every bucket
+	MirrorWrites  *bool                           `json:"mirrorWrites"`  // Whether writes are mirrored, defaults to true
+	CertSubjects  []string                        `json:"certSubjects"`  // Client certificate subjects, CNs, DNS or URI SANs (globs) authenticating as this client
+
+	Policy      *policyDocument   `json:"policy"`      // Inline IAM policy
+	PolicyFiles []string          `json:"policyFiles"` // IAM policy documents evaluated along the inline policy
+	policies    []*policyDocument // Every policy of the client, none allows everything
+	order       int               // Position in the configuration, certificates match the first client
+}
+
+// upstreamCredentials is a key pair used to sign requests to main or the
+// mirror, with the session token of temporary credentials
+type upstreamCredentials struct {
+	AccessKey    string `json:"accessKey"`
+	SecretKey    string `json:"secretKey"`
+	SessionToken string `json:"sessionToken,omitempty"`
+}
+
+type clientCredentialsConfig struct {
+	Clients []*clientCredential `json:"clients"`
+}
+
+var (
+	// Client credentials by access key, empty disables client authentication
+	clientCredentials      = make(map[string]*clientCredential)
+	clientCredentialsMutex sync.RWMutex
+
+	clientCredentialsFile    string
+	clientCredentialsModTime time.Time
+	clientCredentialsReload  time.Duration
+)
+
+const (
+	signatureAlgorithm = "AWS4-HMAC-SHA256"
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	// Maximum difference between the client clock and ours
+	maxRequestTimeSkew = 15 * time.Minute
+	// Longest validity of a presigned URL (7 days)
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+type contextKey string
+
+const identityContextKey contextKey = "identity"
+
+func loadClientCredentials() {
+	clientCredentialsFile = getEnv("CLIENT_CREDENTIALS_FILE")
+	trustForwardedFor = getEnvOrDefault("TRUST_FORWARDED_FOR", "false") == "true"
+
+	reload, err := time.ParseDuration(getEnvOrDefault("CLIENT_CREDENTIALS_RELOAD_INTERVAL", "30s"))
+	if err != nil || reload < 0 {
+		log.Fatalf("Invalid CLIENT_CREDENTIALS_RELOAD_INTERVAL: %v", err)
+	}
+	clientCredentialsReload = reload
+
+	credentials, modTime, err := readClientCredentials()
+	if err != nil {
+		log.Fatalf("Failed to load client credentials: %v", err)
+	}
+	clientCredentials = credentials
+	clientCredentialsModTime = modTime
+
+	if len(clientCredentials) > 0 {
+		log.Infof("Client authentication enabled for %d credentials", len(clientCredentials))
+	} else {
+		log.Warn("No client credentials configured, every request reaching the proxy is forwarded with the main credentials")
+	}
+}
+
+// readClientCredentials parses CLIENT_CREDENTIALS and CLIENT_CREDENTIALS_FILE,
+// also returning the modification time of the file
+func readClientCredentials() (map[string]*clientCredential, time.Time, error) {
+	credentials := make(map[string]*clientCredential)
+	add := func(client *clientCredential) error {
+		if _, exists := credentials[client.AccessKey]; exists {
+			return fmt.Errorf("duplicate client access key %s", client.AccessKey)
+		}
+		client.order = len(credentials)
+		credentials[client.AccessKey] = client
+		return nil
+	}
+
+	// Inline "ACCESS:SECRET" pairs, separated by commas
+	for _, pair := range strings.Split(getEnv("CLIENT_CREDENTIALS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, time.Time{}, fmt.Errorf("invalid CLIENT_CREDENTIALS, expected ACCESS_KEY:SECRET_KEY pairs separated by commas")
+		}
+		if err := add(&clientCredential{Name: parts[0], AccessKey: parts[0], SecretKey: parts[1]}); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	if clientCredentialsFile == "" {
+		return credentials, time.Time{}, nil
+	}
+
+	// Kubernetes updates mounted secrets in place, remember when it last changed
+	info, err := os.Stat(clientCredentialsFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var config clientCredentialsConfig
+	if err := loadConfigFile(clientCredentialsFile, &config); err != nil {
+		return nil, time.Time{}, err
+	}
+	for _, client := range config.Clients {
+		if err := client.validate(); err != nil {
+			return nil, time.Time{}, err
+		}
+		if err := add(client); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	if err := checkCertificateSubjects(config.Clients); err != nil {
+		return nil, time.Time{}, err
+	}
+	return credentials, info.ModTime(), nil
+}
+
+// checkCertificateSubjects rejects certificate subjects of different clients
+// that some name matches both, as a certificate could authenticate as either
+func checkCertificateSubjects(clients []*clientCredential) error {
+	for i, client := range clients {
+		for _, other := range clients[i+1:] {
+			for _, pattern := range client.CertSubjects {
+				for _, otherPattern := range other.CertSubjects {
+					if globsOverlap(pattern, otherPattern) {
+						return fmt.Errorf("certificate subjects %q of client %q and %q of client %q overlap", pattern, client.Name, otherPattern, other.Name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// globsOverlap tells if a name could match both path.Match patterns,
+// character classes are assumed to overlap each other
+func globsOverlap(a, b string) bool {
+	ta, tb := globTokens(a), globTokens(b)
+	seen := make(map[[2]int]bool)
+	var overlap func(i, j int) bool
+	overlap = func(i, j int) bool {
+		if seen[[2]int{i, j}] {
+			return false
+		}
+		seen[[2]int{i, j}] = true
+
+		switch {
+		case i == len(ta) && j == len(tb):
+			return true
+		case i < len(ta) && ta[i] == "*":
+			return overlap(i+1, j) || (j < len(tb) && globLiteral(tb[j]) != "/" && overlap(i, j+1))
+		case j < len(tb) && tb[j] == "*":
+			return overlap(i, j+1) || (i < len(ta) && globLiteral(ta[i]) != "/" && overlap(i+1, j))
+		case i == len(ta) || j == len(tb):
+			return false
+		}
+		return globTokensOverlap(ta[i], tb[j]) && overlap(i+1, j+1)
+	}
+	return overlap(0, 0)
+}
+
+// globTokens splits a pattern into "*", "?", classes and single characters (runes)
+func globTokens(pattern string) []string {
+	var tokens []string
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			// Escaped characters keep their backslash, "\\*" is not a wildcard
+			if i+1 < len(pattern) {
+				i++
+			}
+			_, size := utf8.DecodeRuneInString(pattern[i:])
+			tokens = append(tokens, "\\"+pattern[i:i+size])
+			i += size - 1
+		case '[':
+			end := i + 1
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end, len(pattern)-1)
+			tokens = append(tokens, pattern[i:end+1])
+			i = end
+		default:
+			_, size := utf8.DecodeRuneInString(pattern[i:])
+			tokens = append(tokens, pattern[i:i+size])
+			i += size - 1
+		}
+	}
+	return tokens
+}
+
+// globTokensOverlap tells if a single character could match both tokens
+func globTokensOverlap(a, b string) bool {
+	literal := func(t string) bool { return t != "?" && !strings.HasPrefix(t, "[") }
+	switch {
+	case literal(a) && literal(b):
+		return globLiteral(a) == globLiteral(b)
+	case literal(a):
+		ok, _ := path.Match(b, globLiteral(a))
+		return ok
+	case literal(b):
+		ok, _ := path.Match(a, globLiteral(b))
+		return ok
+	}
+	return true
+}
+
+// globLiteral returns the character of a literal token
+func globLiteral(token string) string {
+	return strings.TrimPrefix(token, "\\")
+}
+
+func (c *clientCredential) validate() error {
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return fmt.Errorf("client %q needs an accessKey and a secretKey", c.Name)
+	}
+	if c.Name == "" {
+		c.Name = c.AccessKey
+	}
+	upstreams := []*upstreamCredentials{c.Main, c.Mirror}
+	for name, upstream := range c.MainBackends {
+		if findMainBackend(name) == nil {
+			return fmt.Errorf("client %q has credentials for unknown main backend %q", c.Name, name)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	for name, upstream := range c.MirrorTargets {
+		if _, err := findMirrorTarget(name); err != nil || name == "" {
+			return fmt.Errorf("client %q has credentials for unknown mirror target %q", c.Name, name)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	for _, upstream := range upstreams {
+		if upstream != nil && (upstream.AccessKey == "" || upstream.SecretKey == "") {
+			return fmt.Errorf("client %q has upstream credentials without an accessKey or a secretKey", c.Name)
+		}
+	}
+	for _, pattern := range c.Buckets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("client %q has an invalid bucket pattern %q: %w", c.Name, pattern, err)
+		}
+	}
+	for _, pattern := range c.CertSubjects {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("client %q has an invalid certificate subject %q", c.Name, pattern)
+		}
+	}
+
+	if c.Policy != nil {
+		if err := c.Policy.validate(); err != nil {
+			return fmt.Errorf("client %q has an invalid policy: %w", c.Name, err)
+		}
+		c.policies = append(c.policies, c.Policy)
+	}
+	for _, policyFile := range c.PolicyFiles {
+		policy, err := loadPolicyFile(policyFile)
+		if err != nil {
+			return fmt.Errorf("client %q policy %s: %w", c.Name, policyFile, err)
+		}
+		c.policies = append(c.policies, policy)
+	}
+	return nil
+}
+
+// watchClientCredentials reloads CLIENT_CREDENTIALS_FILE whenever it changes,
+// an invalid file keeps the previous credentials
+func watchClientCredentials() {
+	if clientCredentialsFile == "" || clientCredentialsReload == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(clientCredentialsReload)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(clientCredentialsFile)
+			if err != nil || info.ModTime().Equal(clientCredentialsModTime) {
+				continue
+			}
+
+			credentials, modTime, err := readClientCredentials()
+			if err != nil {
+				log.Errorf("Failed to reload client credentials, keeping the previous ones: %v", err)
+				clientCredentialsModTime = info.ModTime()
+				continue
+			}
+			if len(credentials) == 0 {
+				// Never silently turn authentication off
+				log.Error("Reloaded client credentials are empty, keeping the previous ones")
+				clientCredentialsModTime = info.ModTime()
+				continue
+			}
+
+			clientCredentialsMutex.Lock()
+			clientCredentials = credentials
+			clientCredentialsMutex.Unlock()
+			clientCredentialsModTime = modTime
+			log.Infof("Reloaded %d client credentials", len(credentials))
+		}
+	}()
+}
+
+// clientAuthEnabled tells if requests must be signed by a known client
+func clientAuthEnabled() bool {
+	clientCredentialsMutex.RLock()
+	defer clientCredentialsMutex.RUnlock()
+	return len(clientCredentials) > 0
+}
+
+// lookupClientCredential returns the client owning an access key
+func lookupClientCredential(accessKey string) *clientCredential {
+	clientCredentialsMutex.RLock()
+	defer clientCredentialsMutex.RUnlock()
+	return clientCredentials[accessKey]
+}
+
+// requestIdentity returns the client that signed the request, nil when
+// client authentication is disabled
+func requestIdentity(req *http.Request) *clientCredential {
+	identity, _ := req.Context().Value(identityContextKey).(*clientCredential)
+	return identity
+}
+
+// errNoClientCredentials is returned for an upstream a client with its own
+// upstream accounts has no credentials for, the shared ones are never used
+var errNoClientCredentials = errors.New("no credentials of the client for")
+
+// mainCredentials returns the credentials used to forward the client's
+// requests to a main backend: those named for the backend, main for the
+// primary one, or the backend's own for clients without any
+func (c *clientCredential) mainCredentials(backend *mainBackend) (upstreamCredentials, error) {
+	if c != nil {
+		if creds := c.MainBackends[backend.Name]; creds != nil {
+			return *creds, nil
+		}
+		if c.Main != nil && backend == mainBackends[0] {
+			return *c.Main, nil
+		}
+		if c.Main != nil || len(c.MainBackends) > 0 {
+			return upstreamCredentials{}, fmt.Errorf("%w main backend %s (client %s)", errNoClientCredentials, backend.Name, c.Name)
+		}
+	}
+	return backend.credentials.Retrieve()
+}
+
+// usesMainBackend tells if the client has credentials for a main backend
+func (c *clientCredential) usesMainBackend(backend *mainBackend) bool {
+	return c == nil || c.MainBackends[backend.Name] != nil || (c.Main != nil && backend == mainBackends[0]) ||
+		(c.Main == nil && len(c.MainBackends) == 0)
+}
+
+// mirrorCredentials returns the credentials used to mirror the client's
+// writes to a target: those named for the target, mirror for the primary
+// one, or the target's own for clients without any
+func (c *clientCredential) mirrorCredentials(target *mirrorTarget) (upstreamCredentials, error) {
+	if c != nil {
+		if creds := c.MirrorTargets[target.Name]; creds != nil {
+			return *creds, nil
+		}
+		if c.Mirror != nil && target == mirrorTargets[0] {
+			return *c.Mirror, nil
+		}
+		if c.Mirror != nil || len(c.MirrorTargets) > 0 {
+			return upstreamCredentials{}, fmt.Errorf("%w mirror target %s (client %s)", errNoClientCredentials, target.Name, c.Name)
+		}
+	}
+	return target.retrieveCredentials()
+}
+
+// mirrorsWrites tells if the client's writes are mirrored
+func (c *clientCredential) mirrorsWrites() bool {
+	return c == nil || c.MirrorWrites == nil || *c.MirrorWrites
+}
+
+// allowsBucket tells if the client may access a bucket
+func (c *clientCredential) allowsBucket(bucket string) bool {
+	if c == nil || len(c.Buckets) == 0 {
+		return true
+	}
+	for _, pattern := range c.Buckets {
+		if ok, _ := path.Match(pattern, bucket); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeRequest rejects requests touching a bucket the client may not
+// access (including the source of copies) or denied by its policies
+func authorizeRequest(req *http.Request, bucket, key string, body []byte) *s3Error {
+	identity := requestIdentity(req)
+	if identity == nil {
+		return nil
+	}
+
+	denied := &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	if len(identity.Buckets) > 0 {
+		if bucket != "" && !identity.allowsBucket(bucket) {
+			log.Warnf("Rejected %s %s/%s for client %s: bucket not allowed", req.Method, bucket, key, identity.Name)
+			return denied
+		}
+		if copySource := req.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+			source, err := url.PathUnescape(strings.SplitN(copySource, "?", 2)[0])
+			if err != nil || !identity.allowsBucket(strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)[0]) {
+				log.Warnf("Rejected %s %s/%s for client %s: copy source bucket not allowed", req.Method, bucket, key, identity.Name)
+				return denied
+			}
+		}
+	}
+
+	if len(identity.policies) > 0 {
+		if allowed, reason := authorizePolicies(req, identity, bucket, key, body); !allowed {
+			log.Warnf("Rejected %s %s/%s for client %s: %s", req.Method, bucket, key, identity.Name, reason)
+			return denied
+		}
+	}
+	return nil
+}
+
+// filterBucketList removes the buckets a client may not access from a
+// ListBuckets response
+func filterBucketList(identity *clientCredential, body []byte) ([]byte, error) {
+	var result listAllMyBucketsResult
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+
+	buckets := result.Buckets[:0]
+	for _, b := range result.Buckets {
+		if identity.allowsBucket(b.Name) {
+			buckets = append(buckets, b)
+		}
+	}
+	result.Buckets = buckets
+	result.Xmlns = s3Namespace
+
+	filtered, err := xml.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), filtered...), nil
+}
+
+// authenticateRequest verifies the SigV4 signature of a client request (header
+// or presigned query) and returns the request carrying the client identity,
+// along with its payload once aws-chunked uploads are decoded
+func authenticateRequest(req *http.Request, body []byte) (*http.Request, []byte, *s3Error) {
+	presigned := req.URL.Query().Get("X-Amz-Algorithm") != ""
+
+	if !clientAuthEnabled() {
+		// Without client credentials only the expiry of presigned URLs can be checked
+		if presigned {
+			sig, err := parsePresignedSignature(req)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := sig.verifyTime(); err != nil {
+				return nil, nil, err
+			}
+		}
+		return decodeStreamingPayload(req, body, nil)
+	}
+
+	// CORS preflights are never signed, main answers them from its CORS rules
+	if req.Method == "OPTIONS" && req.Header.Get("Origin") != "" && req.Header.Get("Authorization") == "" && !presigned {
+		return req, body, nil
+	}
+
+	// Unsigned requests over mTLS authenticate with the client certificate
+	if req.Header.Get("Authorization") == "" && !presigned {
+		if client := certificateIdentity(req); client != nil {
+			log.Debugf("Authenticated request from %s by certificate", client.Name)
+			return decodeStreamingPayload(req.WithContext(context.WithValue(req.Context(), identityContextKey, client)), body, nil)
+		}
+	}
+
+	var sig *parsedSignature
+	var err *s3Error
+	switch {
+	case presigned:
+		sig, err = parsePresignedSignature(req)
+	case req.Header.Get("Authorization") != "":
+		sig, err = parseAuthorizationHeader(req)
+	default:
+		return nil, nil, &s3Error{http.StatusForbidden, "AccessDenied", "Anonymous access is not allowed."}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := lookupClientCredential(sig.accessKey)
+	if client == nil {
+		return nil, nil, &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records."}
+	}
+
+	if err := sig.verifyTime(); err != nil {
+		return nil, nil, err
+	}
+
+	// Make sure the body matches the hash the client signed, presigned or
+	// not, aws-chunked uploads are verified chunk by chunk
+	if !strings.HasPrefix(sig.payloadHash, "STREAMING-") && sig.payloadHash != unsignedPayload {
+		sum := sha256.Sum256(body)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), sig.payloadHash) {
+			return nil, nil, &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+		}
+	}
+
+	expected := computeClientSignature(req, sig, client.SecretKey)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sig.signature))) {
+		log.Debugf("Signature mismatch for %s, expected %s", sig.accessKey, expected)
+		return nil, nil, &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your key and signing method."}
+	}
+
+	var signer *chunkSigner
+	if !sig.presigned && (sig.payloadHash == streamingSignedPayload || sig.payloadHash == streamingSignedPayloadTrailer) {
+		signer = newChunkSigner(sig, client.SecretKey)
+	}
+	authenticated, payload, decodeErr := decodeStreamingPayload(req, body, signer)
+	if decodeErr != nil {
+		return nil, nil, decodeErr
+	}
+
+	log.Debugf("Authenticated request from %s", client.Name)
+	return authenticated.WithContext(context.WithValue(authenticated.Context(), identityContextKey, client)), payload, nil
+}
+
+// Query parameters carrying the signature of a presigned URL
+var presignQueryParams = map[string]bool{
+	"X-Amz-Algorithm":      true,
+	"X-Amz-Credential":     true,
+	"X-Amz-Date":           true,
+	"X-Amz-Expires":        true,
+	"X-Amz-SignedHeaders":  true,
+	"X-Amz-Signature":      true,
+	"X-Amz-Security-Token": true,
+	"X-Amz-Content-Sha256": true,
+}
+
+// stripPresignedQuery removes the client's presigned signature so the request
+// can be re-signed with upstream credentials, other parameters keep their
+// original encoding
+func stripPresignedQuery(req *http.Request) *http.Request {
+	if req.URL.Query().Get("X-Amz-Algorithm") == "" {
+		return req
+	}
+
+	var kept []string
+	for _, part := range strings.Split(req.URL.RawQuery, "&") {
+		name, _ := url.QueryUnescape(strings.SplitN(part, "=", 2)[0])
+		if part != "" && !presignQueryParams[name] {
+			kept = append(kept, part)
+		}
+	}
+
+	stripped := req.Clone(req.Context())
+	stripped.URL.RawQuery = strings.Join(kept, "&")
+	return stripped
+}
+
+// parsedSignature holds the SigV4 parameters of a request
+type parsedSignature struct {
+	accessKey     string
+	date          string // yyyymmdd from the credential scope
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+}
+
+// parseAuthorizationHeader parses
+// "AWS4-HMAC-SHA256 Credential=AK/20240101/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=..."
+func parseAuthorizationHeader(req *http.Request) (*parsedSignature, *s3Error) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signatureAlgorithm+" ") {
+		return nil, &s3Error{http.StatusBadRequest, "InvalidRequest", "Only the AWS4-HMAC-SHA256 signature algorithm is supported."}
+	}
+
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, signatureAlgorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	sig := &parsedSignature{signature: fields["Signature"]}
+	if err := sig.parseCredential(fields["Credential"]); err != nil {
+		return nil, err
+	}
+	if fields["SignedHeaders"] == "" || sig.signature == "" {
+		return nil, &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed; missing SignedHeaders or Signature."}
+	}
+	sig.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	if err := sig.checkSignedHeaders(req); err != nil {
+		return nil, err
+	}
+
+	amzDate := req.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		amzDate = req.Header.Get("Date")
+	}
+	if err := sig.parseDate(amzDate); err != nil {
+		return nil, err
+	}
+
+	sig.payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+	if sig.payloadHash == "" {
+		return nil, &s3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+	}
+	return sig, nil
+}
+
+// parsePresignedSignature parses the X-Amz-* query parameters of a presigned URL
+func parsePresignedSignature(req *http.Request) (*parsedSignature, *s3Error) {
+	query := req.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signatureAlgorithm {
+		return nil, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Algorithm only supports \"AWS4-HMAC-SHA256\"."}
+	}
+
+	sig := &parsedSignature{
+		signature: query.Get("X-Amz-Signature"),
+		presigned: true,
+	}
+	if err := sig.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	if query.Get("X-Amz-SignedHeaders") == "" || sig.signature == "" {
+		return nil, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "Query-string authentication version 4 requires the X-Amz-Algorithm, X-Amz-Credential, X-Amz-Signature, X-Amz-Date, X-Amz-SignedHeaders, and X-Amz-Expires parameters."}
+	}
+	sig.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	if err := sig.checkSignedHeaders(req); err != nil {
+		return nil, err
+	}
+
+	if err := sig.parseDate(query.Get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 {
+		return nil, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires should be a number."}
+	}
+	sig.expires = time.Duration(expires) * time.Second
+	if sig.expires > maxPresignExpiry {
+		return nil, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be less than a week (in seconds) that is 604800."}
+	}
+
+	sig.payloadHash = unsignedPayload
+	if hash := query.Get("X-Amz-Content-Sha256"); hash != "" {
+		sig.payloadHash = hash
+	}
+	// Chunk signatures chain from an Authorization header
+	if strings.HasPrefix(sig.payloadHash, "STREAMING-") {
+		return nil, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "Presigned URLs can't sign aws-chunked payloads."}
+	}
+	return sig, nil
+}
+
+// checkSignedHeaders requires the host and every x-amz- header of a request
+// to be signed, like AWS: unsigned ones could be changed or added to a
+// captured request
+func (sig *parsedSignature) checkSignedHeaders(req *http.Request) *s3Error {
+	signed := make(map[string]bool, len(sig.signedHeaders))
+	for _, name := range sig.signedHeaders {
+		signed[strings.ToLower(name)] = true
+	}
+	if !signed["host"] {
+		return &s3Error{http.StatusForbidden, "AccessDenied", "The host header must be signed."}
+	}
+	for name := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") && !signed[name] {
+			return &s3Error{http.StatusForbidden, "AccessDenied", "There were headers present in the request which were not signed: " + name}
+		}
+	}
+	return nil
+}
+
+// parseCredential parses "AK/20240101/us-east-1/s3/aws4_request"
+func (sig *parsedSignature) parseCredential(credential string) *s3Error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || parts[0] == "" {
+		return &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed; the Credential is mal-formed; expecting \"<YOUR-AKID>/YYYYMMDD/REGION/SERVICE/aws4_request\"."}
+	}
+	sig.accessKey = parts[0]
+	sig.date = parts[1]
+	sig.region = parts[2]
+	sig.service = parts[3]
+	return nil
+}
+
+func (sig *parsedSignature) parseDate(value string) *s3Error {
+	if value == "" {
+		return &s3Error{http.StatusForbidden, "AccessDenied", "AWS authentication requires a valid Date or x-amz-date header"}
+	}
+	t, err := time.Parse("20060102T150405Z", value)
+	if err != nil {
+		if t, err = http.ParseTime(value); err != nil {
+			return &s3Error{http.StatusForbidden, "AccessDenied", "AWS authentication requires a valid Date or x-amz-date header"}
+		}
+	}
+	sig.amzDate = t.UTC()
+
+	if sig.amzDate.Format("20060102") != sig.date {
+		return &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed; Invalid credential date. Date is not the same as X-Amz-Date."}
+	}
+	return nil
+}
+
+// verifyTime checks the clock skew of signed requests and the expiry of presigned ones
+func (sig *parsedSignature) verifyTime() *s3Error {
+	now := time.Now().UTC()
+	if sig.presigned {
+		if sig.amzDate.After(now.Add(maxRequestTimeSkew)) {
+			return &s3Error{http.StatusForbidden, "AccessDenied", "Request is not valid yet"}
+		}
+		if now.After(sig.amzDate.Add(sig.expires)) {
+			return &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+		}
+		return nil
+	}
+
+	skew := now.Sub(sig.amzDate)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxRequestTimeSkew {
+		return &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large."}
+	}
+	return nil
+}
+
+// computeClientSignature returns the signature the client should have sent
+func computeClientSignature(req *http.Request, sig *parsedSignature, secretKey string) string {
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		canonicalClientQuery(req.URL.RawQuery),
+		canonicalClientHeaders(req, sig.signedHeaders),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+
+	log.Debugf("Client Canonical Request:\n%s", canonicalRequest)
+
+	credentialScope := fmt.Sprintf("%s/%s/%s/aws4_request", sig.date, sig.region, sig.service)
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		signatureAlgorithm,
+		sig.amzDate.Format("20060102T150405Z"),
+		credentialScope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := getSigningKey(secretKey, sig.date, sig.region, sig.service)
+	return hex.EncodeToString(hmacSHA256(signingKey, []byte(stringToSign)))
+}
+
+// canonicalClientQuery builds the canonical query string from the raw query,
+// leaving out the signature of presigned URLs
+func canonicalClientQuery(rawQuery string) string {
+	type param struct{ key, value string }
+	var params []param
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		key, _ := url.QueryUnescape(kv[0])
+		value := ""
+		if len(kv) == 2 {
+			value, _ = url.QueryUnescape(kv[1])
+		}
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		params = append(params, param{awsURIEncode(key, true), awsURIEncode(value, true)})
+	}
+
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].key != params[j].key {
+			return params[i].key < params[j].key
+		}
+		return params[i].value < params[j].value
+	})
+
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.key + "=" + p.value
+	}
+	return strings.Join(parts, "&")
+}
+
+// canonicalClientHeaders renders the signed headers as "name:value\n" lines
+func canonicalClientHeaders(req *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = req.Host
+		case "content-length":
+			// net/http moves Content-Length out of the header map
+			value = strconv.FormatInt(req.ContentLength, 10)
+		default:
+			values := req.Header.Values(name)
+			for i, v := range values {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		b.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	return b.String()
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters (RFC 3986),
+// slashes are kept for paths
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
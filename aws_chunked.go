@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Payload hashes of aws-chunked uploads
+const (
+	streamingSignedPayload          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingSignedPayloadTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedPayloadTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// Hash of an empty string, part of every chunk string to sign
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// chunkSigner verifies the signature chain of an aws-chunked upload, each
+// chunk is signed along with the signature of the previous one, starting with
+// the seed signature of the request
+type chunkSigner struct {
+	signingKey []byte
+	amzDate    string
+	scope      string
+	previous   string
+}
+
+func newChunkSigner(sig *parsedSignature, secretKey string) *chunkSigner {
+	return &chunkSigner{
+		signingKey: getSigningKey(secretKey, sig.date, sig.region, sig.service),
+		amzDate:    sig.amzDate.Format("20060102T150405Z"),
+		scope:      fmt.Sprintf("%s/%s/%s/aws4_request", sig.date, sig.region, sig.service),
+		previous:   strings.ToLower(sig.signature),
+	}
+}
+
+// verify checks the signature of a chunk (AWS4-HMAC-SHA256-PAYLOAD) or of
+// the trailing headers (AWS4-HMAC-SHA256-TRAILER) and moves the chain on
+func (c *chunkSigner) verify(algorithm string, hashes []string, signature string) bool {
+	stringToSign := strings.Join(append([]string{algorithm, c.amzDate, c.scope, c.previous}, hashes...), "\n")
+	expected := hex.EncodeToString(hmacSHA256(c.signingKey, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return false
+	}
+	c.previous = expected
+	return true
+}
+
+// errChunkSignature is returned for a chunk or trailer not matching its signature
+var errChunkSignature = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your key and signing method."}
+
+// decodeAWSChunked returns the payload and trailing headers of an
+// aws-chunked body, verifying every signature when signer is not nil
+func decodeAWSChunked(body []byte, signer *chunkSigner, signedTrailer bool) ([]byte, http.Header, *s3Error) {
+	malformed := &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is not a valid aws-chunked payload."}
+	readLine := func() (string, bool) {
+		end := bytes.Index(body, []byte("\r\n"))
+		if end < 0 {
+			return "", false
+		}
+		line := string(body[:end])
+		body = body[end+2:]
+		return line, true
+	}
+
+	var payload bytes.Buffer
+	for {
+		line, ok := readLine()
+		if !ok {
+			return nil, nil, malformed
+		}
+		// "<hex size>[;chunk-signature=<signature>]"
+		sizeField, extension, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 || size > int64(len(body)) {
+			return nil, nil, malformed
+		}
+		chunk := body[:size]
+		body = body[size:]
+
+		if signer != nil {
+			signature, found := strings.CutPrefix(extension, "chunk-signature=")
+			chunkHash := sha256.Sum256(chunk)
+			if !found || !signer.verify("AWS4-HMAC-SHA256-PAYLOAD", []string{emptyPayloadHash, hex.EncodeToString(chunkHash[:])}, signature) {
+				return nil, nil, errChunkSignature
+			}
+		}
+		if size == 0 {
+			break
+		}
+		payload.Write(chunk)
+		if !bytes.HasPrefix(body, []byte("\r\n")) {
+			return nil, nil, malformed
+		}
+		body = body[2:]
+	}
+
+	// Trailing headers up to an empty line, the signature of signed trailers last
+	trailers := make(http.Header)
+	var canonical strings.Builder
+	trailerSignature := ""
+	for {
+		line, ok := readLine()
+		if !ok {
+			// The final CRLF is optional without trailers
+			if len(body) == 0 && len(trailers) == 0 && !signedTrailer {
+				break
+			}
+			return nil, nil, malformed
+		}
+		if line == "" {
+			break
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, nil, malformed
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if name == "x-amz-trailer-signature" {
+			trailerSignature = value
+			continue
+		}
+		trailers.Add(name, value)
+		canonical.WriteString(name + ":" + value + "\n")
+	}
+
+	if signer != nil && signedTrailer {
+		trailerHash := sha256.Sum256([]byte(canonical.String()))
+		if trailerSignature == "" || !signer.verify("AWS4-HMAC-SHA256-TRAILER", []string{hex.EncodeToString(trailerHash[:])}, trailerSignature) {
+			return nil, nil, errChunkSignature
+		}
+	}
+	return payload.Bytes(), trailers, nil
+}
+
+// decodeStreamingPayload replaces an aws-chunked body by its payload, so the
+// request is forwarded and mirrored like a single-chunk upload. Chunk
+// signatures are verified when signer is not nil.
+func decodeStreamingPayload(req *http.Request, body []byte, signer *chunkSigner) (*http.Request, []byte, *s3Error) {
+	mode := req.Header.Get("X-Amz-Content-Sha256")
+	if !strings.HasPrefix(mode, "STREAMING-") {
+		return req, body, nil
+	}
+
+	signedTrailer := false
+	switch mode {
+	case streamingSignedPayload, streamingSignedPayloadTrailer:
+		// Signed chunks chain from the signature of an Authorization header
+		if signer == nil && clientAuthEnabled() {
+			return nil, nil, &s3Error{http.StatusBadRequest, "InvalidRequest", "Signed aws-chunked uploads require an Authorization header."}
+		}
+		signedTrailer = mode == streamingSignedPayloadTrailer
+	case streamingUnsignedPayloadTrailer:
+		// Chunks are not signed, like an UNSIGNED-PAYLOAD upload
+		signer = nil
+	default:
+		return nil, nil, &s3Error{http.StatusNotImplemented, "NotImplemented", "The x-amz-content-sha256 value " + mode + " is not supported."}
+	}
+
+	payload, trailers, err := decodeAWSChunked(body, signer, signedTrailer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if decoded := req.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" && decoded != strconv.Itoa(len(payload)) {
+		return nil, nil, &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body does not match x-amz-decoded-content-length."}
+	}
+
+	decoded := req.Clone(req.Context())
+	var encodings []string
+	for _, encoding := range strings.Split(req.Header.Get("Content-Encoding"), ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) > 0 {
+		decoded.Header.Set("Content-Encoding", strings.Join(encodings, ","))
+	} else {
+		decoded.Header.Del("Content-Encoding")
+	}
+	decoded.Header.Del("X-Amz-Decoded-Content-Length")
+	decoded.Header.Del("X-Amz-Trailer")
+	// Trailing checksums are sent as headers of the decoded upload
+	for name, values := range trailers {
+		decoded.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	payloadHash := sha256.Sum256(payload)
+	decoded.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	decoded.Header.Set("Content-Length", strconv.Itoa(len(payload)))
+	decoded.ContentLength = int64(len(payload))
+	return decoded, payload, nil
+}
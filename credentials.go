@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// credentialSource fetches credentials, a zero expiration never expires
+type credentialSource interface {
+	fetch() (upstreamCredentials, time.Time, error)
+	name() string
+}
+
+// credentialProvider caches the credentials of an upstream and refreshes them
+// in the background before they expire, requests only wait for a fetch when
+// no valid credentials are cached. A failed refresh keeps serving the
+// previous credentials until they actually expire.
+type credentialProvider struct {
+	upstream    string
+	source      credentialSource
+	credentials upstreamCredentials
+	expiration  time.Time
+	loaded      bool
+	lastErr     error         // Error of the last fetch, nil once one succeeds
+	refreshing  chan struct{} // Closed when the fetch in progress ends, nil without one
+	mutex       sync.Mutex
+}
+
+const (
+	// Credentials are refreshed this long before they expire
+	credentialRefreshWindow = 5 * time.Minute
+	// Mounted credential files are checked for changes this often
+	credentialFileCheckInterval = 10 * time.Second
+)
+
+var (
+	credentialRefreshes = newCounter("s3mirror_credentials_refresh_total", "Upstream credential refreshes.", "upstream", "result")
+	credentialExpiry    = newGauge("s3mirror_credentials_expiry_timestamp_seconds", "Expiration of the current upstream credentials (0 when they never expire).", "upstream")
+)
+
+// Retrieve returns valid credentials, refreshing them in the background when
+// about to expire and waiting for a single shared fetch when missing or expired
+func (p *credentialProvider) Retrieve() (upstreamCredentials, error) {
+	p.mutex.Lock()
+	if p.valid() {
+		if !p.expiration.IsZero() && time.Until(p.expiration) <= credentialRefreshWindow {
+			p.startRefresh()
+		}
+		credentials := p.credentials
+		p.mutex.Unlock()
+		return credentials, nil
+	}
+	done := p.startRefresh()
+	p.mutex.Unlock()
+
+	<-done
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.valid() {
+		return p.credentials, nil
+	}
+	return upstreamCredentials{}, p.lastErr
+}
+
+// valid tells if the cached credentials have not expired, with the mutex held
+func (p *credentialProvider) valid() bool {
+	return p.loaded && (p.expiration.IsZero() || time.Now().Before(p.expiration))
+}
+
+// startRefresh starts a fetch unless one is in progress, with the mutex
+// held, and returns the channel closed when it ends
+func (p *credentialProvider) startRefresh() chan struct{} {
+	if p.refreshing == nil {
+		p.refreshing = make(chan struct{})
+		go p.refresh(p.refreshing)
+	}
+	return p.refreshing
+}
+
+// refresh fetches credentials without holding the mutex
+func (p *credentialProvider) refresh(done chan struct{}) {
+	credentials, expiration, err := p.source.fetch()
+	if err == nil && (credentials.AccessKey == "" || credentials.SecretKey == "") {
+		err = fmt.Errorf("no access key or secret key")
+	}
+
+	p.mutex.Lock()
+	defer func() {
+		p.refreshing = nil
+		close(done)
+		p.mutex.Unlock()
+	}()
+
+	if err != nil {
+		credentialRefreshes.Inc(p.upstream, "error")
+		p.lastErr = fmt.Errorf("failed to obtain %s credentials (%s): %w", p.upstream, p.source.name(), err)
+		if p.valid() {
+			log.Warnf("Failed to refresh %s credentials (%s), using the current ones: %v", p.upstream, p.source.name(), err)
+		}
+		return
+	}
+
+	if p.loaded && credentials.AccessKey != p.credentials.AccessKey {
+		log.Infof("Rotated %s credentials (%s) to access key %s", p.upstream, p.source.name(), credentials.AccessKey)
+	}
+	credentialRefreshes.Inc(p.upstream, "success")
+	if expiration.IsZero() {
+		credentialExpiry.Set(0, p.upstream)
+	} else {
+		credentialExpiry.Set(float64(expiration.Unix()), p.upstream)
+	}
+
+	p.credentials = credentials
+	p.expiration = expiration
+	p.loaded = true
+	p.lastErr = nil
+}
+
+// refreshLoop refreshes credentials in the background so requests never wait on STS
+func (p *credentialProvider) refreshLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := p.Retrieve(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// newCredentialProvider builds the provider of an upstream from its
+// prefixed environment (MAIN_, MIRROR_, ...). Without an explicit
+// <PREFIX>_CREDENTIALS_PROVIDER the first configured source is used: static
+// keys, credentials file, credential process, web identity, then profile.
+func newCredentialProvider(prefix, upstream string) (*credentialProvider, error) {
+	env := func(name string) string { return getEnv(prefix + "_" + name) }
+
+	kind := env("CREDENTIALS_PROVIDER")
+	if kind == "" {
+		switch {
+		case env("ACCESS_KEY") != "" || env("SECRET_KEY") != "":
+			kind = "env"
+		case env("CREDENTIALS_FILE") != "":
+			kind = "file"
+		case env("CREDENTIAL_PROCESS") != "":
+			kind = "process"
+		case env("WEB_IDENTITY_TOKEN_FILE") != "":
+			kind = "web-identity"
+		case env("PROFILE") != "":
+			kind = "profile"
+		default:
+			return nil, fmt.Errorf("no credentials configured for %s, set %s_ACCESS_KEY and %s_SECRET_KEY or another credential source", upstream, prefix, prefix)
+		}
+	}
+
+	var source credentialSource
+	switch kind {
+	case "env":
+		if env("ACCESS_KEY") == "" || env("SECRET_KEY") == "" {
+			return nil, fmt.Errorf("%s_ACCESS_KEY and %s_SECRET_KEY are required", prefix, prefix)
+		}
+		source = &staticCredentialSource{upstreamCredentials{
+			AccessKey:    env("ACCESS_KEY"),
+			SecretKey:    env("SECRET_KEY"),
+			SessionToken: env("SESSION_TOKEN"),
+		}}
+	case "file":
+		if env("CREDENTIALS_FILE") == "" {
+			return nil, fmt.Errorf("%s_CREDENTIALS_FILE is required", prefix)
+		}
+		source = &fileCredentialSource{path: env("CREDENTIALS_FILE")}
+	case "process":
+		if env("CREDENTIAL_PROCESS") == "" {
+			return nil, fmt.Errorf("%s_CREDENTIAL_PROCESS is required", prefix)
+		}
+		source = &processCredentialSource{command: env("CREDENTIAL_PROCESS")}
+	case "web-identity":
+		webIdentity, err := newWebIdentitySource(env("WEB_IDENTITY_TOKEN_FILE"), env("ROLE_ARN"), env("ROLE_SESSION_NAME"), env("STS_ENDPOINT"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", prefix, err)
+		}
+		source = webIdentity
+	case "profile":
+		profile, err := loadProfileSource(env("PROFILE"))
+		if err != nil {
+			return nil, fmt.Errorf("%s_PROFILE: %w", prefix, err)
+		}
+		source = profile
+	default:
+		return nil, fmt.Errorf("invalid %s_CREDENTIALS_PROVIDER %q, expected env, file, process, web-identity or profile", prefix, kind)
+	}
+
+	log.Infof("Using %s credentials for %s", source.name(), upstream)
+	return &credentialProvider{upstream: upstream, source: source}, nil
+}
+
+// startCredentialRefresh fetches the upstream credentials once and keeps them fresh
+func startCredentialRefresh() {
+	var providers []*credentialProvider
+	for _, backend := range mainBackends {
+		providers = append(providers, backend.credentials)
+	}
+	for _, target := range mirrorTargets {
+		if target.credentials != nil {
+			providers = append(providers, target.credentials)
+		}
+	}
+	for _, p := range providers {
+		if _, err := p.Retrieve(); err != nil {
+			log.Fatal(err)
+		}
+		go p.refreshLoop()
+	}
+}
+
+// staticCredentialSource serves keys from the environment
+type staticCredentialSource struct {
+	credentials upstreamCredentials
+}
+
+func (s *staticCredentialSource) fetch() (upstreamCredentials, time.Time, error) {
+	return s.credentials, time.Time{}, nil
+}
+
+func (s *staticCredentialSource) name() string { return "environment" }
+
+// fileCredentialSource reads a JSON file, typically a mounted Kubernetes
+// secret: {"accessKey": "...", "secretKey": "...", "sessionToken": "..."}
+type fileCredentialSource struct {
+	path string
+}
+
+func (s *fileCredentialSource) fetch() (upstreamCredentials, time.Time, error) {
+	var credentials upstreamCredentials
+	if err := loadConfigFile(s.path, &credentials); err != nil {
+		return upstreamCredentials{}, time.Time{}, err
+	}
+	// Expiring soon makes the provider re-read the file periodically
+	return credentials, time.Now().Add(credentialRefreshWindow + credentialFileCheckInterval), nil
+}
+
+func (s *fileCredentialSource) name() string { return "file " + s.path }
+
+// processCredentialSource runs a credential_process command printing
+// {"Version": 1, "AccessKeyId": ..., "SecretAccessKey": ..., "SessionToken": ..., "Expiration": ...}
+type processCredentialSource struct {
+	command string
+}
+
+func (s *processCredentialSource) fetch() (upstreamCredentials, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return upstreamCredentials{}, time.Time{}, fmt.Errorf("credential process failed: %w", err)
+	}
+
+	var result struct {
+		Version         int
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      *time.Time
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return upstreamCredentials{}, time.Time{}, fmt.Errorf("invalid credential process output: %w", err)
+	}
+	if result.Version != 1 {
+		return upstreamCredentials{}, time.Time{}, fmt.Errorf("unsupported credential process version %d", result.Version)
+	}
+
+	var expiration time.Time
+	if result.Expiration != nil {
+		expiration = *result.Expiration
+	}
+	return upstreamCredentials{
+		AccessKey:    result.AccessKeyID,
+		SecretKey:    result.SecretAccessKey,
+		SessionToken: result.SessionToken,
+	}, expiration, nil
+}
+
+func (s *processCredentialSource) name() string { return "credential process" }
+
+// webIdentitySource exchanges a projected service account token for temporary
+// credentials with AssumeRoleWithWebIdentity on an STS-compatible endpoint
+type webIdentitySource struct {
+	tokenFile   string
+	roleARN     string
+	sessionName string
+	endpoint    string
+}
+
+func newWebIdentitySource(tokenFile, roleARN, sessionName, endpoint string) (*webIdentitySource, error) {
+	if tokenFile == "" || roleARN == "" {
+		return nil, fmt.Errorf("web identity credentials need a token file and a role ARN")
+	}
+	if sessionName == "" {
+		sessionName = "s3-mirror"
+	}
+	if endpoint == "" {
+		endpoint = "https://sts.amazonaws.com"
+	}
+	return &webIdentitySource{tokenFile: tokenFile, roleARN: roleARN, sessionName: sessionName, endpoint: endpoint}, nil
+}
+
+func (s *webIdentitySource) fetch() (upstreamCredentials, time.Time, error) {
+	// The token is rotated by the kubelet, read it every time
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return upstreamCredentials{}, time.Time{}, err
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {s.roleARN},
+		"RoleSessionName":  {s.sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	resp, err := httpClient.PostForm(s.endpoint, form)
+	if err != nil {
+		return upstreamCredentials{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return upstreamCredentials{}, time.Time{}, fmt.Errorf("AssumeRoleWithWebIdentity failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return upstreamCredentials{}, time.Time{}, fmt.Errorf("invalid AssumeRoleWithWebIdentity response: %w", err)
+	}
+	return upstreamCredentials{
+		AccessKey:    result.Credentials.AccessKeyID,
+		SecretKey:    result.Credentials.SecretAccessKey,
+		SessionToken: result.Credentials.SessionToken,
+	}, result.Credentials.Expiration, nil
+}
+
+func (s *webIdentitySource) name() string { return "web identity " + s.roleARN }
+
+// loadProfileSource resolves a profile of the shared credentials and config
+// files (AWS_SHARED_CREDENTIALS_FILE, AWS_CONFIG_FILE) into the source it uses
+func loadProfileSource(profile string) (credentialSource, error) {
+	home, _ := os.UserHomeDir()
+	credentialsFile := getEnvOrDefault("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(home, ".aws", "credentials"))
+	configFile := getEnvOrDefault("AWS_CONFIG_FILE", filepath.Join(home, ".aws", "config"))
+
+	settings := make(map[string]string)
+	found := false
+	// The config file names its sections "profile NAME", except the default one
+	configSection := "profile " + profile
+	if profile == "default" {
+		configSection = "default"
+	}
+	for _, f := range []struct{ path, section string }{{configFile, configSection}, {credentialsFile, profile}} {
+		values, err := readINISection(f.path, f.section)
+		if err != nil {
+			return nil, err
+		}
+		if values != nil {
+			found = true
+		}
+		// Credentials file values take precedence
+		for k, v := range values {
+			settings[k] = v
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("profile %q not found in %s or %s", profile, credentialsFile, configFile)
+	}
+
+	switch {
+	case settings["aws_access_key_id"] != "":
+		return &staticCredentialSource{upstreamCredentials{
+			AccessKey:    settings["aws_access_key_id"],
+			SecretKey:    settings["aws_secret_access_key"],
+			SessionToken: settings["aws_session_token"],
+		}}, nil
+	case settings["credential_process"] != "":
+		return &processCredentialSource{command: settings["credential_process"]}, nil
+	case settings["web_identity_token_file"] != "":
+		return newWebIdentitySource(settings["web_identity_token_file"], settings["role_arn"], settings["role_session_name"], settings["sts_endpoint"])
+	case settings["source_profile"] != "":
+		return nil, fmt.Errorf("profile %q uses source_profile, which is not supported", profile)
+	}
+	return nil, fmt.Errorf("profile %q has no usable credentials", profile)
+}
+
+// readINISection returns the keys of a section of an INI file, nil when the
+// file or the section does not exist
+func readINISection(path, section string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var values map[string]string
+	current := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			if current == section && values == nil {
+				values = make(map[string]string)
+			}
+			continue
+		}
+		if current != section {
+			continue
+		}
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingSource returns its credentials once released, counting fetches
+type blockingSource struct {
+	release    chan struct{}
+	fetches    atomic.Int32
+	expiration time.Time
+	err        error
+}
+
+func (s *blockingSource) fetch() (upstreamCredentials, time.Time, error) {
+	s.fetches.Add(1)
+	<-s.release
+	if s.err != nil {
+		return upstreamCredentials{}, time.Time{}, s.err
+	}
+	return upstreamCredentials{AccessKey: "fresh", SecretKey: "secret"}, s.expiration, nil
+}
+
+func (s *blockingSource) name() string { return "test" }
+
+func TestCredentialProviderSingleFetch(t *testing.T) {
+	source := &blockingSource{release: make(chan struct{})}
+	p := &credentialProvider{upstream: "test", source: source}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if credentials, err := p.Retrieve(); err != nil || credentials.AccessKey != "fresh" {
+				t.Errorf("Retrieve = %v, %v", credentials, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(source.release)
+	wg.Wait()
+
+	if n := source.fetches.Load(); n != 1 {
+		t.Errorf("%d fetches for concurrent requests, want 1", n)
+	}
+}
+
+func TestCredentialProviderBackgroundRefresh(t *testing.T) {
+	source := &blockingSource{release: make(chan struct{}), expiration: time.Now().Add(time.Hour)}
+	p := &credentialProvider{
+		upstream:    "test",
+		source:      source,
+		credentials: upstreamCredentials{AccessKey: "cached", SecretKey: "secret"},
+		expiration:  time.Now().Add(time.Minute), // Inside the refresh window
+		loaded:      true,
+	}
+
+	// Cached credentials are served while the refresh is blocked
+	for i := 0; i < 3; i++ {
+		credentials, err := p.Retrieve()
+		if err != nil || credentials.AccessKey != "cached" {
+			t.Fatalf("Retrieve = %v, %v, want the cached credentials", credentials, err)
+		}
+	}
+	close(source.release)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		credentials, _ := p.Retrieve()
+		if credentials.AccessKey == "fresh" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refreshed credentials were never served")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := source.fetches.Load(); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+}
+
+func TestCredentialProviderFailedRefresh(t *testing.T) {
+	source := &blockingSource{release: make(chan struct{}), err: errors.New("sts unavailable")}
+	close(source.release)
+	p := &credentialProvider{
+		upstream:    "test",
+		source:      source,
+		credentials: upstreamCredentials{AccessKey: "cached", SecretKey: "secret"},
+		expiration:  time.Now().Add(time.Minute),
+		loaded:      true,
+	}
+
+	if credentials, err := p.Retrieve(); err != nil || credentials.AccessKey != "cached" {
+		t.Fatalf("Retrieve = %v, %v, want the cached credentials", credentials, err)
+	}
+
+	// Once they expire the error of the fetch is returned
+	p.mutex.Lock()
+	p.expiration = time.Now().Add(-time.Second)
+	p.mutex.Unlock()
+	if _, err := p.Retrieve(); err == nil {
+		t.Error("Retrieve returned expired credentials")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How deletes of main reach the mirror copies
+const (
+	deleteModePropagate = "propagate" // Delete the copies immediately
+	deleteModeIgnore    = "ignore"    // Keep the copies forever
+	deleteModeDelay     = "delay"     // Delete the copies days after the object
+	deleteModeTrash     = "trash"     // Move the copies under trashPrefix, deleted after days (0 keeps them)
+)
+
+// Tombstone states of deleted objects
+const (
+	tombstoneRetained = "retained" // Copies kept forever
+	tombstoneDelayed  = "delayed"  // Copies deleted at PurgeAt
+	tombstoneTrashed  = "trashed"  // Copies moved to TrashKey, deleted at PurgeAt when set
+	tombstonePurged   = "purged"   // Copies (or trash copies) deleted by the purge
+)
+
+// deletePolicy decides what happens to the mirror copies of the objects
+// deleted from the buckets it matches
+type deletePolicy struct {
+	Bucket      string `json:"bucket"`      // Bucket name or glob pattern, empty matches every bucket
+	Mode        string `json:"mode"`        // propagate, ignore, delay or trash
+	Days        int    `json:"days"`        // Delay of delay mode, expiry of the trash copies
+	TrashPrefix string `json:"trashPrefix"` // Prepended to the mirror key of trash copies, .trash/ by default
+}
+
+type deleteConfig struct {
+	Policies []*deletePolicy `json:"policies"`
+}
+
+var (
+	// Policies in order, the first matching one applies
+	deletePolicies      []*deletePolicy
+	deletePurgeInterval time.Duration
+
+	// Without a matching policy deletes are mirrored right away
+	defaultDeletePolicy = &deletePolicy{Mode: deleteModePropagate}
+
+	deletePurges = newCounter("s3mirror_delete_purges_total", "Deleted objects whose mirror copies were purged.", "result")
+)
+
+func loadDeletePolicies() {
+	interval, err := time.ParseDuration(getEnvOrDefault("MIRROR_DELETE_PURGE_INTERVAL", "1h"))
+	if err != nil || interval < 0 {
+		log.Fatalf("Invalid MIRROR_DELETE_PURGE_INTERVAL: %v", err)
+	}
+	deletePurgeInterval = interval
+
+	configPath := getEnv("MIRROR_DELETE_CONFIG")
+	if configPath == "" {
+		return
+	}
+
+	var config deleteConfig
+	if err := loadConfigFile(configPath, &config); err != nil {
+		log.Fatalf("Failed to load MIRROR_DELETE_CONFIG: %v", err)
+	}
+
+	for i, policy := range config.Policies {
+		if err := policy.validate(); err != nil {
+			log.Fatalf("Delete policy %d: %v", i+1, err)
+		}
+		if policy.purges() && inventoryBackend == inventoryBackendNone {
+			log.Fatalf("Delete policy %d: %s mode with days requires an inventory backend to schedule the purge", i+1, policy.Mode)
+		}
+	}
+	deletePolicies = config.Policies
+	log.Infof("Loaded %d mirror delete policies", len(deletePolicies))
+}
+
+func (p *deletePolicy) validate() error {
+	if _, err := path.Match(p.Bucket, ""); err != nil {
+		return fmt.Errorf("invalid bucket pattern %q: %w", p.Bucket, err)
+	}
+	switch p.Mode {
+	case deleteModePropagate, deleteModeIgnore:
+		if p.Days != 0 || p.TrashPrefix != "" {
+			return fmt.Errorf("days and trashPrefix do not apply to %s mode", p.Mode)
+		}
+	case deleteModeDelay:
+		if p.Days <= 0 {
+			return fmt.Errorf("delay mode requires days")
+		}
+		if p.TrashPrefix != "" {
+			return fmt.Errorf("trashPrefix does not apply to delay mode")
+		}
+	case deleteModeTrash:
+		if p.Days < 0 {
+			return fmt.Errorf("days must not be negative")
+		}
+		if p.TrashPrefix == "" {
+			p.TrashPrefix = ".trash/"
+		}
+	default:
+		return fmt.Errorf("invalid mode %q, expected propagate, ignore, delay or trash", p.Mode)
+	}
+	return nil
+}
+
+// matchDeletePolicy returns the first policy matching a bucket (as seen by clients)
+func matchDeletePolicy(bucket string) *deletePolicy {
+	for _, policy := range deletePolicies {
+		if policy.Bucket == "" {
+			return policy
+		}
+		if ok, _ := path.Match(policy.Bucket, bucket); ok {
+			return policy
+		}
+	}
+	return defaultDeletePolicy
+}
+
+// purges tells if copies are deleted later by the purge
+func (p *deletePolicy) purges() bool {
+	return p.Mode == deleteModeDelay || (p.Mode == deleteModeTrash && p.Days > 0)
+}
+
+// deletesNow tells if the copies leave their key when the object is deleted
+func (p *deletePolicy) deletesNow() bool {
+	return p.Mode == deleteModePropagate || p.Mode == deleteModeTrash
+}
+
+// tombstone returns the tombstone of an object deleted at a time, nil when
+// the copies are deleted right away
+func (p *deletePolicy) tombstone(mirrorKey string, at time.Time) *Tombstone {
+	var tombstone *Tombstone
+	switch p.Mode {
+	case deleteModeIgnore:
+		tombstone = &Tombstone{State: tombstoneRetained}
+	case deleteModeDelay:
+		tombstone = &Tombstone{State: tombstoneDelayed}
+	case deleteModeTrash:
+		tombstone = &Tombstone{State: tombstoneTrashed, TrashKey: p.TrashPrefix + mirrorKey}
+	default:
+		return nil
+	}
+	if p.purges() {
+		purgeAt := at.AddDate(0, 0, p.Days)
+		tombstone.PurgeAt = &purgeAt
+	}
+	return tombstone
+}
+
+// deleteMirrorCopy removes the copy of a deleted object from its key on a
+// target, moving it to the trash key first in trash mode
+func (p *deletePolicy) deleteMirrorCopy(target *mirrorTarget, bucket, mirrorBucket, mirrorKey string, tombstone *Tombstone, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) error {
+	if p.Mode == deleteModeTrash {
+		if err := target.store.copyObject(bucket, mirrorBucket, mirrorKey, tombstone.TrashKey, nil); err != nil {
+			return fmt.Errorf("failed to move the copy to %s: %w", tombstone.TrashKey, err)
+		}
+	}
+	return mirrorToBackupS3(target, bucket, mirrorBucket, mirrorKey, "DELETE", nil, headers, creds, clientVirtualHosted)
+}
+
+// operation names the mirrored operation in metrics
+func (p *deletePolicy) operation() string {
+	if p.Mode == deleteModeTrash {
+		return "trash"
+	}
+	return "delete"
+}
+
+// recordTombstone stores the tombstone of a deleted object in the inventory
+func recordTombstone(bucket, key string, tombstone *Tombstone) {
+	if inventory == nil || tombstone == nil {
+		return
+	}
+	if err := inventory.SetTombstone(bucket, key, *tombstone); err != nil {
+		log.Errorf("Failed to record tombstone of %s/%s: %v", bucket, key, err)
+	}
+}
+
+// startDeletePurger deletes the copies of delayed and trashed objects once
+// due, on a fixed interval
+func startDeletePurger(store InventoryStore) {
+	if deletePurgeInterval == 0 || len(deletePolicies) == 0 || store == nil {
+		return
+	}
+
+	log.Infof("Purging delayed and trashed mirror copies every %s", deletePurgeInterval)
+
+	go func() {
+		ticker := time.NewTicker(deletePurgeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			purgeDeletedObjects(store, time.Now().UTC())
+		}
+	}()
+}
+
+// purgeDeletedObjects deletes the copies of every deleted object due at a time
+func purgeDeletedObjects(store InventoryStore, now time.Time) {
+	buckets, err := store.Buckets()
+	if err != nil {
+		log.Errorf("Failed to list inventory buckets for the purge: %v", err)
+		return
+	}
+
+	for _, bucket := range buckets {
+		startAfter := ""
+		for {
+			records, err := store.ListObjects(bucket, ObjectQuery{StartAfter: startAfter, Limit: 1000, PurgeDue: now})
+			if err != nil {
+				log.Errorf("Failed to list objects to purge in bucket %s: %v", bucket, err)
+				break
+			}
+			for _, rec := range records {
+				if err := purgeMirrorCopies(store, bucket, rec.Key, now); err != nil {
+					log.Errorf("Failed to purge copies of %s/%s: %v", bucket, rec.Key, err)
+					deletePurges.Inc("error")
+					continue
+				}
+				deletePurges.Inc("success")
+			}
+			if len(records) < 1000 {
+				break
+			}
+			startAfter = records[len(records)-1].Key
+		}
+	}
+}
+
+// purgeMirrorCopies deletes the copies of a deleted object from every target
+// and marks its tombstone purged, failures are retried on the next run
+func purgeMirrorCopies(store InventoryStore, bucket, key string, now time.Time) error {
+	// The object may have been written again since it was listed
+	rec, err := store.GetObject(bucket, key)
+	if err != nil || rec == nil || !rec.purgeDue(now) {
+		return err
+	}
+
+	rule, mirrorKey, err := recordedReplication(bucket, key, rec)
+	if err != nil {
+		return err
+	}
+	if rec.Tombstone.State == tombstoneTrashed {
+		mirrorKey = rec.Tombstone.TrashKey
+	}
+
+	var failed []string
+	for _, target := range rule.targets(bucket) {
+		creds, err := target.retrieveCredentials()
+		if err == nil {
+			err = target.store.deleteObject(rule.mirrorBucket(target, bucket, key), mirrorKey, nil, creds, false)
+		}
+		recordMirrorStatus(target, bucket, key, "purge", err)
+		if err != nil {
+			failed = append(failed, target.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("purge failed on %s", strings.Join(failed, ", "))
+	}
+
+	log.Infof("Purged mirror copies of %s/%s (%s)", bucket, key, rec.Tombstone.State)
+	return store.SetTombstone(bucket, key, Tombstone{State: tombstonePurged})
+}
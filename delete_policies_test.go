@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withFilesystemTarget makes a filesystem store the only mirror target for a test
+func withFilesystemTarget(t *testing.T) *filesystemMirrorStore {
+	store := newTestFilesystemStore(t)
+	previous := mirrorTargets
+	mirrorTargets = []*mirrorTarget{store.target}
+	t.Cleanup(func() { mirrorTargets = previous })
+	return store
+}
+
+func TestDeletePolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy deletePolicy
+		valid  bool
+	}{
+		{deletePolicy{Mode: deleteModePropagate}, true},
+		{deletePolicy{Mode: deleteModeIgnore, Days: 1}, false},
+		{deletePolicy{Mode: deleteModeDelay, Days: 7}, true},
+		{deletePolicy{Mode: deleteModeDelay}, false},
+		{deletePolicy{Mode: deleteModeDelay, Days: 7, TrashPrefix: "bin/"}, false},
+		{deletePolicy{Mode: deleteModeTrash}, true},
+		{deletePolicy{Mode: deleteModeTrash, Days: -1}, false},
+		{deletePolicy{Mode: "archive"}, false},
+		{deletePolicy{Bucket: "logs-[", Mode: deleteModeIgnore}, false},
+	}
+	for _, tt := range tests {
+		policy := tt.policy
+		if err := policy.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(%+v) = %v, want valid %v", tt.policy, err, tt.valid)
+		}
+	}
+
+	trash := deletePolicy{Mode: deleteModeTrash}
+	trash.validate()
+	if trash.TrashPrefix != ".trash/" || trash.purges() || !trash.deletesNow() {
+		t.Errorf("trash policy without days = %+v, want copies moved to .trash/ and kept", trash)
+	}
+}
+
+func TestMatchDeletePolicy(t *testing.T) {
+	logs := &deletePolicy{Bucket: "logs-*", Mode: deleteModeIgnore}
+	all := &deletePolicy{Mode: deleteModeDelay, Days: 1}
+	previous := deletePolicies
+	defer func() { deletePolicies = previous }()
+
+	deletePolicies = []*deletePolicy{logs}
+	if matchDeletePolicy("logs-eu") != logs || matchDeletePolicy("photos") != defaultDeletePolicy {
+		t.Error("buckets without a policy must propagate their deletes")
+	}
+	deletePolicies = []*deletePolicy{logs, all}
+	if matchDeletePolicy("logs-eu") != logs || matchDeletePolicy("photos") != all {
+		t.Error("the first matching policy must apply")
+	}
+}
+
+func TestDeletePolicyTombstones(t *testing.T) {
+	at := time.Date(2024, 3, 7, 9, 30, 0, 0, time.UTC)
+	week := at.AddDate(0, 0, 7)
+
+	tests := []struct {
+		policy   deletePolicy
+		state    string
+		trashKey string
+		purgeAt  *time.Time
+	}{
+		{deletePolicy{Mode: deleteModePropagate}, "", "", nil},
+		{deletePolicy{Mode: deleteModeIgnore}, tombstoneRetained, "", nil},
+		{deletePolicy{Mode: deleteModeDelay, Days: 7}, tombstoneDelayed, "", &week},
+		{deletePolicy{Mode: deleteModeTrash, TrashPrefix: "bin/"}, tombstoneTrashed, "bin/2024/a", nil},
+		{deletePolicy{Mode: deleteModeTrash, Days: 7, TrashPrefix: "bin/"}, tombstoneTrashed, "bin/2024/a", &week},
+	}
+	for _, tt := range tests {
+		tombstone := tt.policy.tombstone("2024/a", at)
+		if tt.state == "" {
+			if tombstone != nil {
+				t.Errorf("%s tombstone = %+v, want none", tt.policy.Mode, tombstone)
+			}
+			continue
+		}
+		if tombstone == nil || tombstone.State != tt.state || tombstone.TrashKey != tt.trashKey ||
+			(tombstone.PurgeAt == nil) != (tt.purgeAt == nil) || (tt.purgeAt != nil && !tombstone.PurgeAt.Equal(*tt.purgeAt)) {
+			t.Errorf("%s (%d days) tombstone = %+v, want %s %q purged at %v", tt.policy.Mode, tt.policy.Days, tombstone, tt.state, tt.trashKey, tt.purgeAt)
+		}
+	}
+}
+
+func TestDeletePurgeFlow(t *testing.T) {
+	fs := withFilesystemTarget(t)
+	target := fs.target
+	store := withInventory(t)
+	at := time.Date(2024, 3, 7, 9, 30, 0, 0, time.UTC)
+
+	copyPath := func(key string) string {
+		return filepath.Join(fs.root, target.bucketName("bucket"), filepath.FromSlash(key))
+	}
+	exists := func(key string) bool {
+		_, err := os.Stat(copyPath(key))
+		return err == nil
+	}
+
+	// Objects deleted under a trash, a delay and an ignore policy, and one
+	// written again after its delete
+	policies := map[string]*deletePolicy{
+		"trashed":   {Mode: deleteModeTrash, Days: 7, TrashPrefix: ".trash/"},
+		"delayed":   {Mode: deleteModeDelay, Days: 3},
+		"retained":  {Mode: deleteModeIgnore},
+		"rewritten": {Mode: deleteModeDelay, Days: 1},
+	}
+	for key, policy := range policies {
+		if err := fs.putObject("bucket", target.bucketName("bucket"), key, []byte(key), http.Header{}, upstreamCredentials{}, false); err != nil {
+			t.Fatal(err)
+		}
+		store.UpsertObject("bucket", ObjectRecord{Key: key, Size: int64(len(key))})
+		store.MarkDeleted("bucket", key, at)
+
+		tombstone := policy.tombstone(key, at)
+		if policy.deletesNow() {
+			if err := policy.deleteMirrorCopy(target, "bucket", target.bucketName("bucket"), key, tombstone, nil, upstreamCredentials{}, false); err != nil {
+				t.Fatalf("deleteMirrorCopy(%s): %v", key, err)
+			}
+		}
+		recordTombstone("bucket", key, tombstone)
+	}
+	store.UpsertObject("bucket", ObjectRecord{Key: "rewritten", Size: 1})
+
+	if exists("trashed") || !exists(".trash/trashed") {
+		t.Error("trash policy must move the copy to the trash key")
+	}
+	for _, key := range []string{"delayed", "retained", "rewritten"} {
+		if !exists(key) {
+			t.Errorf("copy of %s deleted before its purge", key)
+		}
+	}
+
+	tests := []struct {
+		day     int
+		present []string
+		purged  []string
+	}{
+		{1, []string{".trash/trashed", "delayed", "retained", "rewritten"}, nil},
+		{3, []string{".trash/trashed", "retained", "rewritten"}, []string{"delayed"}},
+		{7, []string{"retained", "rewritten"}, []string{"delayed", "trashed"}},
+		{30, []string{"retained", "rewritten"}, []string{"delayed", "trashed"}},
+	}
+	for _, tt := range tests {
+		purgeDeletedObjects(store, at.AddDate(0, 0, tt.day))
+		for _, key := range tt.present {
+			if !exists(key) {
+				t.Errorf("day %d: copy %s purged", tt.day, key)
+			}
+		}
+		for _, key := range tt.purged {
+			rec, _ := store.GetObject("bucket", key)
+			if rec == nil || rec.Tombstone == nil || rec.Tombstone.State != tombstonePurged {
+				t.Errorf("day %d: %s = %+v, want a purged tombstone", tt.day, key, rec)
+			}
+		}
+	}
+	for _, key := range []string{"delayed", ".trash/trashed"} {
+		if exists(key) {
+			t.Errorf("copy %s left after its purge", key)
+		}
+	}
+	if rec, _ := store.GetObject("bucket", "retained"); rec == nil || rec.Tombstone == nil || rec.Tombstone.State != tombstoneRetained {
+		t.Errorf("retained = %+v, want its copies kept", rec)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mirror copies are encrypted with a random data key per object, sealed in
+// 64 KiB AES-256-GCM chunks (STREAM construction: 7 byte nonce prefix, 4 byte
+// chunk counter, 1 byte last-chunk flag). The data key is wrapped by a master
+// key from the keyring and stored with the algorithm in the object metadata.
+const (
+	encryptionAlgorithm = "AES-256-GCM-STREAM-64K"
+	encryptionChunkSize = 64 * 1024
+	encryptionTagSize   = 16
+	encryptionPrefixLen = 7
+
+	// Metadata of encrypted mirror objects
+	encryptionMetaAlgorithm = "X-Amz-Meta-S3mirror-Enc"
+	encryptionMetaKeyID     = "X-Amz-Meta-S3mirror-Enc-Key-Id"
+	encryptionMetaKey       = "X-Amz-Meta-S3mirror-Enc-Key"
+	encryptionMetaNonce     = "X-Amz-Meta-S3mirror-Enc-Nonce"
+	encryptionMetaSize      = "X-Amz-Meta-S3mirror-Enc-Size"
+)
+
+// encryptionKeyring holds the master keys, new objects use the primary one
+// and the others are kept to decrypt older objects
+type encryptionKeyring struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"` // Key id to base64 encoded 32 byte key
+
+	keys map[string][]byte
+}
+
+// Keyring used to encrypt mirror copies, nil disables encryption
+var mirrorKeyring *encryptionKeyring
+
+func loadEncryptionConfig() {
+	path := getEnv("MIRROR_ENCRYPTION_KEYRING")
+	if path == "" {
+		return
+	}
+
+	var keyring encryptionKeyring
+	if err := loadConfigFile(path, &keyring); err != nil {
+		log.Fatalf("Failed to load MIRROR_ENCRYPTION_KEYRING: %v", err)
+	}
+
+	keyring.keys = make(map[string][]byte)
+	for id, encoded := range keyring.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			log.Fatalf("Encryption key %q must be 32 bytes encoded in base64", id)
+		}
+		keyring.keys[id] = key
+	}
+	if keyring.keys[keyring.Primary] == nil {
+		log.Fatalf("Primary encryption key %q is not in the keyring", keyring.Primary)
+	}
+
+	mirrorKeyring = &keyring
+	log.Infof("Mirror copies are encrypted with key %s (%d keys in the keyring)", keyring.Primary, len(keyring.keys))
+}
+
+// encryptMirrorObject encrypts a body for the mirror and returns the headers to
+// send with it. Headers describing the plaintext (checksums, MD5) are dropped.
+func encryptMirrorObject(body []byte, headers http.Header) ([]byte, http.Header, error) {
+	dataKey := make([]byte, 32)
+	prefix := make([]byte, encryptionPrefixLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := mirrorKeyring.wrap(mirrorKeyring.Primary, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunks := len(body)/encryptionChunkSize + 1
+	ciphertext := make([]byte, 0, len(body)+chunks*encryptionTagSize)
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * encryptionChunkSize
+		if end > len(body) {
+			end = len(body)
+		}
+		ciphertext = aead.Seal(ciphertext, chunkNonce(prefix, uint32(i), i == chunks-1), body[i*encryptionChunkSize:end], nil)
+	}
+
+	encrypted := make(http.Header)
+	for k, v := range headers {
+		if k == "Content-Md5" || strings.HasPrefix(k, "X-Amz-Checksum-") || k == "X-Amz-Sdk-Checksum-Algorithm" || k == "X-Amz-Decoded-Content-Length" {
+			continue
+		}
+		encrypted[k] = v
+	}
+	encrypted.Set(encryptionMetaAlgorithm, encryptionAlgorithm)
+	encrypted.Set(encryptionMetaKeyID, mirrorKeyring.Primary)
+	encrypted.Set(encryptionMetaKey, wrapped)
+	encrypted.Set(encryptionMetaNonce, base64.StdEncoding.EncodeToString(prefix))
+	encrypted.Set(encryptionMetaSize, strconv.Itoa(len(body)))
+	return ciphertext, encrypted, nil
+}
+
+// isEncryptedMirrorObject tells if the headers of a mirror object describe an encrypted copy
+func isEncryptedMirrorObject(headers http.Header) bool {
+	return headers.Get(encryptionMetaAlgorithm) != ""
+}
+
+// newDecryptingReader returns the plaintext of an encrypted mirror object,
+// chunk by chunk so large objects are never held in memory
+func newDecryptingReader(body io.Reader, headers http.Header) (io.Reader, error) {
+	if algorithm := headers.Get(encryptionMetaAlgorithm); algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", algorithm)
+	}
+	if mirrorKeyring == nil {
+		return nil, fmt.Errorf("object is encrypted but MIRROR_ENCRYPTION_KEYRING is not set")
+	}
+
+	dataKey, err := mirrorKeyring.unwrap(headers.Get(encryptionMetaKeyID), headers.Get(encryptionMetaKey))
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := base64.StdEncoding.DecodeString(headers.Get(encryptionMetaNonce))
+	if err != nil || len(prefix) != encryptionPrefixLen {
+		return nil, fmt.Errorf("invalid encryption nonce")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		source: body,
+		aead:   aead,
+		prefix: prefix,
+		buffer: make([]byte, encryptionChunkSize+encryptionTagSize+1),
+	}, nil
+}
+
+type decryptingReader struct {
+	source  io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buffer  []byte // Read-ahead of one byte tells if a chunk is the last one
+	filled  int
+	plain   []byte
+	done    bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) nextChunk() error {
+	// Fill a full sealed chunk plus one byte to detect the end of the stream
+	n, err := io.ReadFull(r.source, r.buffer[r.filled:])
+	r.filled += n
+	last := false
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return err
+	}
+
+	sealed := r.filled
+	if !last {
+		sealed = encryptionChunkSize + encryptionTagSize
+	}
+	if sealed < encryptionTagSize {
+		return fmt.Errorf("truncated encrypted object")
+	}
+
+	plain, err := r.aead.Open(nil, chunkNonce(r.prefix, r.counter, last), r.buffer[:sealed], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %d: %w", r.counter, err)
+	}
+
+	r.plain = plain
+	r.counter++
+	r.filled = copy(r.buffer, r.buffer[sealed:r.filled])
+	r.done = last
+	return nil
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixLen:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap seals a data key with a master key, the key id is authenticated
+func (k *encryptionKeyring) wrap(keyID string, dataKey []byte) (string, error) {
+	aead, err := newGCM(k.keys[keyID])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(keyID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *encryptionKeyring) unwrap(keyID, wrapped string) ([]byte, error) {
+	master := k.keys[keyID]
+	if master == nil {
+		return nil, fmt.Errorf("encryption key %q is not in the keyring", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+	dataKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with %q: %w", keyID, err)
+	}
+	return dataKey, nil
+}
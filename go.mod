@@ -4,11 +4,12 @@ go 1.21
 
 require (
 	github.com/lib/pq v1.10.9
+	github.com/rs/dnscache v0.0.0-20230804202142-fc85eb664529
 	github.com/sirupsen/logrus v1.9.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/rs/dnscache v0.0.0-20230804202142-fc85eb664529 // indirect
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ObjectRecord is a single row of the inventory, one per object key
+type ObjectRecord struct {
+	Key                string            `json:"key"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"content_type"`
+	ETag               string            `json:"etag,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`             // Headers returned by HeadObject (user metadata, Cache-Control, ...)
+	IsBackedUp         bool              `json:"is_backed_up"`                   // Every target the object is mirrored to holds it
+	MirrorStatus       map[string]string `json:"mirror_status,omitempty"`        // PENDING, COMPLETED, FAILED or LOCK_FAILED per mirror target
+	MirrorRule         string            `json:"mirror_rule,omitempty"`          // Replication rule matched by the last write
+	MirrorKey          string            `json:"mirror_key,omitempty"`           // Key of the copies when a rule rewrites it
+	MirrorStorageClass map[string]string `json:"mirror_storage_class,omitempty"` // Storage class of the copy per mirror target
+	LastModified       time.Time         `json:"last_modified"`
+	Deleted            bool              `json:"deleted"`
+	Tombstone          *Tombstone        `json:"tombstone,omitempty"` // What the delete policy did with the copies of a deleted object
+}
+
+// Tombstone is the state of the mirror copies of a deleted object
+type Tombstone struct {
+	State    string     `json:"state"`               // retained, delayed, trashed or purged
+	PurgeAt  *time.Time `json:"purge_at,omitempty"`  // When the copies (or their trash copies) are deleted
+	TrashKey string     `json:"trash_key,omitempty"` // Key of the trash copies
+}
+
+// withMirrorStatus returns a copy of the record with the status and storage
+// classes of targets merged in and IsBackedUp recomputed
+func (rec ObjectRecord) withMirrorStatus(status, storageClass map[string]string) ObjectRecord {
+	merged := copyMirrorStatus(rec.MirrorStatus)
+	for target, s := range status {
+		merged[target] = s
+	}
+	rec.MirrorStatus = merged
+	rec.IsBackedUp = isBackedUp(merged)
+
+	if len(storageClass) > 0 {
+		classes := copyMirrorStatus(rec.MirrorStorageClass)
+		for target, class := range storageClass {
+			classes[target] = class
+		}
+		rec.MirrorStorageClass = classes
+	}
+	return rec
+}
+
+func copyMirrorStatus(status map[string]string) map[string]string {
+	copied := make(map[string]string, len(status))
+	for target, s := range status {
+		copied[target] = s
+	}
+	return copied
+}
+
+// mirrorStorageClass returns the storage class of a target as merged by
+// withMirrorStatus, nil when it is unknown
+func mirrorStorageClass(target, storageClass string) map[string]string {
+	if storageClass == "" {
+		return nil
+	}
+	return map[string]string{target: storageClass}
+}
+
+// hasMirrorFailure tells if the last mirroring of the record failed on a target
+func (rec ObjectRecord) hasMirrorFailure() bool {
+	for _, status := range rec.MirrorStatus {
+		if status == mirrorStatusFailed || status == mirrorStatusLockFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeDue tells if the copies of a deleted record are due for purge at a time
+func (rec ObjectRecord) purgeDue(at time.Time) bool {
+	return rec.Deleted && rec.Tombstone != nil && rec.Tombstone.PurgeAt != nil && !rec.Tombstone.PurgeAt.After(at)
+}
+
+// ObjectQuery filters the records returned by InventoryStore.ListObjects
+type ObjectQuery struct {
+	Prefix         string // Only keys starting with this prefix
+	StartAfter     string // Only keys strictly greater than this key
+	Limit          int    // Maximum number of records (0 = unlimited)
+	IncludeDeleted bool   // Also return records marked as deleted
+
+	// Only deleted records whose copies are due for purge at this time
+	PurgeDue time.Time
+}
+
+// matchesKey tells if a key is in the range of the query
+func (q ObjectQuery) matchesKey(key string) bool {
+	return strings.HasPrefix(key, q.Prefix) && key > q.StartAfter
+}
+
+// matches tells if the query returns a record, its limit aside
+func (q ObjectQuery) matches(rec *ObjectRecord) bool {
+	if !q.matchesKey(rec.Key) {
+		return false
+	}
+	if !q.PurgeDue.IsZero() {
+		return rec.purgeDue(q.PurgeDue)
+	}
+	return !rec.Deleted || q.IncludeDeleted
+}
+
+// InventoryStore tracks every object written through the proxy.
+// Records are kept per bucket and ordered by key (binary order, like S3).
+type InventoryStore interface {
+	// EnsureBucket prepares storage for a bucket, it is safe to call repeatedly
+	EnsureBucket(bucket string) error
+	// UpsertObject inserts or replaces the record for rec.Key
+	UpsertObject(bucket string, rec ObjectRecord) error
+	// SetMirrorStatus records the outcome of mirroring an existing record to a
+	// target, and the storage class of the copy unless empty
+	SetMirrorStatus(bucket, key, target, status, storageClass string) error
+	// MarkDeleted flags an existing record as deleted
+	MarkDeleted(bucket, key string, at time.Time) error
+	// SetTombstone records the state of the copies of a record, unless it is no longer deleted
+	SetTombstone(bucket, key string, tombstone Tombstone) error
+	// ApplyBatch writes coalesced changes (at most one op per key) at once
+	ApplyBatch(bucket string, ops []InventoryOp) error
+	// GetObject returns the record for a key, or nil if it is unknown
+	GetObject(bucket, key string) (*ObjectRecord, error)
+	// ListObjects returns records matching the query ordered by key
+	ListObjects(bucket string, query ObjectQuery) ([]ObjectRecord, error)
+	// Buckets returns the names of all buckets known to the store
+	Buckets() ([]string, error)
+	Close() error
+}
+
+// Inventory backends
+const (
+	inventoryBackendPostgres = "postgres"
+	inventoryBackendFile     = "file"
+	inventoryBackendNone     = "none"
+)
+
+// openInventoryStore creates the store selected by inventoryBackend
+func openInventoryStore() (InventoryStore, error) {
+	switch inventoryBackend {
+	case inventoryBackendPostgres:
+		return openPostgresStore(postgresURL)
+	case inventoryBackendFile:
+		return openFileStore(inventoryFile)
+	case inventoryBackendNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown inventory backend %q", inventoryBackend)
+	}
+}
+
+// resolveInventoryBackend picks the backend from the environment, keeping
+// the historical behaviour of enabling Postgres whenever POSTGRES_URL is set
+func resolveInventoryBackend() string {
+	if disableDatabase {
+		return inventoryBackendNone
+	}
+
+	backend := strings.ToLower(getEnv("INVENTORY_BACKEND"))
+	if backend == "" {
+		if postgresURL != "" {
+			return inventoryBackendPostgres
+		}
+		return inventoryBackendNone
+	}
+
+	if backend == inventoryBackendPostgres && postgresURL == "" {
+		log.Fatal("POSTGRES_URL is required when INVENTORY_BACKEND=postgres")
+	}
+
+	return backend
+}
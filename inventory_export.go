@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	inventoryExportBucket   string        // Destination bucket on the mirror, empty = disabled
+	inventoryExportTarget   *mirrorTarget // Mirror target receiving the reports
+	inventoryExportPrefix   string        // Key prefix inside the destination bucket
+	inventoryExportID       string        // Inventory configuration ID used in the key layout
+	inventoryExportInterval time.Duration // Time between two exports
+	inventoryExportFileRows int           // Maximum number of rows per data file
+)
+
+// Fields written to each CSV row, in order
+const inventoryExportSchema = "Bucket, Key, Size, LastModifiedDate, ETag, ReplicationStatus"
+
+// inventoryManifest is the manifest.json of an AWS S3 Inventory report
+type inventoryManifest struct {
+	SourceBucket      string                  `json:"sourceBucket"`
+	DestinationBucket string                  `json:"destinationBucket"`
+	Version           string                  `json:"version"`
+	CreationTimestamp string                  `json:"creationTimestamp"`
+	FileFormat        string                  `json:"fileFormat"`
+	FileSchema        string                  `json:"fileSchema"`
+	Files             []inventoryManifestFile `json:"files"`
+}
+
+type inventoryManifestFile struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	MD5Checksum string `json:"MD5checksum"`
+}
+
+func loadInventoryExportConfig() {
+	inventoryExportBucket = getEnv("INVENTORY_EXPORT_BUCKET")
+	inventoryExportPrefix = strings.Trim(getEnvOrDefault("INVENTORY_EXPORT_PREFIX", ""), "/")
+	inventoryExportID = getEnvOrDefault("INVENTORY_EXPORT_ID", "s3-mirror")
+
+	target, err := findMirrorTarget(getEnv("INVENTORY_EXPORT_TARGET"))
+	if err != nil {
+		log.Fatalf("Invalid INVENTORY_EXPORT_TARGET: %v", err)
+	}
+	if inventoryExportBucket != "" && target.Type != mirrorTargetS3 {
+		log.Fatalf("Invalid INVENTORY_EXPORT_TARGET: reports are written to S3 targets, %s is a %s target", target.Name, target.Type)
+	}
+	inventoryExportTarget = target
+
+	interval, err := time.ParseDuration(getEnvOrDefault("INVENTORY_EXPORT_INTERVAL", "24h"))
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid INVENTORY_EXPORT_INTERVAL: %v", err)
+	}
+	inventoryExportInterval = interval
+
+	rows, err := strconv.Atoi(getEnvOrDefault("INVENTORY_EXPORT_FILE_ROWS", "1000000"))
+	if err != nil || rows <= 0 {
+		log.Fatalf("Invalid INVENTORY_EXPORT_FILE_ROWS: %v", err)
+	}
+	inventoryExportFileRows = rows
+
+	// ORC and Parquet reports are not produced
+	if format := strings.ToUpper(getEnvOrDefault("INVENTORY_EXPORT_FORMAT", "CSV")); format != "CSV" {
+		log.Fatalf("Unsupported INVENTORY_EXPORT_FORMAT %q: only CSV is supported", format)
+	}
+}
+
+// startInventoryExporter runs an export of every bucket on a fixed interval,
+// the first one an interval after the last published report so that restarts
+// don't postpone exports
+func startInventoryExporter(store InventoryStore) {
+	if inventoryExportBucket == "" || store == nil {
+		return
+	}
+
+	log.Infof("Inventory export enabled to %s on %s every %s", inventoryExportBucket, inventoryExportTarget.Name, inventoryExportInterval)
+
+	go func() {
+		wait := time.Duration(0)
+		if last, err := lastInventoryExport(store); err != nil {
+			log.Errorf("Failed to find the last inventory report, exporting now: %v", err)
+		} else if !last.IsZero() {
+			wait = time.Until(last.Add(inventoryExportInterval))
+		}
+		if wait > 0 {
+			log.Infof("Next inventory export in %s", wait.Round(time.Second))
+			time.Sleep(wait)
+		}
+
+		ticker := time.NewTicker(inventoryExportInterval)
+		defer ticker.Stop()
+		for {
+			exportInventory(store, time.Now().UTC())
+			<-ticker.C
+		}
+	}()
+}
+
+// inventoryExportBasePath returns the key prefix of the reports of a bucket
+func inventoryExportBasePath(bucket string) string {
+	basePath := bucket + "/" + inventoryExportID
+	if inventoryExportPrefix != "" {
+		basePath = inventoryExportPrefix + "/" + basePath
+	}
+	return basePath
+}
+
+// lastInventoryExport returns when every bucket last got a report, zero when
+// a bucket has none yet
+func lastInventoryExport(store InventoryStore) (time.Time, error) {
+	buckets, err := store.Buckets()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var oldest time.Time
+	for _, bucket := range buckets {
+		basePath := inventoryExportBasePath(bucket)
+		var latest time.Time
+		err := inventoryExportTarget.store.listObjects(inventoryExportBucket, basePath+"/", func(key string) error {
+			stamp, ok := strings.CutSuffix(strings.TrimPrefix(key, basePath+"/"), "/manifest.json")
+			if !ok {
+				return nil
+			}
+			if created, err := time.Parse("2006-01-02T15-04Z", stamp); err == nil && created.After(latest) {
+				latest = created
+			}
+			return nil
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+		if latest.IsZero() {
+			return time.Time{}, nil
+		}
+		if oldest.IsZero() || latest.Before(oldest) {
+			oldest = latest
+		}
+	}
+	return oldest, nil
+}
+
+// exportInventory writes one inventory report per bucket
+func exportInventory(store InventoryStore, now time.Time) {
+	buckets, err := store.Buckets()
+	if err != nil {
+		log.Errorf("Failed to list inventory buckets: %v", err)
+		return
+	}
+
+	for _, bucket := range buckets {
+		start := time.Now()
+		files, rows, err := exportBucketInventory(store, bucket, now)
+		if err != nil {
+			log.Errorf("Failed to export inventory for bucket %s: %v", bucket, err)
+			continue
+		}
+		log.Infof("Exported inventory for bucket %s: %d objects in %d files (%s)", bucket, rows, files, time.Since(start))
+	}
+}
+
+// exportBucketInventory writes the CSV data files then the manifest of a
+// single bucket, the manifest is written last so readers never see a partial report
+func exportBucketInventory(store InventoryStore, bucket string, now time.Time) (int, int, error) {
+	basePath := inventoryExportBasePath(bucket)
+
+	manifest := inventoryManifest{
+		SourceBucket:      bucket,
+		DestinationBucket: "arn:aws:s3:::" + inventoryExportBucket,
+		Version:           "2016-11-30",
+		CreationTimestamp: strconv.FormatInt(now.UnixMilli(), 10),
+		FileFormat:        "CSV",
+		FileSchema:        inventoryExportSchema,
+		Files:             []inventoryManifestFile{},
+	}
+
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	var writer *csv.Writer
+	fileRows := 0
+	totalRows := 0
+
+	flush := func() error {
+		if fileRows == 0 {
+			return nil
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf("%s/data/%s.csv.gz", basePath, newUUID())
+		data := buf.Bytes()
+		sum := md5.Sum(data)
+		if err := putMirrorObject(inventoryExportBucket, key, data, "application/x-gzip"); err != nil {
+			return err
+		}
+
+		manifest.Files = append(manifest.Files, inventoryManifestFile{
+			Key:         key,
+			Size:        int64(len(data)),
+			MD5Checksum: hex.EncodeToString(sum[:]),
+		})
+		fileRows = 0
+		return nil
+	}
+
+	// Page through the inventory in key order
+	startAfter := ""
+	for {
+		records, err := store.ListObjects(bucket, ObjectQuery{StartAfter: startAfter, Limit: 1000})
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, rec := range records {
+			if fileRows == 0 {
+				buf.Reset()
+				gz = gzip.NewWriter(&buf)
+				writer = csv.NewWriter(gz)
+			}
+
+			// Objects a rule does not mirror have no status, like objects
+			// outside of an S3 replication configuration
+			replicationStatus := "PENDING"
+			switch {
+			case rec.IsBackedUp:
+				replicationStatus = "COMPLETED"
+			case rec.hasMirrorFailure():
+				replicationStatus = "FAILED"
+			case rec.MirrorRule != "" && len(rec.MirrorStatus) == 0:
+				replicationStatus = ""
+			}
+
+			// Keys are URL-encoded in CSV inventory reports
+			if err := writer.Write([]string{
+				bucket,
+				url.QueryEscape(rec.Key),
+				strconv.FormatInt(rec.Size, 10),
+				rec.LastModified.UTC().Format("2006-01-02T15:04:05.000Z"),
+				strings.Trim(rec.ETag, `"`),
+				replicationStatus,
+			}); err != nil {
+				return 0, 0, err
+			}
+			fileRows++
+			totalRows++
+
+			if fileRows >= inventoryExportFileRows {
+				if err := flush(); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+
+		startAfter = records[len(records)-1].Key
+	}
+
+	if err := flush(); err != nil {
+		return 0, 0, err
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, 0, err
+	}
+	manifestSum := md5.Sum(manifestJSON)
+
+	manifestPath := fmt.Sprintf("%s/%s", basePath, now.Format("2006-01-02T15-04Z"))
+	if err := putMirrorObject(inventoryExportBucket, manifestPath+"/manifest.json", manifestJSON, "application/json"); err != nil {
+		return 0, 0, err
+	}
+	if err := putMirrorObject(inventoryExportBucket, manifestPath+"/manifest.checksum", []byte(hex.EncodeToString(manifestSum[:])), "text/plain"); err != nil {
+		return 0, 0, err
+	}
+
+	return len(manifest.Files), totalRows, nil
+}
+
+// putMirrorObject uploads an object to the export target as-is (no bucket naming rule)
+func putMirrorObject(bucket, key string, body []byte, contentType string) error {
+	headers := make(http.Header)
+	headers.Set("Content-Type", contentType)
+
+	resp, err := inventoryExportTarget.send("PUT", bucket, key, nil, headers, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("upload of %s/%s failed with status %d: %s", bucket, key, resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatalf("Failed to generate random bytes: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withExportTarget points inventory exports to a fake S3 target keeping the
+// objects written to it, by path
+func withExportTarget(t *testing.T) map[string][]byte {
+	objects := make(map[string][]byte)
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.Method {
+		case "PUT":
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+		case "GET":
+			listing := listBucketResultV2{}
+			for name := range objects {
+				key := strings.TrimPrefix(name, "/reports/")
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+					listing.Contents = append(listing.Contents, listObjectEntry{Key: key})
+				}
+			}
+			writeS3XML(w, http.StatusOK, listing)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("MIRROR_REPORTS_ACCESS_KEY", "access")
+	t.Setenv("MIRROR_REPORTS_SECRET_KEY", "secret")
+	target := &mirrorTarget{Name: "reports", Endpoint: server.URL, AddressingStyle: addressingStylePath}
+	if err := target.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	previousTarget, previousBucket, previousPrefix := inventoryExportTarget, inventoryExportBucket, inventoryExportPrefix
+	previousID, previousRows := inventoryExportID, inventoryExportFileRows
+	inventoryExportTarget, inventoryExportBucket, inventoryExportPrefix = target, "reports", "inventory"
+	inventoryExportID, inventoryExportFileRows = "daily", 2
+	t.Cleanup(func() {
+		inventoryExportTarget, inventoryExportBucket, inventoryExportPrefix = previousTarget, previousBucket, previousPrefix
+		inventoryExportID, inventoryExportFileRows = previousID, previousRows
+	})
+	return objects
+}
+
+func TestExportBucketInventory(t *testing.T) {
+	objects := withExportTarget(t)
+	store := withInventory(t)
+	at := time.Date(2024, 3, 7, 9, 30, 0, 0, time.UTC)
+
+	for _, rec := range []ObjectRecord{
+		{Key: "backed up", Size: 1, ETag: `"e1"`, MirrorStatus: map[string]string{"aws": mirrorStatusCompleted, "b2": mirrorStatusCompleted}},
+		{Key: "failed", Size: 2, MirrorStatus: map[string]string{"aws": mirrorStatusCompleted, "b2": mirrorStatusFailed}},
+		{Key: "locked", Size: 3, MirrorStatus: map[string]string{"aws": mirrorStatusLockFailed}},
+		{Key: "pending", Size: 4, MirrorStatus: map[string]string{"aws": mirrorStatusPending}},
+		{Key: "skipped", Size: 5, MirrorRule: "tmp"},
+		{Key: "a/deleted", Size: 6, Deleted: true},
+	} {
+		rec.LastModified = at
+		rec.IsBackedUp = isBackedUp(rec.MirrorStatus)
+		store.UpsertObject("photos", rec)
+	}
+
+	if last, err := lastInventoryExport(store); err != nil || !last.IsZero() {
+		t.Errorf("lastInventoryExport before any report = %s, %v, want zero", last, err)
+	}
+	files, rows, err := exportBucketInventory(store, "photos", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 3 || rows != 5 {
+		t.Errorf("exported %d rows in %d files, want 5 rows in 3 files", rows, files)
+	}
+
+	manifestJSON := objects["/reports/inventory/photos/daily/2024-03-07T09-30Z/manifest.json"]
+	var manifest inventoryManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		t.Fatalf("manifest %q: %v", manifestJSON, err)
+	}
+	sum := md5.Sum(manifestJSON)
+	if checksum := objects["/reports/inventory/photos/daily/2024-03-07T09-30Z/manifest.checksum"]; string(checksum) != hex.EncodeToString(sum[:]) {
+		t.Errorf("manifest.checksum = %s, want %x", checksum, sum)
+	}
+	if manifest.SourceBucket != "photos" || manifest.DestinationBucket != "arn:aws:s3:::reports" || manifest.FileSchema != inventoryExportSchema || len(manifest.Files) != files {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	var got [][]string
+	for _, file := range manifest.Files {
+		data := objects["/reports/"+file.Key]
+		sum := md5.Sum(data)
+		if !strings.HasPrefix(file.Key, "inventory/photos/daily/data/") || file.Size != int64(len(data)) || file.MD5Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("manifest file %+v does not describe %d bytes uploaded", file, len(data))
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(gz).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, records...)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i][1] < got[j][1] })
+	want := [][]string{
+		{"photos", "backed+up", "1", "2024-03-07T09:30:00.000Z", "e1", "COMPLETED"},
+		{"photos", "failed", "2", "2024-03-07T09:30:00.000Z", "", "FAILED"},
+		{"photos", "locked", "3", "2024-03-07T09:30:00.000Z", "", "FAILED"},
+		{"photos", "pending", "4", "2024-03-07T09:30:00.000Z", "", "PENDING"},
+		{"photos", "skipped", "5", "2024-03-07T09:30:00.000Z", "", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %v, want %v", got, want)
+	}
+
+	// The next export is scheduled from the published report
+	if last, err := lastInventoryExport(store); err != nil || !last.Equal(at.Truncate(time.Minute)) {
+		t.Errorf("lastInventoryExport = %s, %v, want %s", last, err, at.Truncate(time.Minute))
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileStore is an embedded inventory kept in a single append-only journal file.
+// Every mutation appends the resulting record as one JSON line, the whole
+// journal is replayed into memory on startup and compacted once it grows to
+// twice the number of live records. Meant for sidecars writing to a PVC.
+type fileStore struct {
+	path string
+	file *os.File
+
+	buckets map[string]*fileBucket
+	entries int // Number of lines in the journal
+	records int // Number of live records (across all buckets)
+	dirty   bool
+	mutex   sync.RWMutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fileBucket holds the records of a single bucket
+type fileBucket struct {
+	objects map[string]*ObjectRecord
+	keys    []string // Sorted keys, rebuilt lazily when nil
+}
+
+// fileJournalEntry is one line of the journal, an entry without a record
+// only registers the bucket
+type fileJournalEntry struct {
+	Bucket string        `json:"b"`
+	Record *ObjectRecord `json:"r,omitempty"`
+}
+
+// Minimum journal size before compaction is considered
+const fileStoreCompactMin = 1024
+
+func openFileStore(path string) (*fileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("INVENTORY_FILE is required when INVENTORY_BACKEND=file")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create inventory directory: %w", err)
+	}
+
+	s := &fileStore{
+		path:    path,
+		buckets: make(map[string]*fileBucket),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open inventory file: %w", err)
+	}
+	s.file = file
+
+	// Flush to disk periodically rather than on every write
+	go s.syncLoop()
+
+	log.Infof("Loaded %d inventory records from %s", s.records, path)
+	return s, nil
+}
+
+// replay loads the journal into memory, last entry for a key wins
+func (s *fileStore) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open inventory file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	var offset int64
+	for scanner.Scan() {
+		line++
+		offset += int64(len(scanner.Bytes())) + 1
+		var entry fileJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn write at the end of the file is expected after a crash
+			log.Warnf("Skipping corrupt inventory entry at line %d: %v", line, err)
+			continue
+		}
+		s.apply(entry)
+	}
+	s.entries = line
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read inventory file: %w", err)
+	}
+
+	// Appending after a torn line would join the next entry to it
+	if info, err := file.Stat(); err == nil && offset > info.Size() {
+		end, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open inventory file: %w", err)
+		}
+		defer end.Close()
+		if _, err := end.Write([]byte{'\n'}); err != nil {
+			return fmt.Errorf("failed to end the torn inventory entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply updates the in-memory state, the caller must hold the write lock
+func (s *fileStore) apply(entry fileJournalEntry) {
+	b := s.buckets[entry.Bucket]
+	if b == nil {
+		b = &fileBucket{objects: make(map[string]*ObjectRecord)}
+		s.buckets[entry.Bucket] = b
+	}
+	if entry.Record == nil {
+		return
+	}
+
+	if _, exists := b.objects[entry.Record.Key]; !exists {
+		s.records++
+		b.keys = nil
+	}
+	rec := *entry.Record
+	b.objects[rec.Key] = &rec
+}
+
+// write appends an entry to the journal and applies it, the caller must hold
+// the write lock
+func (s *fileStore) write(entry fileJournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write inventory entry: %w", err)
+	}
+
+	s.apply(entry)
+	s.entries++
+	s.dirty = true
+
+	if s.entries > fileStoreCompactMin && s.entries > 2*s.records {
+		if err := s.compact(); err != nil {
+			log.Errorf("Failed to compact inventory file: %v", err)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the journal with one entry per live record, the caller
+// must hold the write lock
+func (s *fileStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	entries := 0
+	for name, b := range s.buckets {
+		if err := encoder.Encode(fileJournalEntry{Bucket: name}); err != nil {
+			tmp.Close()
+			return err
+		}
+		entries++
+		for _, rec := range b.objects {
+			if err := encoder.Encode(fileJournalEntry{Bucket: name, Record: rec}); err != nil {
+				tmp.Close()
+				return err
+			}
+			entries++
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	// Reopen the compacted file for appending
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.dirty = false
+
+	log.Debugf("Compacted inventory file from %d to %d entries", s.entries, entries)
+	s.entries = entries
+	return nil
+}
+
+func (s *fileStore) syncLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mutex.Lock()
+			if s.dirty {
+				if err := s.file.Sync(); err != nil {
+					log.Errorf("Failed to sync inventory file: %v", err)
+				}
+				s.dirty = false
+			}
+			s.mutex.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *fileStore) EnsureBucket(bucket string) error {
+	s.mutex.RLock()
+	_, exists := s.buckets[bucket]
+	s.mutex.RUnlock()
+	if exists {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.buckets[bucket]; exists {
+		return nil
+	}
+	return s.write(fileJournalEntry{Bucket: bucket})
+}
+
+func (s *fileStore) UpsertObject(bucket string, rec ObjectRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(fileJournalEntry{Bucket: bucket, Record: &rec})
+}
+
+// update applies fn to a copy of an existing record and journals the result,
+// unknown keys are ignored like an UPDATE matching no rows
+func (s *fileStore) update(bucket, key string, fn func(rec *ObjectRecord)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := s.buckets[bucket]
+	if b == nil {
+		return nil
+	}
+	existing := b.objects[key]
+	if existing == nil {
+		return nil
+	}
+
+	rec := *existing
+	fn(&rec)
+	return s.write(fileJournalEntry{Bucket: bucket, Record: &rec})
+}
+
+func (s *fileStore) SetMirrorStatus(bucket, key, target, status, storageClass string) error {
+	return s.update(bucket, key, func(rec *ObjectRecord) {
+		*rec = rec.withMirrorStatus(map[string]string{target: status}, mirrorStorageClass(target, storageClass))
+	})
+}
+
+func (s *fileStore) MarkDeleted(bucket, key string, at time.Time) error {
+	return s.update(bucket, key, func(rec *ObjectRecord) {
+		rec.Deleted = true
+		rec.LastModified = at
+	})
+}
+
+func (s *fileStore) SetTombstone(bucket, key string, tombstone Tombstone) error {
+	return s.update(bucket, key, func(rec *ObjectRecord) {
+		if rec.Deleted {
+			rec.Tombstone = &tombstone
+		}
+	})
+}
+
+func (s *fileStore) ApplyBatch(bucket string, ops []InventoryOp) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := s.buckets[bucket]
+	for _, op := range ops {
+		var existing *ObjectRecord
+		if b != nil {
+			existing = b.objects[op.Key]
+		}
+		rec := op.apply(existing)
+		if rec == nil {
+			continue
+		}
+		if err := s.write(fileJournalEntry{Bucket: bucket, Record: rec}); err != nil {
+			return err
+		}
+		b = s.buckets[bucket]
+	}
+	return nil
+}
+
+func (s *fileStore) GetObject(bucket, key string) (*ObjectRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b := s.buckets[bucket]
+	if b == nil {
+		return nil, nil
+	}
+	rec := b.objects[key]
+	if rec == nil {
+		return nil, nil
+	}
+	copied := *rec
+	return &copied, nil
+}
+
+func (s *fileStore) ListObjects(bucket string, query ObjectQuery) ([]ObjectRecord, error) {
+	// Sorting needs the write lock since it caches the key slice
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := s.buckets[bucket]
+	if b == nil {
+		return nil, nil
+	}
+
+	if b.keys == nil {
+		b.keys = make([]string, 0, len(b.objects))
+		for k := range b.objects {
+			b.keys = append(b.keys, k)
+		}
+		sort.Strings(b.keys)
+	}
+
+	// Skip straight to the first candidate key
+	start := query.Prefix
+	if query.StartAfter > start {
+		start = query.StartAfter
+	}
+	i := sort.SearchStrings(b.keys, start)
+
+	var records []ObjectRecord
+	for ; i < len(b.keys); i++ {
+		key := b.keys[i]
+		if !strings.HasPrefix(key, query.Prefix) {
+			break
+		}
+		rec := b.objects[key]
+		if !query.matches(rec) {
+			continue
+		}
+		records = append(records, *rec)
+		if query.Limit > 0 && len(records) >= query.Limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+func (s *fileStore) Buckets() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	buckets := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		buckets = append(buckets, name)
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+func (s *fileStore) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.file.Sync(); err != nil {
+		log.Errorf("Failed to sync inventory file: %v", err)
+	}
+	return s.file.Close()
+}
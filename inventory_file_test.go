@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withInventory replaces the inventory with a file store for a test
+func withInventory(t *testing.T) *fileStore {
+	store, err := openFileStore(filepath.Join(t.TempDir(), "inventory.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := inventory
+	inventory = store
+	t.Cleanup(func() {
+		inventory = previous
+		store.Close()
+	})
+	return store
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.jsonl")
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.EnsureBucket("empty")
+	store.UpsertObject("bucket", ObjectRecord{Key: "a", Size: 1})
+	store.UpsertObject("bucket", ObjectRecord{Key: "b", Size: 1})
+	store.UpsertObject("bucket", ObjectRecord{Key: "a", Size: 2})
+	store.SetMirrorStatus("bucket", "a", "aws", mirrorStatusCompleted, "GLACIER")
+	store.MarkDeleted("bucket", "b", deletedAt)
+	store.SetMirrorStatus("bucket", "missing", "aws", mirrorStatusCompleted, "")
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while appending leaves a torn last line
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"b":"bucket","r":{"key":"c","si`)
+	file.Close()
+
+	store, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buckets, _ := store.Buckets(); !reflect.DeepEqual(buckets, []string{"bucket", "empty"}) {
+		t.Errorf("Buckets = %v, want [bucket empty]", buckets)
+	}
+	a, _ := store.GetObject("bucket", "a")
+	if a == nil || a.Size != 2 || a.MirrorStatus["aws"] != mirrorStatusCompleted || a.MirrorStorageClass["aws"] != "GLACIER" || !a.IsBackedUp {
+		t.Errorf("replayed a = %+v, want the last update of it", a)
+	}
+	b, _ := store.GetObject("bucket", "b")
+	if b == nil || !b.Deleted || !b.LastModified.Equal(deletedAt) {
+		t.Errorf("replayed b = %+v, want deleted at %s", b, deletedAt)
+	}
+	for _, key := range []string{"c", "missing"} {
+		if rec, _ := store.GetObject("bucket", key); rec != nil {
+			t.Errorf("replayed %s = %+v, want no record", key, rec)
+		}
+	}
+
+	// Writes after the torn line are replayed on their own line
+	store.UpsertObject("bucket", ObjectRecord{Key: "d", Size: 4})
+	store.Close()
+	store, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if d, _ := store.GetObject("bucket", "d"); d == nil || d.Size != 4 {
+		t.Errorf("record written after a torn line = %+v", d)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.jsonl")
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		store.UpsertObject("bucket", ObjectRecord{Key: key})
+	}
+	for i := 1; i <= fileStoreCompactMin; i++ {
+		store.UpsertObject("bucket", ObjectRecord{Key: "a", Size: int64(i)})
+	}
+	if store.entries > 2*store.records+1 {
+		t.Errorf("journal has %d entries for %d records, want it compacted", store.entries, store.records)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(content, []byte("\n")); lines > 10 {
+		t.Errorf("compacted journal has %d lines", lines)
+	}
+
+	store, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	records, _ := store.ListObjects("bucket", ObjectQuery{})
+	if keys := recordKeys(records); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Errorf("keys after compaction = %v, want [a b c]", keys)
+	}
+	if records[0].Size != fileStoreCompactMin {
+		t.Errorf("size of a after compaction = %d, want %d", records[0].Size, fileStoreCompactMin)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Bucket patterns (path.Match syntax) whose inventory is trusted to be complete
+	inventoryAuthoritativeBuckets []string
+
+	// Buckets known to the inventory store
+	inventoryKnownBuckets sync.Map
+	// Buckets whose inventory missed a write since startup, value is the reason
+	inventoryIncompleteBuckets sync.Map
+)
+
+// Largest code point, appended to a common prefix to skip every key under it
+const maxKeyRune = "\U0010FFFF"
+
+// Headers stored with each record and replayed by HeadObject
+var inventoryMetadataHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Expires",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Storage-Class",
+	"X-Amz-Version-Id",
+	"X-Amz-Website-Redirect-Location",
+}
+
+func loadInventoryListingConfig() {
+	for _, pattern := range strings.Split(getEnv("INVENTORY_AUTHORITATIVE_BUCKETS"), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid INVENTORY_AUTHORITATIVE_BUCKETS pattern %q: %v", pattern, err)
+		}
+		inventoryAuthoritativeBuckets = append(inventoryAuthoritativeBuckets, pattern)
+	}
+}
+
+// loadKnownInventoryBuckets caches the buckets already present in the store
+func loadKnownInventoryBuckets(store InventoryStore) {
+	if len(inventoryAuthoritativeBuckets) == 0 {
+		return
+	}
+
+	buckets, err := store.Buckets()
+	if err != nil {
+		log.Errorf("Failed to load inventory buckets, listing will be forwarded to main: %v", err)
+		return
+	}
+	for _, bucket := range buckets {
+		inventoryKnownBuckets.Store(bucket, true)
+	}
+}
+
+// isInventoryAuthoritative tells if reads for a bucket can be answered from the inventory
+func isInventoryAuthoritative(bucket string) bool {
+	if inventory == nil || bucket == "" {
+		return false
+	}
+
+	matched := false
+	for _, pattern := range inventoryAuthoritativeBuckets {
+		if ok, _ := path.Match(pattern, bucket); ok {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	// A bucket never written through the proxy may hold objects we don't know about
+	if _, known := inventoryKnownBuckets.Load(bucket); !known {
+		return false
+	}
+	if _, incomplete := inventoryIncompleteBuckets.Load(bucket); incomplete {
+		return false
+	}
+	// Listings would miss the changes waiting for another attempt
+	return !inventoryRetrying(bucket)
+}
+
+// markInventoryIncomplete stops serving reads of a bucket from the inventory
+// until restart, used whenever a write could not be recorded
+func markInventoryIncomplete(bucket, reason string) {
+	if _, loaded := inventoryIncompleteBuckets.LoadOrStore(bucket, reason); !loaded && len(inventoryAuthoritativeBuckets) > 0 {
+		log.Warnf("Inventory of bucket %s is incomplete (%s), reads will be forwarded to main", bucket, reason)
+	}
+}
+
+// serveFromInventory answers ListObjectsV2 and HeadObject from the inventory,
+// it returns false when the request must be forwarded to main instead
+func serveFromInventory(w http.ResponseWriter, req *http.Request, bucket, key string) bool {
+	if !isInventoryAuthoritative(bucket) {
+		return false
+	}
+
+	query := req.URL.Query()
+	switch {
+	case req.Method == "GET" && key == "" && query.Get("list-type") == "2":
+		return serveListObjectsV2(w, req, bucket, query)
+	case req.Method == "HEAD" && key != "" && len(query) == 0 && !hasConditionalHeaders(req):
+		return serveHeadObject(w, req, bucket, key)
+	}
+	return false
+}
+
+// hasConditionalHeaders reports headers the inventory can't evaluate
+func hasConditionalHeaders(req *http.Request) bool {
+	for k := range req.Header {
+		if strings.HasPrefix(k, "If-") || k == "Range" || strings.HasPrefix(k, "X-Amz-Server-Side-Encryption-Customer-") {
+			return true
+		}
+	}
+	return false
+}
+
+func serveHeadObject(w http.ResponseWriter, req *http.Request, bucket, key string) bool {
+	rec, err := inventory.GetObject(bucket, key)
+	if err != nil {
+		log.Errorf("Failed to read inventory for %s/%s, forwarding to main: %v", bucket, key, err)
+		return false
+	}
+
+	if rec == nil || rec.Deleted {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return true
+	}
+
+	header := w.Header()
+	for k, v := range rec.Metadata {
+		header.Set(k, v)
+	}
+	header.Set("Content-Length", strconv.FormatInt(rec.Size, 10))
+	header.Set("Content-Type", rec.ContentType)
+	header.Set("Last-Modified", rec.LastModified.UTC().Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("X-Amz-Request-Id", newRequestID())
+	if rec.ETag != "" {
+		header.Set("ETag", rec.ETag)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	log.Debugf("HeadObject %s/%s served from inventory", bucket, key)
+	return true
+}
+
+func serveListObjectsV2(w http.ResponseWriter, req *http.Request, bucket string, query url.Values) bool {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	startAfter := query.Get("start-after")
+	encodingType := query.Get("encoding-type")
+
+	if encodingType != "" && encodingType != "url" {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request")
+		return true
+	}
+
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "Provided max-keys not an integer or within integer range")
+			return true
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	// The continuation token is the cursor to resume from, it takes precedence over start-after
+	cursor := startAfter
+	token, hasToken := query["continuation-token"]
+	if hasToken {
+		decoded, err := base64.RawURLEncoding.DecodeString(token[0])
+		if err != nil || token[0] == "" {
+			writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+			return true
+		}
+		cursor = string(decoded)
+	}
+
+	result := listBucketResultV2{
+		Xmlns:        s3Namespace,
+		Name:         bucket,
+		Prefix:       prefix,
+		Delimiter:    delimiter,
+		MaxKeys:      maxKeys,
+		StartAfter:   startAfter,
+		EncodingType: encodingType,
+	}
+	if hasToken {
+		result.ContinuationToken = token[0]
+	}
+
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return strings.ReplaceAll(url.QueryEscape(s), "%2F", "/")
+		}
+		return s
+	}
+	result.Prefix = encode(prefix)
+	result.Delimiter = encode(delimiter)
+	result.StartAfter = encode(startAfter)
+
+	count := 0
+	done := maxKeys == 0
+	for !done && count < maxKeys {
+		records, err := inventory.ListObjects(bucket, ObjectQuery{Prefix: prefix, StartAfter: cursor, Limit: 1000})
+		if err != nil {
+			log.Errorf("Failed to list inventory for %s, forwarding to main: %v", bucket, err)
+			return false
+		}
+		if len(records) == 0 {
+			done = true
+			break
+		}
+
+		// Re-query after each common prefix to skip the keys it groups
+		skipped := false
+		for _, rec := range records {
+			if count >= maxKeys {
+				break
+			}
+
+			rest := rec.Key[len(prefix):]
+			if delimiter != "" {
+				if idx := strings.Index(rest, delimiter); idx >= 0 {
+					cp := prefix + rest[:idx+len(delimiter)]
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(cp)})
+					count++
+					cursor = cp + maxKeyRune
+					skipped = true
+					break
+				}
+			}
+
+			result.Contents = append(result.Contents, inventoryListEntry(rec, encode(rec.Key)))
+			count++
+			cursor = rec.Key
+		}
+
+		if !skipped && len(records) < 1000 && count < maxKeys {
+			done = true
+		}
+	}
+
+	// Look ahead to tell if another page exists
+	if !done {
+		more, err := inventory.ListObjects(bucket, ObjectQuery{Prefix: prefix, StartAfter: cursor, Limit: 1})
+		if err != nil {
+			log.Errorf("Failed to list inventory for %s, forwarding to main: %v", bucket, err)
+			return false
+		}
+		if len(more) > 0 {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(cursor))
+		}
+	}
+
+	result.KeyCount = count
+	writeS3XML(w, http.StatusOK, result)
+
+	log.Debugf("ListObjectsV2 %s (prefix=%q) served from inventory: %d keys", bucket, prefix, count)
+	return true
+}
+
+func inventoryListEntry(rec ObjectRecord, key string) listObjectEntry {
+	storageClass := rec.Metadata["X-Amz-Storage-Class"]
+	if storageClass == "" {
+		storageClass = "STANDARD"
+	}
+	return listObjectEntry{
+		Key:          key,
+		LastModified: rec.LastModified.UTC().Format("2006-01-02T15:04:05.000Z"),
+		ETag:         rec.ETag,
+		Size:         rec.Size,
+		StorageClass: storageClass,
+	}
+}
+
+// inventoryMetadata extracts the headers replayed by HeadObject
+func inventoryMetadata(headers http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range headers {
+		if len(v) > 0 && strings.HasPrefix(k, "X-Amz-Meta-") {
+			metadata[k] = v[0]
+		}
+	}
+	for _, k := range inventoryMetadataHeaders {
+		if v := headers.Get(k); v != "" {
+			metadata[k] = v
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// inventoryTime is the timestamp stored for writes happening now
+func inventoryTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAuthoritativeInventory serves the reads of a bucket from a file
+// inventory for a test
+func withAuthoritativeInventory(t *testing.T, bucket string) *fileStore {
+	store := withInventory(t)
+	previous := inventoryAuthoritativeBuckets
+	inventoryAuthoritativeBuckets = []string{bucket}
+	inventoryKnownBuckets.Store(bucket, true)
+	t.Cleanup(func() {
+		inventoryAuthoritativeBuckets = previous
+		inventoryKnownBuckets.Delete(bucket)
+	})
+	return store
+}
+
+// listAll lists a bucket from the inventory page by page, returning the keys
+// and common prefixes of every page and the number of pages
+func listAll(t *testing.T, bucket string, query url.Values) ([]string, []string, int) {
+	var keys, prefixes []string
+	for pages := 1; ; pages++ {
+		req := httptest.NewRequest("GET", "http://proxy.example.com/"+bucket+"?"+query.Encode(), nil)
+		w := httptest.NewRecorder()
+		if !serveFromInventory(w, req, bucket, "") {
+			t.Fatal("listing not served from the inventory")
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("listing answered %d: %s", w.Code, w.Body)
+		}
+		var result listBucketResultV2
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range result.Contents {
+			keys = append(keys, entry.Key)
+		}
+		for _, cp := range result.CommonPrefixes {
+			prefixes = append(prefixes, cp.Prefix)
+		}
+		if result.KeyCount != len(result.Contents)+len(result.CommonPrefixes) {
+			t.Errorf("KeyCount = %d for %d entries", result.KeyCount, len(result.Contents)+len(result.CommonPrefixes))
+		}
+		if !result.IsTruncated {
+			return keys, prefixes, pages
+		}
+		if pages > 100 {
+			t.Fatal("listing never ends")
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// expectedListing groups sorted keys like S3 does for a prefix and delimiter
+func expectedListing(keys []string, prefix, delimiter string) ([]string, []string) {
+	var contents, prefixes []string
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			cp := prefix + rest[:i+len(delimiter)]
+			if !seen[cp] {
+				seen[cp] = true
+				prefixes = append(prefixes, cp)
+			}
+			continue
+		}
+		contents = append(contents, key)
+	}
+	return contents, prefixes
+}
+
+func TestServeListObjectsV2Pagination(t *testing.T) {
+	store := withAuthoritativeInventory(t, "bucket")
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	live := []string{"a", "b/1", "b/2", "b/c/3", "c", "d/", "d/x", "e f", "photos/2024/a.jpg", "photos/2024/b.jpg", "photos/2025/a.jpg", "photos/index.html", "z"}
+	for i := 0; i < 30; i++ {
+		live = append(live, "many/"+strconv.Itoa(100+i))
+	}
+	for _, key := range live {
+		store.UpsertObject("bucket", ObjectRecord{Key: key, Size: 1, LastModified: at})
+	}
+	// Deleted keys are neither listed nor grouped into common prefixes
+	for _, key := range []string{"b/0", "gone/x", "photos/2023/a.jpg"} {
+		store.UpsertObject("bucket", ObjectRecord{Key: key, Size: 1, LastModified: at})
+		store.MarkDeleted("bucket", key, at)
+	}
+	sort.Strings(live)
+
+	tests := []struct {
+		prefix    string
+		delimiter string
+	}{
+		{"", ""},
+		{"", "/"},
+		{"b/", "/"},
+		{"photos/", "/"},
+		{"photos/2024/", "/"},
+		{"many/", "/"},
+		{"", "o"},
+		{"missing/", "/"},
+	}
+	for _, tt := range tests {
+		wantKeys, wantPrefixes := expectedListing(live, tt.prefix, tt.delimiter)
+		for _, maxKeys := range []int{1, 2, 7, 1000} {
+			query := url.Values{"list-type": {"2"}, "prefix": {tt.prefix}, "delimiter": {tt.delimiter}, "max-keys": {strconv.Itoa(maxKeys)}}
+			keys, prefixes, pages := listAll(t, "bucket", query)
+			if !reflect.DeepEqual(keys, wantKeys) || !reflect.DeepEqual(prefixes, wantPrefixes) {
+				t.Errorf("prefix=%q delimiter=%q max-keys=%d: keys %v, prefixes %v, want %v, %v",
+					tt.prefix, tt.delimiter, maxKeys, keys, prefixes, wantKeys, wantPrefixes)
+			}
+			if entries := len(wantKeys) + len(wantPrefixes); maxKeys < entries && pages != (entries+maxKeys-1)/maxKeys {
+				t.Errorf("prefix=%q delimiter=%q max-keys=%d: %d pages for %d entries", tt.prefix, tt.delimiter, maxKeys, pages, entries)
+			}
+		}
+	}
+
+	// Later pages resume from their continuation token, not start-after
+	keys, prefixes, _ := listAll(t, "bucket", url.Values{"list-type": {"2"}, "delimiter": {"/"}, "start-after": {"b/2"}, "max-keys": {"2"}})
+	if want := []string{"c", "e f", "z"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys after b/2 = %v, want %v", keys, want)
+	}
+	if want := []string{"b/", "d/", "many/", "photos/"}; !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("prefixes after b/2 = %v, want %v", prefixes, want)
+	}
+}
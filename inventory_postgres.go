@@ -0,0 +1,738 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// postgresStore keeps one table per bucket (see bucketTableName) in a single database
+type postgresStore struct {
+	db *sql.DB
+
+	// Buckets whose table has already been created/verified
+	tables map[string]bool
+	// Prepared statements per bucket table
+	statements map[string]*postgresStatements
+	mutex      sync.RWMutex
+}
+
+// postgresStatements are the write statements of one bucket table, every
+// statement takes arrays so a whole batch is written in a single round-trip
+type postgresStatements struct {
+	upsert       *sql.Stmt
+	mirrorStatus *sql.Stmt
+	deleted      *sql.Stmt
+	tombstone    *sql.Stmt
+}
+
+func openPostgresStore(connURL string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", connURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	// Registry of bucket names, table names can't be mapped back to them
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS s3_mirror_buckets (
+			name TEXT PRIMARY KEY,
+			table_name TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW()
+		)
+	`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create bucket registry: %w", err)
+	}
+	for _, column := range []string{"legacy_table", "incomplete"} {
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE s3_mirror_buckets ADD COLUMN IF NOT EXISTS %s TEXT", column)); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate bucket registry: %w", err)
+		}
+	}
+	if err := migrateBucketTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := loadIncompleteBuckets(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &postgresStore{
+		db:         db,
+		tables:     make(map[string]bool),
+		statements: make(map[string]*postgresStatements),
+	}, nil
+}
+
+func (s *postgresStore) EnsureBucket(bucket string) error {
+	s.mutex.RLock()
+	exists := s.tables[bucket]
+	s.mutex.RUnlock()
+	if exists {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Check again, another goroutine may have created it meanwhile
+	if s.tables[bucket] {
+		return nil
+	}
+
+	// Each bucket gets its own table
+	tableName := bucketTableName(bucket)
+	if err := s.adoptLegacyTable(bucket, tableName); err != nil {
+		return err
+	}
+
+	// Create table for this bucket if it doesn't exist
+	createTableSQL := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id SERIAL PRIMARY KEY,
+			path TEXT UNIQUE NOT NULL,
+			size BIGINT NOT NULL,
+			content_type TEXT NOT NULL,
+			is_backed_up BOOLEAN DEFAULT FALSE,
+			last_modified TIMESTAMP NOT NULL,
+			deleted BOOLEAN DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT NOW(),
+			updated_at TIMESTAMP DEFAULT NOW()
+		)
+	`, tableName)
+
+	if _, err := s.db.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("failed to create table %s: %w", tableName, err)
+	}
+
+	// Columns added after the initial schema
+	migrationCommands := []string{
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS etag TEXT", tableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS metadata JSONB", tableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS mirror_status JSONB", tableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS mirror_rule TEXT", tableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS mirror_key TEXT", tableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS tombstone TEXT", tableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS purge_at TIMESTAMP", tableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS trash_key TEXT", tableName),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS mirror_storage_class JSONB", tableName),
+	}
+
+	for _, cmd := range migrationCommands {
+		if _, err := s.db.Exec(cmd); err != nil {
+			return fmt.Errorf("failed to migrate table %s: %w", tableName, err)
+		}
+	}
+
+	// Create indexes for performance
+	indexCommands := []string{
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_path ON %s(path)", tableName, tableName),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_%s_path_c ON %s(path COLLATE "C")`, tableName, tableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_backup ON %s(is_backed_up)", tableName, tableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_deleted ON %s(deleted)", tableName, tableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_purge ON %s(purge_at) WHERE purge_at IS NOT NULL", tableName, tableName),
+	}
+
+	for _, cmd := range indexCommands {
+		if _, err := s.db.Exec(cmd); err != nil {
+			log.Warnf("Failed to create index: %v", err)
+		}
+	}
+
+	if _, err := s.db.Exec(`
+		INSERT INTO s3_mirror_buckets (name, table_name) VALUES ($1, $2)
+		ON CONFLICT (name) DO NOTHING
+	`, bucket, tableName); err != nil {
+		log.Warnf("Failed to register bucket %s: %v", bucket, err)
+	}
+
+	// Mark that we've initialized this bucket's table
+	s.tables[bucket] = true
+
+	log.Debugf("Created/verified table %s for bucket %s", tableName, bucket)
+	return nil
+}
+
+// prepare returns the prepared statements of a bucket, preparing them on first use
+func (s *postgresStore) prepare(bucket string) (*postgresStatements, error) {
+	s.mutex.RLock()
+	stmts := s.statements[bucket]
+	s.mutex.RUnlock()
+	if stmts != nil {
+		return stmts, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if stmts := s.statements[bucket]; stmts != nil {
+		return stmts, nil
+	}
+
+	tableName := bucketTableName(bucket)
+	stmts = &postgresStatements{}
+	var err error
+
+	stmts.upsert, err = s.db.Prepare(fmt.Sprintf(`
+		INSERT INTO %s (path, size, content_type, is_backed_up, last_modified, deleted, etag, metadata, mirror_status, mirror_rule, mirror_key, tombstone, purge_at, trash_key, mirror_storage_class)
+		SELECT * FROM unnest($1::text[], $2::bigint[], $3::text[], $4::boolean[], $5::text[]::timestamp[], $6::boolean[], $7::text[], $8::text[]::jsonb[], $9::text[]::jsonb[], $10::text[], $11::text[], $12::text[], $13::text[]::timestamp[], $14::text[], $15::text[]::jsonb[])
+		ON CONFLICT (path)
+		DO UPDATE SET
+			size = EXCLUDED.size,
+			content_type = EXCLUDED.content_type,
+			is_backed_up = EXCLUDED.is_backed_up,
+			last_modified = EXCLUDED.last_modified,
+			deleted = EXCLUDED.deleted,
+			etag = EXCLUDED.etag,
+			metadata = EXCLUDED.metadata,
+			mirror_status = EXCLUDED.mirror_status,
+			mirror_rule = EXCLUDED.mirror_rule,
+			mirror_key = EXCLUDED.mirror_key,
+			tombstone = EXCLUDED.tombstone,
+			purge_at = EXCLUDED.purge_at,
+			trash_key = EXCLUDED.trash_key,
+			mirror_storage_class = EXCLUDED.mirror_storage_class,
+			updated_at = NOW()
+	`, tableName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare upsert for %s: %w", tableName, err)
+	}
+
+	// Backed up once no target is pending or failed
+	stmts.mirrorStatus, err = s.db.Prepare(fmt.Sprintf(`
+		UPDATE %s AS t SET
+			mirror_status = COALESCE(t.mirror_status, '{}'::jsonb) || u.status,
+			is_backed_up = NOT EXISTS (
+				SELECT 1 FROM jsonb_each_text(COALESCE(t.mirror_status, '{}'::jsonb) || u.status) AS s
+				WHERE s.value <> 'COMPLETED'
+			),
+			mirror_storage_class = COALESCE(t.mirror_storage_class, '{}'::jsonb) || COALESCE(u.storage_class, '{}'::jsonb),
+			updated_at = NOW()
+		FROM unnest($1::text[], $2::text[]::jsonb[], $3::text[]::jsonb[]) AS u(path, status, storage_class)
+		WHERE t.path = u.path
+	`, tableName))
+	if err != nil {
+		stmts.upsert.Close()
+		return nil, fmt.Errorf("failed to prepare mirror status update for %s: %w", tableName, err)
+	}
+
+	stmts.deleted, err = s.db.Prepare(fmt.Sprintf(`
+		UPDATE %s AS t SET deleted = true, last_modified = d.at, updated_at = NOW()
+		FROM unnest($1::text[], $2::text[]::timestamp[]) AS d(path, at)
+		WHERE t.path = d.path
+	`, tableName))
+	if err != nil {
+		stmts.upsert.Close()
+		stmts.mirrorStatus.Close()
+		return nil, fmt.Errorf("failed to prepare delete update for %s: %w", tableName, err)
+	}
+
+	// Records written again since the delete keep their (empty) tombstone
+	stmts.tombstone, err = s.db.Prepare(fmt.Sprintf(`
+		UPDATE %s AS t SET tombstone = u.state, purge_at = u.purge_at, trash_key = u.trash_key, updated_at = NOW()
+		FROM unnest($1::text[], $2::text[], $3::text[]::timestamp[], $4::text[]) AS u(path, state, purge_at, trash_key)
+		WHERE t.path = u.path AND t.deleted
+	`, tableName))
+	if err != nil {
+		stmts.upsert.Close()
+		stmts.mirrorStatus.Close()
+		stmts.deleted.Close()
+		return nil, fmt.Errorf("failed to prepare tombstone update for %s: %w", tableName, err)
+	}
+
+	s.statements[bucket] = stmts
+	return stmts, nil
+}
+
+func (s *postgresStore) ApplyBatch(bucket string, ops []InventoryOp) error {
+	stmts, err := s.prepare(bucket)
+	if err != nil {
+		return err
+	}
+
+	var (
+		paths, contentTypes, modified, etags []string
+		rules, mirrorKeys                    []sql.NullString
+		tombstones, purgeAt, trashKeys       []sql.NullString
+		sizes                                []int64
+		backedUp, deleted                    []bool
+		metadata, mirrorStatus               []sql.NullString
+		storageClasses                       []sql.NullString
+		statusPaths, deletedPaths            []string
+		statusUpdates, statusStorageClasses  []sql.NullString
+		deletedAt                            []string
+		tombstonePaths                       []string
+		tombstoneStates, tombstonePurgeAt    []sql.NullString
+		tombstoneTrashKeys                   []sql.NullString
+	)
+
+	for _, op := range ops {
+		if rec := op.Record; rec != nil {
+			encoded, err := marshalMetadata(rec.Metadata)
+			if err != nil {
+				return err
+			}
+			status, err := marshalMetadata(rec.MirrorStatus)
+			if err != nil {
+				return err
+			}
+			storageClass, err := marshalMetadata(rec.MirrorStorageClass)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, rec.Key)
+			sizes = append(sizes, rec.Size)
+			contentTypes = append(contentTypes, rec.ContentType)
+			backedUp = append(backedUp, rec.IsBackedUp)
+			modified = append(modified, formatTimestamp(rec.LastModified))
+			deleted = append(deleted, rec.Deleted)
+			etags = append(etags, rec.ETag)
+			metadata = append(metadata, encoded)
+			mirrorStatus = append(mirrorStatus, status)
+			storageClasses = append(storageClasses, storageClass)
+			rules = append(rules, sql.NullString{String: rec.MirrorRule, Valid: rec.MirrorRule != ""})
+			mirrorKeys = append(mirrorKeys, sql.NullString{String: rec.MirrorKey, Valid: rec.MirrorKey != ""})
+			state, purge, trashKey := tombstoneColumns(rec.Tombstone)
+			tombstones = append(tombstones, state)
+			purgeAt = append(purgeAt, purge)
+			trashKeys = append(trashKeys, trashKey)
+			continue
+		}
+		if len(op.MirrorStatus) > 0 {
+			status, err := marshalMetadata(op.MirrorStatus)
+			if err != nil {
+				return err
+			}
+			storageClass, err := marshalMetadata(op.MirrorStorageClass)
+			if err != nil {
+				return err
+			}
+			statusPaths = append(statusPaths, op.Key)
+			statusUpdates = append(statusUpdates, status)
+			statusStorageClasses = append(statusStorageClasses, storageClass)
+		}
+		if op.DeletedAt != nil {
+			deletedPaths = append(deletedPaths, op.Key)
+			deletedAt = append(deletedAt, formatTimestamp(*op.DeletedAt))
+		}
+		if op.Tombstone != nil {
+			state, purge, trashKey := tombstoneColumns(op.Tombstone)
+			tombstonePaths = append(tombstonePaths, op.Key)
+			tombstoneStates = append(tombstoneStates, state)
+			tombstonePurgeAt = append(tombstonePurgeAt, purge)
+			tombstoneTrashKeys = append(tombstoneTrashKeys, trashKey)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(paths) > 0 {
+		if _, err := tx.Stmt(stmts.upsert).Exec(pq.Array(paths), pq.Array(sizes), pq.Array(contentTypes),
+			pq.Array(backedUp), pq.Array(modified), pq.Array(deleted), pq.Array(etags), pq.Array(metadata), pq.Array(mirrorStatus), pq.Array(rules), pq.Array(mirrorKeys),
+			pq.Array(tombstones), pq.Array(purgeAt), pq.Array(trashKeys), pq.Array(storageClasses)); err != nil {
+			return fmt.Errorf("failed to upsert file records: %w", err)
+		}
+	}
+	if len(statusPaths) > 0 {
+		if _, err := tx.Stmt(stmts.mirrorStatus).Exec(pq.Array(statusPaths), pq.Array(statusUpdates), pq.Array(statusStorageClasses)); err != nil {
+			return fmt.Errorf("failed to update mirror status: %w", err)
+		}
+	}
+	if len(deletedPaths) > 0 {
+		if _, err := tx.Stmt(stmts.deleted).Exec(pq.Array(deletedPaths), pq.Array(deletedAt)); err != nil {
+			return fmt.Errorf("failed to mark files as deleted: %w", err)
+		}
+	}
+	if len(tombstonePaths) > 0 {
+		if _, err := tx.Stmt(stmts.tombstone).Exec(pq.Array(tombstonePaths), pq.Array(tombstoneStates), pq.Array(tombstonePurgeAt), pq.Array(tombstoneTrashKeys)); err != nil {
+			return fmt.Errorf("failed to update tombstones: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresStore) UpsertObject(bucket string, rec ObjectRecord) error {
+	return s.ApplyBatch(bucket, []InventoryOp{{Key: rec.Key, Record: &rec}})
+}
+
+func (s *postgresStore) SetMirrorStatus(bucket, key, target, status, storageClass string) error {
+	return s.ApplyBatch(bucket, []InventoryOp{{Key: key, MirrorStatus: map[string]string{target: status}, MirrorStorageClass: mirrorStorageClass(target, storageClass)}})
+}
+
+func (s *postgresStore) MarkDeleted(bucket, key string, at time.Time) error {
+	return s.ApplyBatch(bucket, []InventoryOp{{Key: key, DeletedAt: &at}})
+}
+
+func (s *postgresStore) SetTombstone(bucket, key string, tombstone Tombstone) error {
+	return s.ApplyBatch(bucket, []InventoryOp{{Key: key, Tombstone: &tombstone}})
+}
+
+func (s *postgresStore) GetObject(bucket, key string) (*ObjectRecord, error) {
+	row := s.db.QueryRow(fmt.Sprintf(`
+		SELECT %s
+		FROM %s WHERE path = $1
+	`, objectRecordColumns, bucketTableName(bucket)), key)
+
+	rec, err := scanObjectRecord(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (s *postgresStore) ListObjects(bucket string, query ObjectQuery) ([]ObjectRecord, error) {
+	// COLLATE "C" gives the same binary ordering S3 uses for keys
+	var conditions []string
+	var args []interface{}
+
+	// Prefixes are a range of the path index rather than a scan
+	if query.Prefix != "" {
+		args = append(args, query.Prefix)
+		conditions = append(conditions, fmt.Sprintf(`path COLLATE "C" >= $%d`, len(args)))
+		if upper, ok := prefixUpperBound(query.Prefix); ok {
+			args = append(args, upper)
+			conditions = append(conditions, fmt.Sprintf(`path COLLATE "C" < $%d`, len(args)))
+		}
+	}
+	if query.StartAfter != "" {
+		args = append(args, query.StartAfter)
+		conditions = append(conditions, fmt.Sprintf(`path COLLATE "C" > $%d`, len(args)))
+	}
+	if !query.PurgeDue.IsZero() {
+		args = append(args, formatTimestamp(query.PurgeDue))
+		conditions = append(conditions, fmt.Sprintf("deleted = true AND purge_at <= $%d", len(args)))
+	} else if !query.IncludeDeleted {
+		conditions = append(conditions, "deleted = false")
+	}
+
+	sqlQuery := fmt.Sprintf(`
+		SELECT %s
+		FROM %s`, objectRecordColumns, bucketTableName(bucket))
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += ` ORDER BY path COLLATE "C"`
+	if query.Limit > 0 {
+		sqlQuery += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ObjectRecord
+	for rows.Next() {
+		rec, err := scanObjectRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	return records, rows.Err()
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting
+// with prefix in code point order, which COLLATE "C" follows for UTF-8. A
+// prefix of only maximal code points has no bound.
+func prefixUpperBound(prefix string) (string, bool) {
+	runes := []rune(prefix)
+	for i := len(runes) - 1; i >= 0; i-- {
+		switch next := runes[i] + 1; {
+		case next > utf8.MaxRune:
+			continue
+		case next >= 0xD800 && next <= 0xDFFF:
+			// Surrogates are not valid in UTF-8
+			runes[i] = 0xE000
+		default:
+			runes[i] = next
+		}
+		return string(runes[:i+1]), true
+	}
+	return "", false
+}
+
+func (s *postgresStore) Buckets() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM s3_mirror_buckets ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, name)
+	}
+	return buckets, rows.Err()
+}
+
+func (s *postgresStore) Close() error {
+	s.mutex.Lock()
+	for _, stmts := range s.statements {
+		stmts.upsert.Close()
+		stmts.mirrorStatus.Close()
+		stmts.deleted.Close()
+		stmts.tombstone.Close()
+	}
+	s.mutex.Unlock()
+	return s.db.Close()
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Columns read by scanObjectRecord, in order
+const objectRecordColumns = "path, size, content_type, is_backed_up, last_modified, deleted, etag, metadata, mirror_status, mirror_rule, mirror_key, tombstone, purge_at, trash_key, mirror_storage_class"
+
+func scanObjectRecord(row rowScanner) (*ObjectRecord, error) {
+	var rec ObjectRecord
+	var etag, rule, mirrorKey, tombstone, trashKey sql.NullString
+	var purgeAt sql.NullTime
+	var metadata, mirrorStatus, storageClass []byte
+	if err := row.Scan(&rec.Key, &rec.Size, &rec.ContentType, &rec.IsBackedUp, &rec.LastModified, &rec.Deleted, &etag, &metadata, &mirrorStatus, &rule, &mirrorKey,
+		&tombstone, &purgeAt, &trashKey, &storageClass); err != nil {
+		return nil, err
+	}
+	if tombstone.Valid {
+		rec.Tombstone = &Tombstone{State: tombstone.String, TrashKey: trashKey.String}
+		if purgeAt.Valid {
+			rec.Tombstone.PurgeAt = &purgeAt.Time
+		}
+	}
+	rec.ETag = etag.String
+	rec.MirrorRule = rule.String
+	rec.MirrorKey = mirrorKey.String
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &rec.Metadata); err != nil {
+			return nil, fmt.Errorf("invalid metadata for %s: %w", rec.Key, err)
+		}
+	}
+	if len(mirrorStatus) > 0 {
+		if err := json.Unmarshal(mirrorStatus, &rec.MirrorStatus); err != nil {
+			return nil, fmt.Errorf("invalid mirror status for %s: %w", rec.Key, err)
+		}
+	}
+	if len(storageClass) > 0 {
+		if err := json.Unmarshal(storageClass, &rec.MirrorStorageClass); err != nil {
+			return nil, fmt.Errorf("invalid mirror storage class for %s: %w", rec.Key, err)
+		}
+	}
+	return &rec, nil
+}
+
+// tombstoneColumns returns the tombstone, purge_at and trash_key columns of a tombstone
+func tombstoneColumns(tombstone *Tombstone) (sql.NullString, sql.NullString, sql.NullString) {
+	if tombstone == nil {
+		return sql.NullString{}, sql.NullString{}, sql.NullString{}
+	}
+	var purgeAt sql.NullString
+	if tombstone.PurgeAt != nil {
+		purgeAt = sql.NullString{String: formatTimestamp(*tombstone.PurgeAt), Valid: true}
+	}
+	return sql.NullString{String: tombstone.State, Valid: true}, purgeAt,
+		sql.NullString{String: tombstone.TrashKey, Valid: tombstone.TrashKey != ""}
+}
+
+// marshalMetadata encodes metadata for a JSONB column, nil stays NULL
+func marshalMetadata(metadata map[string]string) (sql.NullString, error) {
+	if len(metadata) == 0 {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(encoded), Valid: true}, nil
+}
+
+// formatTimestamp formats a time for a TIMESTAMP (without time zone) column,
+// keeping the wall clock like lib/pq does for time.Time parameters
+func formatTimestamp(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05.999999")
+}
+
+var dbNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// sanitizeDBName returns the table name buckets used to have. It is lossy
+// (my-bucket and my.bucket share bucket_my_bucket) and long names get
+// truncated, only the migration to bucketTableName still uses it.
+func sanitizeDBName(name string) string {
+	// Replace non-alphanumeric characters with underscores and prefix with bucket_
+	sanitized := dbNameRegexp.ReplaceAllString(name, "_")
+	return "bucket_" + sanitized
+}
+
+// Longest table name, idx_<table>_<suffix> index names must still fit in
+// the 63 bytes Postgres keeps of an identifier
+const maxBucketTableName = 51
+
+// Index name suffixes of a bucket table
+var bucketIndexSuffixes = []string{"path", "path_c", "backup", "deleted", "purge"}
+
+// bucketTableName returns the table of a bucket: its sanitized name, cut to
+// fit, followed by a hash of the exact name so no two buckets share a table
+func bucketTableName(bucket string) string {
+	sum := sha256.Sum256([]byte(bucket))
+	suffix := "_" + hex.EncodeToString(sum[:4])
+	name := strings.ToLower(sanitizeDBName(bucket))
+	if len(name) > maxBucketTableName-len(suffix) {
+		name = name[:maxBucketTableName-len(suffix)]
+	}
+	return name + suffix
+}
+
+// renameBucketTable renames a bucket table and its indexes
+func renameBucketTable(tx *sql.Tx, from, to string) error {
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE IF EXISTS %s RENAME TO %s", from, to)); err != nil {
+		return fmt.Errorf("failed to rename table %s to %s: %w", from, to, err)
+	}
+	for _, suffix := range bucketIndexSuffixes {
+		if _, err := tx.Exec(fmt.Sprintf("ALTER INDEX IF EXISTS idx_%s_%s RENAME TO idx_%s_%s", from, suffix, to, suffix)); err != nil {
+			return fmt.Errorf("failed to rename index of table %s: %w", from, err)
+		}
+	}
+	return nil
+}
+
+// migrateBucketTables renames the registered tables still named by
+// sanitizeDBName. A table several buckets shared holds the objects of all of
+// them: it is left as is, and each of them starts over with an empty table
+// marked incomplete. The old name stays in legacy_table so no other bucket
+// adopts it.
+func migrateBucketTables(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name, table_name FROM s3_mirror_buckets`)
+	if err != nil {
+		return fmt.Errorf("failed to read bucket registry: %w", err)
+	}
+	legacy := make(map[string][]string)
+	for rows.Next() {
+		var name, table string
+		if err := rows.Scan(&name, &table); err != nil {
+			rows.Close()
+			return err
+		}
+		if table != bucketTableName(name) {
+			legacy[table] = append(legacy[table], name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for table, buckets := range legacy {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		incomplete := sql.NullString{}
+		if len(buckets) == 1 {
+			if err := renameBucketTable(tx, table, bucketTableName(buckets[0])); err != nil {
+				tx.Rollback()
+				return err
+			}
+			log.Infof("Migrated inventory table %s of bucket %s to %s", table, buckets[0], bucketTableName(buckets[0]))
+		} else {
+			sort.Strings(buckets)
+			incomplete = sql.NullString{String: fmt.Sprintf("table %s was shared by buckets %s", table, strings.Join(buckets, ", ")), Valid: true}
+			log.Errorf("Inventory table %s was shared by buckets %s, each gets a new empty table and %s is left as is",
+				table, strings.Join(buckets, ", "), table)
+		}
+		for _, bucket := range buckets {
+			if _, err := tx.Exec(`
+				UPDATE s3_mirror_buckets SET table_name = $2, legacy_table = $3, incomplete = COALESCE($4, incomplete)
+				WHERE name = $1
+			`, bucket, bucketTableName(bucket), table, incomplete); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to update bucket registry: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to migrate table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// adoptLegacyTable renames the table a bucket written before the registry
+// existed still has under its sanitizeDBName, unless a registered bucket
+// claims it
+func (s *postgresStore) adoptLegacyTable(bucket, tableName string) error {
+	legacyName := sanitizeDBName(bucket)
+	var registered, legacyExists, claimed bool
+	if err := s.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM s3_mirror_buckets WHERE name = $1),
+			to_regclass($2) IS NOT NULL,
+			EXISTS (SELECT 1 FROM s3_mirror_buckets WHERE lower(table_name) = lower($2) OR lower(legacy_table) = lower($2))
+	`, bucket, legacyName).Scan(&registered, &legacyExists, &claimed); err != nil {
+		return fmt.Errorf("failed to look up the table of bucket %s: %w", bucket, err)
+	}
+	if registered || !legacyExists || claimed {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := renameBucketTable(tx, legacyName, tableName); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to migrate table %s: %w", legacyName, err)
+	}
+	log.Infof("Migrated inventory table %s of bucket %s to %s", legacyName, bucket, tableName)
+	return nil
+}
+
+// loadIncompleteBuckets keeps reads of the buckets whose inventory was lost
+// in a migration from being served by the inventory, until the mark is
+// cleared from the registry
+func loadIncompleteBuckets(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name, incomplete FROM s3_mirror_buckets WHERE incomplete IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to read bucket registry: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, reason string
+		if err := rows.Scan(&name, &reason); err != nil {
+			return err
+		}
+		markInventoryIncomplete(name, reason+", clear incomplete in s3_mirror_buckets once its table is complete")
+	}
+	return rows.Err()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBucketTableName(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	buckets := []string{"my-bucket", "my.bucket", "my_bucket", "My-Bucket", long, long[:62] + "b", "a"}
+
+	seen := make(map[string]string)
+	for _, bucket := range buckets {
+		table := bucketTableName(bucket)
+		if other, ok := seen[table]; ok {
+			t.Errorf("buckets %q and %q share table %s", bucket, other, table)
+		}
+		seen[table] = bucket
+
+		if !strings.HasPrefix(table, "bucket_") || strings.ToLower(table) != table {
+			t.Errorf("bucketTableName(%q) = %s, want a lowercase bucket_ name", bucket, table)
+		}
+		// Index names must not be truncated into one another
+		for _, suffix := range bucketIndexSuffixes {
+			if index := "idx_" + table + "_" + suffix; len(index) > 63 {
+				t.Errorf("index %s of bucket %q is longer than 63 bytes", index, bucket)
+			}
+		}
+		if bucketTableName(bucket) != table {
+			t.Errorf("bucketTableName(%q) is not stable", bucket)
+		}
+	}
+
+	if got := bucketTableName("my-data"); got != "bucket_my_data_c0b8114a" {
+		t.Errorf("bucketTableName(my-data) = %s, want bucket_my_data_c0b8114a", got)
+	}
+}
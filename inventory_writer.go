@@ -0,0 +1,531 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// InventoryOp is the coalesced change of one key within a batch
+type InventoryOp struct {
+	Key                string
+	Record             *ObjectRecord     // Record to upsert, nil for updates of an existing record
+	MirrorStatus       map[string]string // Mirror status per target merged into the existing record
+	MirrorStorageClass map[string]string // Storage class of the copy per target merged into the existing record
+	DeletedAt          *time.Time        // Mark the existing record as deleted
+	Tombstone          *Tombstone        // Tombstone of the existing record, applied once it is deleted
+}
+
+// apply returns the record resulting from the op applied on rec (which may be nil)
+func (op *InventoryOp) apply(rec *ObjectRecord) *ObjectRecord {
+	if op.Record != nil {
+		copied := *op.Record
+		copied.MirrorStatus = copyMirrorStatus(op.Record.MirrorStatus)
+		copied.MirrorStorageClass = copyMirrorStatus(op.Record.MirrorStorageClass)
+		return &copied
+	}
+	// Updates of unknown keys are ignored like an UPDATE matching no rows
+	if rec == nil {
+		return nil
+	}
+	copied := *rec
+	if op.MirrorStatus != nil {
+		copied = copied.withMirrorStatus(op.MirrorStatus, op.MirrorStorageClass)
+	}
+	if op.DeletedAt != nil {
+		copied.Deleted = true
+		copied.LastModified = *op.DeletedAt
+	}
+	if op.Tombstone != nil && copied.Deleted {
+		tombstone := *op.Tombstone
+		copied.Tombstone = &tombstone
+	}
+	return &copied
+}
+
+// clone returns a deep copy of the op, queued ops keep changing until flushed
+func (op *InventoryOp) clone() *InventoryOp {
+	if op == nil {
+		return nil
+	}
+	copied := *op
+	if op.Record != nil {
+		rec := *op.Record
+		rec.MirrorStatus = copyMirrorStatus(op.Record.MirrorStatus)
+		rec.MirrorStorageClass = copyMirrorStatus(op.Record.MirrorStorageClass)
+		copied.Record = &rec
+	}
+	if op.MirrorStatus != nil {
+		copied.MirrorStatus = copyMirrorStatus(op.MirrorStatus)
+	}
+	if op.MirrorStorageClass != nil {
+		copied.MirrorStorageClass = copyMirrorStatus(op.MirrorStorageClass)
+	}
+	if op.Tombstone != nil {
+		tombstone := *op.Tombstone
+		copied.Tombstone = &tombstone
+	}
+	return &copied
+}
+
+// then returns the op applying op and then next, next being the newer change
+func (op *InventoryOp) then(next *InventoryOp) *InventoryOp {
+	if next.Record != nil {
+		return next.clone()
+	}
+	if op.Record != nil {
+		return &InventoryOp{Key: op.Key, Record: next.apply(op.Record)}
+	}
+	merged := op.clone()
+	for target, status := range next.MirrorStatus {
+		if merged.MirrorStatus == nil {
+			merged.MirrorStatus = make(map[string]string)
+		}
+		merged.MirrorStatus[target] = status
+	}
+	for target, class := range next.MirrorStorageClass {
+		if merged.MirrorStorageClass == nil {
+			merged.MirrorStorageClass = make(map[string]string)
+		}
+		merged.MirrorStorageClass[target] = class
+	}
+	if next.DeletedAt != nil {
+		deletedAt := *next.DeletedAt
+		merged.DeletedAt = &deletedAt
+	}
+	if next.Tombstone != nil {
+		tombstone := *next.Tombstone
+		merged.Tombstone = &tombstone
+	}
+	return merged
+}
+
+// Longest wait between two attempts of a failed batch
+const inventoryMaxRetryDelay = 30 * time.Second
+
+var (
+	inventoryBatchWindow  time.Duration // Maximum time a write waits in the queue, 0 disables batching
+	inventoryBatchSize    int           // Number of queued keys triggering an immediate flush
+	inventoryBatchRetries int           // Attempts of a failed batch before its changes are dropped
+
+	inventoryBatches    = newCounter("s3mirror_inventory_batches_total", "Inventory batches written.", "result")
+	inventoryBatchOps   = newCounter("s3mirror_inventory_batch_ops_total", "Coalesced inventory changes written in batches.")
+	inventoryCoalesced  = newCounter("s3mirror_inventory_coalesced_total", "Inventory changes merged into a change already queued.")
+	inventoryFlushDelay = newGauge("s3mirror_inventory_last_flush_seconds", "Duration of the last inventory batch flush.")
+)
+
+func loadInventoryBatchConfig() {
+	window, err := time.ParseDuration(getEnvOrDefault("INVENTORY_BATCH_WINDOW", "50ms"))
+	if err != nil || window < 0 {
+		log.Fatalf("Invalid INVENTORY_BATCH_WINDOW: %v", err)
+	}
+	inventoryBatchWindow = window
+
+	size, err := strconv.Atoi(getEnvOrDefault("INVENTORY_BATCH_SIZE", "500"))
+	if err != nil || size <= 0 {
+		log.Fatalf("Invalid INVENTORY_BATCH_SIZE: %v", err)
+	}
+	inventoryBatchSize = size
+
+	retries, err := strconv.Atoi(getEnvOrDefault("INVENTORY_BATCH_RETRIES", "5"))
+	if err != nil || retries < 0 {
+		log.Fatalf("Invalid INVENTORY_BATCH_RETRIES: %v", err)
+	}
+	inventoryBatchRetries = retries
+}
+
+// batchedStore queues writes and flushes them to the backend in batches,
+// coalescing changes of the same key. Reads see queued changes.
+type batchedStore struct {
+	backend   InventoryStore
+	window    time.Duration
+	batchSize int
+
+	pending  map[string]map[string]*InventoryOp // Queued changes per bucket and key
+	inflight map[string]map[string]*InventoryOp // Changes being written by the current flush
+	failures map[string]int                     // Failed attempts of the queued changes per bucket
+	count    int
+	timer    *time.Timer
+	flushing bool // A flush was triggered by the batch size and has not started yet
+	mutex    sync.Mutex
+
+	// Serializes flushes so changes reach the backend in order
+	flushMutex sync.Mutex
+}
+
+func newBatchedStore(backend InventoryStore, window time.Duration, batchSize int) *batchedStore {
+	return &batchedStore{
+		backend:   backend,
+		window:    window,
+		batchSize: batchSize,
+		pending:   make(map[string]map[string]*InventoryOp),
+		failures:  make(map[string]int),
+	}
+}
+
+// enqueue merges a change into the queued op of a key
+func (s *batchedStore) enqueue(bucket, key string, merge func(op *InventoryOp)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ops := s.pending[bucket]
+	if ops == nil {
+		ops = make(map[string]*InventoryOp)
+		s.pending[bucket] = ops
+	}
+	op := ops[key]
+	if op == nil {
+		op = &InventoryOp{Key: key}
+		ops[key] = op
+		s.count++
+	} else {
+		inventoryCoalesced.Inc()
+	}
+	merge(op)
+
+	if s.count >= s.batchSize {
+		if s.timer != nil {
+			s.timer.Stop()
+			s.timer = nil
+		}
+		if !s.flushing {
+			s.flushing = true
+			go s.flushLogged()
+		}
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(s.window, s.flushLogged)
+	}
+}
+
+func (s *batchedStore) flushLogged() {
+	// Errors are already logged per bucket
+	s.Flush()
+}
+
+// Flush writes every queued change and waits for it to be committed
+func (s *batchedStore) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+
+	s.mutex.Lock()
+	batch := s.pending
+	s.pending = make(map[string]map[string]*InventoryOp)
+	s.inflight = batch
+	s.count = 0
+	s.flushing = false
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		s.inflight = nil
+		s.mutex.Unlock()
+	}()
+
+	start := time.Now()
+	var firstErr error
+	for bucket, ops := range batch {
+		list := make([]InventoryOp, 0, len(ops))
+		for _, op := range ops {
+			list = append(list, *op)
+		}
+		// Stable order keeps concurrent transactions from deadlocking
+		sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+		if err := s.backend.ApplyBatch(bucket, list); err != nil {
+			inventoryBatches.Inc("error")
+			if firstErr == nil {
+				firstErr = err
+			}
+			s.retry(bucket, ops, err)
+			continue
+		}
+		inventoryBatches.Inc("success")
+		inventoryBatchOps.Add(float64(len(list)))
+		s.mutex.Lock()
+		delete(s.failures, bucket)
+		s.mutex.Unlock()
+	}
+
+	if len(batch) > 0 {
+		inventoryFlushDelay.Set(time.Since(start).Seconds())
+	}
+	return firstErr
+}
+
+// retry queues the changes of a failed batch again, under the changes queued
+// since, and schedules the next attempt with an exponential backoff. Once
+// every attempt failed the changes are dropped and the bucket's inventory is
+// incomplete.
+func (s *batchedStore) retry(bucket string, ops map[string]*InventoryOp, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failures[bucket]++
+	attempts := s.failures[bucket]
+	if attempts > inventoryBatchRetries {
+		log.Errorf("Dropping %d inventory changes for bucket %s after %d attempts: %v", len(ops), bucket, attempts, err)
+		delete(s.failures, bucket)
+		markInventoryIncomplete(bucket, err.Error())
+		return
+	}
+
+	queued := s.pending[bucket]
+	if queued == nil {
+		queued = make(map[string]*InventoryOp)
+		s.pending[bucket] = queued
+	}
+	for key, op := range ops {
+		if newer := queued[key]; newer != nil {
+			queued[key] = op.then(newer)
+			continue
+		}
+		queued[key] = op
+		s.count++
+	}
+
+	delay := time.Second << (attempts - 1)
+	if delay > inventoryMaxRetryDelay {
+		delay = inventoryMaxRetryDelay
+	}
+	log.Warnf("Failed to write %d inventory changes for bucket %s, retrying in %s (attempt %d of %d): %v",
+		len(ops), bucket, delay, attempts, inventoryBatchRetries, err)
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(delay, s.flushLogged)
+}
+
+// retrying tells if changes of a bucket are waiting for another attempt
+func (s *batchedStore) retrying(bucket string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.failures[bucket] > 0
+}
+
+func (s *batchedStore) EnsureBucket(bucket string) error {
+	return s.backend.EnsureBucket(bucket)
+}
+
+func (s *batchedStore) UpsertObject(bucket string, rec ObjectRecord) error {
+	s.enqueue(bucket, rec.Key, func(op *InventoryOp) {
+		op.Record = &rec
+		op.MirrorStatus = nil
+		op.MirrorStorageClass = nil
+		op.DeletedAt = nil
+		op.Tombstone = nil
+	})
+	return nil
+}
+
+func (s *batchedStore) SetMirrorStatus(bucket, key, target, status, storageClass string) error {
+	s.enqueue(bucket, key, func(op *InventoryOp) {
+		if op.Record != nil {
+			*op.Record = op.Record.withMirrorStatus(map[string]string{target: status}, mirrorStorageClass(target, storageClass))
+			return
+		}
+		if op.MirrorStatus == nil {
+			op.MirrorStatus = make(map[string]string)
+		}
+		op.MirrorStatus[target] = status
+		if storageClass != "" {
+			if op.MirrorStorageClass == nil {
+				op.MirrorStorageClass = make(map[string]string)
+			}
+			op.MirrorStorageClass[target] = storageClass
+		}
+	})
+	return nil
+}
+
+func (s *batchedStore) MarkDeleted(bucket, key string, at time.Time) error {
+	s.enqueue(bucket, key, func(op *InventoryOp) {
+		if op.Record != nil {
+			op.Record.Deleted = true
+			op.Record.LastModified = at
+		} else {
+			op.DeletedAt = &at
+		}
+	})
+	return nil
+}
+
+func (s *batchedStore) SetTombstone(bucket, key string, tombstone Tombstone) error {
+	s.enqueue(bucket, key, func(op *InventoryOp) {
+		if op.Record == nil {
+			op.Tombstone = &tombstone
+		} else if op.Record.Deleted {
+			op.Record.Tombstone = &tombstone
+		}
+	})
+	return nil
+}
+
+func (s *batchedStore) ApplyBatch(bucket string, ops []InventoryOp) error {
+	for _, op := range ops {
+		if op.Record != nil {
+			s.UpsertObject(bucket, *op.Record)
+		}
+		for target, status := range op.MirrorStatus {
+			s.SetMirrorStatus(bucket, op.Key, target, status, op.MirrorStorageClass[target])
+		}
+		if op.DeletedAt != nil {
+			s.MarkDeleted(bucket, op.Key, *op.DeletedAt)
+		}
+		if op.Tombstone != nil {
+			s.SetTombstone(bucket, op.Key, *op.Tombstone)
+		}
+	}
+	return nil
+}
+
+func (s *batchedStore) GetObject(bucket, key string) (*ObjectRecord, error) {
+	s.mutex.Lock()
+	pending := s.pending[bucket][key].clone()
+	inflight := s.inflight[bucket][key].clone()
+	s.mutex.Unlock()
+
+	return applyQueued(inflight, pending, func() (*ObjectRecord, error) {
+		return s.backend.GetObject(bucket, key)
+	})
+}
+
+// applyQueued returns a record with its in-flight and pending changes
+// applied, stored is only read when they don't fully define it
+func applyQueued(inflight, pending *InventoryOp, stored func() (*ObjectRecord, error)) (*ObjectRecord, error) {
+	// A queued upsert fully defines the record
+	if pending != nil && pending.Record != nil {
+		return pending.apply(nil), nil
+	}
+
+	var rec *ObjectRecord
+	if inflight == nil || inflight.Record == nil {
+		var err error
+		if rec, err = stored(); err != nil {
+			return nil, err
+		}
+	}
+	if inflight != nil {
+		rec = inflight.apply(rec)
+	}
+	if pending != nil {
+		rec = pending.apply(rec)
+	}
+	return rec, nil
+}
+
+// ListObjects lists the backend with the queued changes applied. A queued
+// change may hide a listed record, so the backend is read one record
+// further per queued key.
+func (s *batchedStore) ListObjects(bucket string, query ObjectQuery) ([]ObjectRecord, error) {
+	type queuedOps struct{ inflight, pending *InventoryOp }
+	queued := make(map[string]*queuedOps)
+	s.mutex.Lock()
+	for key, op := range s.inflight[bucket] {
+		if query.matchesKey(key) {
+			queued[key] = &queuedOps{inflight: op.clone()}
+		}
+	}
+	for key, op := range s.pending[bucket] {
+		if !query.matchesKey(key) {
+			continue
+		}
+		if queued[key] == nil {
+			queued[key] = &queuedOps{}
+		}
+		queued[key].pending = op.clone()
+	}
+	s.mutex.Unlock()
+
+	if len(queued) == 0 {
+		return s.backend.ListObjects(bucket, query)
+	}
+
+	backendQuery := query
+	if query.Limit > 0 {
+		backendQuery.Limit = query.Limit + len(queued)
+	}
+	listed, err := s.backend.ListObjects(bucket, backendQuery)
+	if err != nil {
+		return nil, err
+	}
+	// Past the last record of a full page the backend has records not read yet
+	last, complete := "", backendQuery.Limit == 0 || len(listed) < backendQuery.Limit
+	if !complete {
+		last = listed[len(listed)-1].Key
+	}
+
+	records := make([]ObjectRecord, 0, len(listed)+len(queued))
+	stored := make(map[string]*ObjectRecord)
+	for i, rec := range listed {
+		if queued[rec.Key] != nil {
+			stored[rec.Key] = &listed[i]
+			continue
+		}
+		records = append(records, rec)
+	}
+	for key, ops := range queued {
+		if !complete && key > last {
+			continue
+		}
+		rec, err := applyQueued(ops.inflight, ops.pending, func() (*ObjectRecord, error) {
+			if rec := stored[key]; rec != nil {
+				return rec, nil
+			}
+			// Records the query filters out may become part of it
+			return s.backend.GetObject(bucket, key)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil && query.matches(rec) {
+			records = append(records, *rec)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[:query.Limit]
+	}
+	return records, nil
+}
+
+func (s *batchedStore) Buckets() ([]string, error) {
+	return s.backend.Buckets()
+}
+
+// Close writes the queued changes, retrying failed batches until they are
+// committed or dropped
+func (s *batchedStore) Close() error {
+	for s.Flush() != nil {
+		s.mutex.Lock()
+		pending := s.count
+		s.mutex.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	return s.backend.Close()
+}
+
+// flushInventory waits until every queued inventory change is committed
+func flushInventory() error {
+	if batched, ok := inventory.(*batchedStore); ok {
+		return batched.Flush()
+	}
+	return nil
+}
+
+// inventoryRetrying tells if changes of a bucket failed to be written and
+// are waiting for another attempt
+func inventoryRetrying(bucket string) bool {
+	batched, ok := inventory.(*batchedStore)
+	return ok && batched.retrying(bucket)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestBatchedStore returns a batched store over a file store, flushed
+// only when the test asks to
+func newTestBatchedStore(t *testing.T) (*batchedStore, *fileStore) {
+	backend, err := openFileStore(filepath.Join(t.TempDir(), "inventory.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newBatchedStore(backend, time.Hour, 1000)
+	t.Cleanup(func() { store.Close() })
+	return store, backend
+}
+
+// recordKeys returns the keys of records, in order
+func recordKeys(records []ObjectRecord) []string {
+	keys := []string{}
+	for _, rec := range records {
+		keys = append(keys, rec.Key)
+	}
+	return keys
+}
+
+func TestBatchedStoreListObjects(t *testing.T) {
+	store, backend := newTestBatchedStore(t)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		store.UpsertObject("bucket", ObjectRecord{Key: key, Size: 1})
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued changes: two deletes, a new key and an update
+	deletedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.MarkDeleted("bucket", "a", deletedAt)
+	store.MarkDeleted("bucket", "b", deletedAt)
+	store.UpsertObject("bucket", ObjectRecord{Key: "bb", Size: 2})
+	store.SetMirrorStatus("bucket", "c", "aws", mirrorStatusCompleted, "")
+
+	if records, _ := backend.ListObjects("bucket", ObjectQuery{}); len(records) != 5 {
+		t.Fatalf("backend has %d records, the changes must still be queued", len(records))
+	}
+
+	tests := []struct {
+		query ObjectQuery
+		keys  []string
+	}{
+		{ObjectQuery{}, []string{"bb", "c", "d", "e"}},
+		{ObjectQuery{Limit: 2}, []string{"bb", "c"}},
+		{ObjectQuery{Limit: 3, StartAfter: "bb"}, []string{"c", "d", "e"}},
+		{ObjectQuery{Prefix: "b"}, []string{"bb"}},
+		{ObjectQuery{Prefix: "b", IncludeDeleted: true}, []string{"b", "bb"}},
+		{ObjectQuery{Limit: 1, IncludeDeleted: true}, []string{"a"}},
+		{ObjectQuery{StartAfter: "z"}, []string{}},
+	}
+	for _, tt := range tests {
+		records, err := store.ListObjects("bucket", tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := recordKeys(records); !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("ListObjects(%+v) = %v, want %v", tt.query, keys, tt.keys)
+		}
+	}
+
+	records, _ := store.ListObjects("bucket", ObjectQuery{Prefix: "c"})
+	if len(records) != 1 || records[0].MirrorStatus["aws"] != mirrorStatusCompleted || !records[0].IsBackedUp {
+		t.Errorf("queued mirror status not listed: %+v", records)
+	}
+
+	// Tombstones queued on deleted records make them due for purge
+	purgeAt := deletedAt.Add(time.Hour)
+	store.Flush()
+	store.SetTombstone("bucket", "a", Tombstone{State: tombstoneDelayed, PurgeAt: &purgeAt})
+	records, _ = store.ListObjects("bucket", ObjectQuery{PurgeDue: purgeAt})
+	if keys := recordKeys(records); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("ListObjects(PurgeDue) = %v, want [a]", keys)
+	}
+}
+
+func TestInventoryOpThen(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	purgeAt := at.Add(time.Hour)
+	upsert := &InventoryOp{Key: "a", Record: &ObjectRecord{Key: "a", Size: 2, MirrorStatus: map[string]string{"aws": mirrorStatusPending}}}
+	completed := &InventoryOp{Key: "a", MirrorStatus: map[string]string{"aws": mirrorStatusCompleted}, MirrorStorageClass: map[string]string{"aws": "GLACIER"}}
+	failed := &InventoryOp{Key: "a", MirrorStatus: map[string]string{"b2": mirrorStatusFailed}}
+	deleted := &InventoryOp{Key: "a", DeletedAt: &at}
+	tombstone := &InventoryOp{Key: "a", Tombstone: &Tombstone{State: tombstoneDelayed, PurgeAt: &purgeAt}}
+
+	stored := []*ObjectRecord{
+		nil,
+		{Key: "a", Size: 1},
+		{Key: "a", Size: 1, MirrorStatus: map[string]string{"aws": mirrorStatusFailed, "b2": mirrorStatusCompleted}},
+		{Key: "a", Size: 1, Deleted: true, LastModified: at.Add(-time.Hour)},
+	}
+	sequences := map[string][]*InventoryOp{
+		"statuses":                   {completed, failed},
+		"status then delete":         {completed, deleted},
+		"delete then tombstone":      {deleted, tombstone},
+		"upsert then status":         {upsert, completed, failed},
+		"status then upsert":         {completed, upsert},
+		"upsert, delete, tombstone":  {upsert, deleted, tombstone},
+		"delete then upsert":         {deleted, tombstone, upsert, completed},
+		"tombstone of a live record": {tombstone},
+	}
+	for name, ops := range sequences {
+		for _, rec := range stored {
+			// Applying the coalesced op once matches applying each change
+			want := rec
+			for _, op := range ops {
+				want = op.apply(want)
+			}
+			coalesced := ops[0].clone()
+			for _, op := range ops[1:] {
+				coalesced = coalesced.then(op)
+			}
+			if got := coalesced.apply(rec); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s on %+v = %+v, want %+v", name, rec, got, want)
+			}
+		}
+	}
+
+	// Coalescing leaves the queued ops as they were
+	if upsert.Record.MirrorStatus["aws"] != mirrorStatusPending || len(completed.MirrorStatus) != 1 || deleted.Tombstone != nil {
+		t.Error("then changed the ops it merged")
+	}
+}
+
+// failingStore fails every batch while fail is set
+type failingStore struct {
+	*fileStore
+	fail bool
+}
+
+func (s *failingStore) ApplyBatch(bucket string, ops []InventoryOp) error {
+	if s.fail {
+		return errors.New("connection refused")
+	}
+	return s.fileStore.ApplyBatch(bucket, ops)
+}
+
+func TestBatchedStoreCoalescing(t *testing.T) {
+	file, err := openFileStore(filepath.Join(t.TempDir(), "inventory.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &failingStore{fileStore: file}
+	store := newBatchedStore(backend, time.Hour, 1000)
+	t.Cleanup(func() { store.Close() })
+	defer func(retries int) { inventoryBatchRetries = retries }(inventoryBatchRetries)
+	inventoryBatchRetries = 5
+
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.UpsertObject("bucket", ObjectRecord{Key: "a", Size: 1})
+	store.SetMirrorStatus("bucket", "a", "aws", mirrorStatusCompleted, "")
+	store.UpsertObject("bucket", ObjectRecord{Key: "b", Size: 1})
+	store.SetMirrorStatus("bucket", "b", "aws", mirrorStatusFailed, "")
+	store.SetMirrorStatus("bucket", "missing", "aws", mirrorStatusCompleted, "")
+	if store.count != 3 {
+		t.Errorf("%d queued ops, want one per key", store.count)
+	}
+
+	// A failed batch is queued again under the changes made since
+	backend.fail = true
+	if err := store.Flush(); err == nil {
+		t.Fatal("Flush succeeded on a failing backend")
+	}
+	store.SetMirrorStatus("bucket", "b", "aws", mirrorStatusCompleted, "STANDARD_IA")
+	store.MarkDeleted("bucket", "a", at)
+	if !store.retrying("bucket") || store.count != 3 {
+		t.Errorf("retrying = %v with %d queued ops, want the failed batch queued again", store.retrying("bucket"), store.count)
+	}
+
+	backend.fail = false
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.retrying("bucket") {
+		t.Error("bucket still retrying after a successful flush")
+	}
+	a, _ := file.GetObject("bucket", "a")
+	if a == nil || !a.Deleted || !a.LastModified.Equal(at) || a.MirrorStatus["aws"] != mirrorStatusCompleted {
+		t.Errorf("a = %+v, want deleted after being mirrored", a)
+	}
+	b, _ := file.GetObject("bucket", "b")
+	if b == nil || b.MirrorStatus["aws"] != mirrorStatusCompleted || b.MirrorStorageClass["aws"] != "STANDARD_IA" || !b.IsBackedUp {
+		t.Errorf("b = %+v, want the newer mirror status", b)
+	}
+	if missing, _ := file.GetObject("bucket", "missing"); missing != nil {
+		t.Errorf("update of an unknown key created %+v", missing)
+	}
+}
@@ -5,44 +5,36 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"regexp"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	_ "github.com/lib/pq"
 	"github.com/rs/dnscache"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 var (
 	// Environment variables
-	mainS3Endpoint     string
-	mainAccessKey      string
-	mainSecretKey      string
-	mirrorS3Endpoint   string
-	mirrorAccessKey    string
-	mirrorSecretKey    string
-	mirrorBucketPrefix string
-	postgresURL        string
-	disableDatabase    bool
-	proxyDomain        string // Domain for virtual-hosted style detection (e.g., "s3.local")
-
-	// Database connection pool
-	db *sql.DB
-	// Database connections cache per bucket
-	dbConnections = make(map[string]*sql.DB)
-	dbMutex       sync.RWMutex
+	postgresURL      string
+	disableDatabase  bool
+	inventoryBackend string // postgres, file or none
+	inventoryFile    string // Journal path for the file backend
+
+	// Inventory store, nil when tracking is disabled
+	inventory InventoryStore
 
 	// Shared HTTP client with connection pooling
 	httpClient *http.Client
@@ -69,16 +61,6 @@ func init() {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	// Load environment variables
-	mainS3Endpoint = getEnvOrDefault("MAIN_S3_ENDPOINT", "https://s3.amazonaws.com")
-	mainAccessKey = getEnv("MAIN_ACCESS_KEY")
-	mainSecretKey = getEnv("MAIN_SECRET_KEY")
-	mirrorS3Endpoint = getEnv("MIRROR_S3_ENDPOINT")
-	mirrorAccessKey = getEnv("MIRROR_ACCESS_KEY")
-	mirrorSecretKey = getEnv("MIRROR_SECRET_KEY")
-	mirrorBucketPrefix = getEnvOrDefault("MIRROR_BUCKET_PREFIX", "")
-	proxyDomain = getEnvOrDefault("PROXY_DOMAIN", "") // Optional: for virtual-hosted style detection
-
 	// Check if database tracking should be disabled
 	disableDatabase = getEnvOrDefault("DISABLE_DATABASE", "false") == "true"
 
@@ -86,7 +68,6 @@ func init() {
 	if !disableDatabase {
 		postgresURL = getEnv("POSTGRES_URL")
 		if postgresURL == "" {
-			disableDatabase = true
 			// Build URL from components if not provided
 			//host := getEnvOrDefault("POSTGRES_HOST", "localhost")
 			//port := getEnvOrDefault("POSTGRES_PORT", "5432")
@@ -102,14 +83,30 @@ func init() {
 		}
 	}
 
-	// Validate required environment variables
-	if mainAccessKey == "" || mainSecretKey == "" || mirrorS3Endpoint == "" || mirrorAccessKey == "" || mirrorSecretKey == "" {
-		log.Fatal("Required environment variables not set: MAIN_ACCESS_KEY, MAIN_SECRET_KEY, MIRROR_S3_ENDPOINT, MIRROR_ACCESS_KEY, MIRROR_SECRET_KEY")
-	}
-
-	if !disableDatabase && postgresURL == "" {
-		log.Fatal("POSTGRES_URL or POSTGRES_PASSWORD is required when database is enabled")
-	}
+	// Hosts of the proxy, main backends, mirror targets and the rules choosing them
+	loadProxyHostConfig()
+	loadMainBackends()
+	loadMirrorTargets()
+
+	// Select the inventory backend (postgres, file or none), rules naming
+	// keys by date need one
+	inventoryFile = getEnvOrDefault("INVENTORY_FILE", "/data/inventory.jsonl")
+	inventoryBackend = resolveInventoryBackend()
+	loadReplicationRules()
+	loadInventoryExportConfig()
+	loadInventoryListingConfig()
+	loadInventoryBatchConfig()
+	loadQuotaConfig()
+	loadAdminConfig()
+	loadClientCredentials()
+	loadAuditConfig()
+	loadPresignConfig()
+	loadEncryptionConfig()
+	loadSSEConfig()
+	loadDeletePolicies()
+	loadObjectLockConfig()
+	loadAssembledObjectConfig()
+	loadTLSConfig()
 
 	// Initialize shared HTTP client with DNS caching using rs/dnscache
 	resolver := &dnscache.Resolver{}
@@ -159,48 +156,99 @@ func init() {
 }
 
 func main() {
-	// Initialize main database connection if enabled
-	if !disableDatabase {
-		var err error
-		db, err = sql.Open("postgres", postgresURL)
-		if err != nil {
-			log.Fatalf("Failed to connect to database: %v", err)
+	// Maintenance commands share the configuration of the proxy
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "presign":
+			runPresignCommand(os.Args[2:])
+			return
+		case "restore":
+			runRestoreCommand(os.Args[2:])
+			return
+		case "rotate-keys":
+			runRotateKeysCommand(os.Args[2:])
+			return
 		}
-		defer db.Close()
+	}
+
+	// Fetch the upstream credentials and keep them fresh
+	startCredentialRefresh()
 
-		// Test database connection
-		if err := db.Ping(); err != nil {
-			log.Fatalf("Failed to ping database: %v", err)
+	// Initialize the inventory store if enabled
+	store, err := openInventoryStore()
+	if err != nil {
+		log.Fatalf("Failed to open inventory store: %v", err)
+	}
+	if store != nil {
+		inventory = store
+		if inventoryBatchWindow > 0 {
+			// Queue writes and flush them in batches
+			inventory = newBatchedStore(store, inventoryBatchWindow, inventoryBatchSize)
 		}
-		log.Info("Database connection established")
+		defer inventory.Close()
+		log.Infof("Inventory store established (%s)", inventoryBackend)
+
+		loadKnownInventoryBuckets(inventory)
+		startQuotaTracking(inventory)
+
+		// Periodically publish S3 Inventory reports to the mirror
+		startInventoryExporter(inventory)
+		startDeletePurger(inventory)
 	} else {
 		log.Info("Database tracking disabled")
 	}
 
-	// Create main proxy
-	targetURL, err := url.Parse(mainS3Endpoint)
-	if err != nil {
-		log.Fatalf("Failed to parse main S3 endpoint: %v", err)
-	}
+	// Immutable copies must not be written to buckets without Object Lock
+	verifyObjectLockBuckets()
+
+	// Metrics and health checks
+	startAdminServer()
+
+	// Pick up rotated client credentials and edited replication rules
+	watchClientCredentials()
+	watchReplicationRules()
 
 	// Create HTTP handler
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handleProxyRequest(w, r, targetURL)
-	})
+	handler := http.HandlerFunc(handleProxyRequest)
 
-	// Simple HTTP server
+	// Simple HTTP server, with TLS when a certificate is configured
 	server := &http.Server{
 		Addr:    ":8080",
 		Handler: handler,
 	}
+	if server.TLSConfig, err = newServerTLSConfig(); err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+
+	// Stop accepting requests on SIGTERM so queued inventory writes get flushed
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		log.Info("Shutting down S3 proxy server...")
+		ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("Server shutdown failed: %v", err)
+		}
+	}()
 
-	log.Info("Starting S3 proxy server on :8080...")
-	if err := server.ListenAndServe(); err != nil {
+	if server.TLSConfig != nil {
+		log.Infof("Starting S3 proxy server on :8080 with TLS (client certificates: %t)...", tlsClientCAFile != "")
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Info("Starting S3 proxy server on :8080...")
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
 
-func handleProxyRequest(w http.ResponseWriter, req *http.Request, targetURL *url.URL) {
+func handleProxyRequest(w http.ResponseWriter, req *http.Request) {
+	req = withRequestTime(req)
+
 	// Read the request body
 	var bodyBytes []byte
 	if req.Body != nil {
@@ -208,56 +256,78 @@ func handleProxyRequest(w http.ResponseWriter, req *http.Request, targetURL *url
 		req.Body.Close()
 	}
 
-	// Extract bucket and key for logging (supports both path-style and virtual-hosted style)
-	bucket, key := extractBucketAndKey(req.URL.Path, req.Host)
-
-	// Create new request to forward to main S3
-	forwardURL := *targetURL
-
-	// Detect if original request was virtual-hosted style
-	isVirtualHosted := bucket != "" && !strings.HasPrefix(req.URL.Path, "/"+bucket)
+	// Verify the client signature before anything reaches main
+	authenticated, payload, authErr := authenticateRequest(req, bodyBytes)
+	if authErr != nil {
+		log.Warnf("Rejected %s %s: %s", req.Method, req.URL.Path, authErr)
+		writeS3Error(w, req, authErr.Status, authErr.Code, authErr.Message)
+		return
+	}
+	req, bodyBytes = authenticated, payload
 
-	// Preserve the original request style when forwarding to main S3
-	// This keeps the signature calculation straightforward
-	forwardURL.Path = req.URL.Path
-	forwardURL.RawQuery = req.URL.RawQuery
+	// Bucket and key from the Host and path, a host the proxy doesn't serve is refused
+	bucket, key, clientVirtualHosted, hostErr := extractBucketAndKey(req.URL.Path, req.Host)
+	if hostErr != nil {
+		log.Warnf("Rejected %s %s on host %s: %s", req.Method, req.URL.Path, req.Host, hostErr)
+		writeS3Error(w, req, hostErr.Status, hostErr.Code, hostErr.Message)
+		return
+	}
 
-	if isVirtualHosted {
-		// Virtual-hosted style: bucket goes in the hostname
-		// Extract hostname from targetURL (could be "s3.amazonaws.com" or "s3.amazonaws.com:443")
-		targetHost := targetURL.Host
-		if targetHost == "" {
-			targetHost = targetURL.Hostname()
-		}
-		forwardURL.Host = bucket + "." + targetHost
-		log.Debugf("Virtual-hosted: forwarding to %s%s", forwardURL.Host, forwardURL.Path)
-	} else {
-		// Path-style: use target host as-is, bucket is in path
-		forwardURL.Host = targetURL.Host
-		if forwardURL.Host == "" {
-			forwardURL.Host = targetURL.Hostname()
-		}
-		log.Debugf("Path-style: forwarding to %s%s", forwardURL.Host, forwardURL.Path)
+	// Enforce the client's allowed buckets and access policies
+	identity := requestIdentity(req)
+	if authErr := authorizeRequest(req, bucket, key, bodyBytes); authErr != nil {
+		writeS3Error(w, req, authErr.Status, authErr.Code, authErr.Message)
+		return
 	}
 
-	forwardReq, err := http.NewRequest(req.Method, forwardURL.String(), bytes.NewReader(bodyBytes))
-	if err != nil {
-		http.Error(w, "Failed to create forward request", http.StatusInternalServerError)
+	// Buckets no backend holds are unknown, whatever exists upstream
+	backend := mainBackendFor(bucket)
+	if backend == nil {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	// Clients with their own main accounts never fall back to the shared credentials
+	if !(bucket == "" && hasBucketRoutes()) && !identity.usesMainBackend(backend) {
+		log.Warnf("Rejected %s %s/%s for client %s: no credentials for main backend %s", req.Method, bucket, key, identity.Name, backend.Name)
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "Access Denied")
 		return
 	}
 
-	// Copy relevant headers
-	for k, v := range req.Header {
-		if strings.HasPrefix(k, "Content-") || strings.HasPrefix(k, "X-Amz-") {
-			forwardReq.Header[k] = v
-		}
+	// Presigned URLs are validated, from here on they are handled like any
+	// other request and re-signed with upstream credentials
+	req = stripPresignedQuery(req)
+
+	// Answer listings and HEAD from the inventory when it is authoritative
+	if serveFromInventory(w, req, bucket, key) {
+		return
 	}
 
-	// Sign the request with main S3 credentials using the same style as the request
-	signRequestV4WithBucket(forwardReq, mainAccessKey, mainSecretKey, "us-east-1", "s3", bodyBytes, bucket, isVirtualHosted)
+	// Reject writes that would exceed a hard quota before they reach main
+	rule, quotaErr := checkQuota(req, bucket, key, bodyBytes)
+	if quotaErr != nil {
+		writeS3Error(w, req, http.StatusServiceUnavailable, "ServiceUnavailable",
+			"The size of the write could not be determined to check its storage quota, retry the request.")
+		return
+	}
+	if rule != nil {
+		writeS3Error(w, req, http.StatusForbidden, "QuotaExceeded",
+			fmt.Sprintf("The request would exceed the storage quota %s.", rule.ID))
+		return
+	}
 
-	// Forward the request using shared client
-	resp, err := httpClient.Do(forwardReq)
+	var resp *http.Response
+	var err error
+	if bucket == "" && req.Method == "GET" && hasBucketRoutes() {
+		// Every backend holds some of the buckets
+		resp, err = listBackendBuckets(identity, req.URL.Query())
+	} else {
+		resp, err = forwardToMain(backend, req, bucket, bodyBytes, clientVirtualHosted)
+	}
+	if errors.Is(err, errUpstreamCredentials) {
+		log.Error(err)
+		writeS3Error(w, req, http.StatusInternalServerError, "InternalError", "Failed to obtain upstream credentials")
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to forward request to S3", http.StatusBadGateway)
 		log.Errorf("Failed to forward request: %v", err)
@@ -265,6 +335,73 @@ func handleProxyRequest(w http.ResponseWriter, req *http.Request, targetURL *url
 	}
 	defer resp.Body.Close()
 
+	// Read the response body, it is also needed to track DeleteObjects
+	respBody, _ := io.ReadAll(resp.Body)
+	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+
+	// Only list the buckets the client may access
+	if success && bucket == "" && req.Method == "GET" && identity != nil && len(identity.Buckets) > 0 {
+		if filtered, err := filterBucketList(identity, respBody); err != nil {
+			log.Errorf("Failed to filter bucket list for client %s: %v", identity.Name, err)
+		} else {
+			respBody = filtered
+			resp.Header.Set("Content-Length", strconv.Itoa(len(respBody)))
+		}
+	}
+
+	// Browser uploads are recorded and mirrored as the PutObject they amount to
+	writeKey, writeReq, writeBody := key, req, bodyBytes
+	if success && key == "" && req.Method == "POST" && isPostObjectUpload(req) {
+		if formKey, putReq, file, err := postObjectAsPut(req, bodyBytes, clientVirtualHosted); err != nil {
+			log.Errorf("Failed to read the upload form of bucket %s: %v", bucket, err)
+			markInventoryIncomplete(bucket, err.Error())
+		} else {
+			writeKey, writeReq, writeBody = formKey, putReq, file
+		}
+	}
+
+	// Writes to authoritative buckets are recorded before answering so that
+	// reads served from the inventory always see them
+	recorded, mirrored := false, false
+	if success && isInventoryAuthoritative(bucket) {
+		recordInventoryChange(bucket, writeKey, writeReq, writeBody, resp, respBody, clientVirtualHosted)
+		if err := flushInventory(); err != nil {
+			log.Errorf("Failed to flush inventory for %s/%s: %v", bucket, writeKey, err)
+		}
+		recorded = true
+	}
+
+	// Writes matching a sync replication rule are mirrored before answering,
+	// a write prepared here is reused by the background mirroring
+	var prepared *mirrorWrite
+	if success && writeKey != "" && (writeReq.Method == "PUT" || writeReq.Method == "POST") &&
+		identity.mirrorsWrites() && hasSyncReplicationRule(bucket) {
+		prepared, err = prepareMirrorWrite(bucket, writeKey, writeReq, writeBody, clientVirtualHosted)
+		switch {
+		case err != nil:
+			// Retried in the background
+			log.Errorf("Failed to prepare mirroring of %s/%s: %v", bucket, writeKey, err)
+		case prepared == nil:
+			// Nothing to mirror
+			mirrored = true
+		case prepared.rule.sync():
+			if !recorded {
+				recordInventoryChange(bucket, writeKey, writeReq, writeBody, resp, respBody, clientVirtualHosted)
+				recorded = true
+			}
+			if err := prepared.run(identity, clientVirtualHosted); err != nil {
+				message := "The object was stored but could not be mirrored, retry the request."
+				if errors.Is(err, errFilesystemKeyConflict) {
+					// Retrying fails the same way
+					message = "The object was stored but could not be mirrored: " + err.Error() + "."
+				}
+				writeS3Error(w, req, http.StatusInternalServerError, "InternalError", message)
+				return
+			}
+			mirrored = true
+		}
+	}
+
 	// Copy response headers
 	for k, v := range resp.Header {
 		w.Header()[k] = v
@@ -274,23 +411,34 @@ func handleProxyRequest(w http.ResponseWriter, req *http.Request, targetURL *url
 	w.WriteHeader(resp.StatusCode)
 
 	// Copy response body
-	respBody, _ := io.ReadAll(resp.Body)
 	w.Write(respBody)
 
 	// Handle background operations for successful requests
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 && bucket != "" && key != "" {
+	if success && bucket != "" {
 		// Only log successful operations at debug level to reduce log volume
 		log.Debugf("S3 operation: %s %s/%s - Status: %d", req.Method, bucket, key, resp.StatusCode)
 
-		// Capture isVirtualHosted for the goroutine
-		isVirtual := isVirtualHosted
+		// Capture clientVirtualHosted for the goroutine
+		isVirtual := clientVirtualHosted
 
 		go func() {
-			switch req.Method {
-			case "PUT", "POST":
-				handlePutRequest(bucket, key, req, bodyBytes, resp, isVirtual)
-			case "DELETE":
+			if !recorded {
+				recordInventoryChange(bucket, writeKey, writeReq, writeBody, resp, respBody, isVirtual)
+			}
+
+			if !identity.mirrorsWrites() || mirrored {
+				return
+			}
+
+			switch {
+			case prepared != nil:
+				prepared.run(identity, isVirtual)
+			case writeKey != "" && (writeReq.Method == "PUT" || writeReq.Method == "POST"):
+				handlePutRequest(bucket, writeKey, writeReq, writeBody, isVirtual)
+			case key != "" && req.Method == "DELETE":
 				handleDeleteRequest(bucket, key, req, isVirtual)
+			case key == "" && req.Method == "POST" && req.URL.Query().Has("delete"):
+				handleDeleteObjectsRequest(bucket, req, bodyBytes, respBody, isVirtual)
 			}
 		}()
 	} else if resp.StatusCode >= 400 {
@@ -299,174 +447,378 @@ func handleProxyRequest(w http.ResponseWriter, req *http.Request, targetURL *url
 	}
 }
 
-func handlePutRequest(bucket, key string, req *http.Request, body []byte, resp *http.Response, isVirtualHosted bool) {
-	// Skip database operations if disabled
-	if disableDatabase {
-		// Just mirror to backup S3
-		if err := mirrorToBackupS3(bucket, key, req.Method, body, req.Header, isVirtualHosted); err != nil {
-			log.Errorf("Failed to mirror to backup S3: %v", err)
+// forwardToMain sends a client request to the main backend holding its
+// bucket, in the style of the backend and signed with the client's main
+// credentials
+func forwardToMain(backend *mainBackend, req *http.Request, bucket string, body []byte, clientVirtualHosted bool) (*http.Response, error) {
+	isVirtualHosted := backend.virtualHosted(bucket, clientVirtualHosted)
+	forwardURL := backend.requestURL(bucket, bucketObjectPath(req.URL.Path, bucket, clientVirtualHosted), isVirtualHosted)
+	forwardURL.RawQuery = req.URL.RawQuery
+	log.Debugf("Forwarding to %s: %s%s", backend.Name, forwardURL.Host, forwardURL.Path)
+
+	forwardReq, err := http.NewRequest(req.Method, forwardURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy relevant headers, CORS headers let main answer browsers
+	for k, v := range req.Header {
+		if strings.HasPrefix(k, "Content-") || strings.HasPrefix(k, "X-Amz-") ||
+			k == "Origin" || strings.HasPrefix(k, "Access-Control-Request-") {
+			forwardReq.Header[k] = v
 		}
-		return
 	}
 
-	// Get or create database connection for bucket
-	bucketDB := getOrCreateBucketDB(bucket)
-	if bucketDB == nil {
-		log.Errorf("Failed to get database for bucket %s", bucket)
+	mainCreds, err := requestIdentity(req).mainCredentials(backend)
+	if err != nil {
+		return nil, fmt.Errorf("%w of %s: %v", errUpstreamCredentials, backend.Name, err)
+	}
+
+	// Forward the request using shared client, signed for the bucket's region
+	return backend.send(forwardReq, mainCreds, body, bucket, isVirtualHosted)
+}
+
+// recordInventoryChange logs a successful write or delete to the inventory,
+// a failure marks the bucket's inventory as incomplete
+func recordInventoryChange(bucket, key string, req *http.Request, body []byte, resp *http.Response, respBody []byte, clientVirtualHosted bool) {
+	// Skip database operations if disabled
+	if inventory == nil || bucket == "" {
 		return
 	}
 
-	// Extract file info
-	size := len(body)
-	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
-		if cl, err := strconv.Atoi(contentLength); err == nil {
-			size = cl
+	var err error
+	switch {
+	case key != "" && (req.Method == "PUT" || req.Method == "POST"):
+		err = recordPutRequest(bucket, key, req, body, resp, clientVirtualHosted)
+	case key != "" && req.Method == "DELETE":
+		err = recordDeleteRequest(bucket, []string{key})
+	case key == "" && req.Method == "POST" && req.URL.Query().Has("delete"):
+		var keys []string
+		if keys, err = deletedObjectKeys(body, respBody); err == nil {
+			err = recordDeleteRequest(bucket, keys)
 		}
+	default:
+		return
 	}
 
-	contentType := resp.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	if err != nil {
+		log.Errorf("Failed to record %s %s/%s in inventory: %v", req.Method, bucket, key, err)
+		markInventoryIncomplete(bucket, err.Error())
+	}
+}
+
+func recordPutRequest(bucket, key string, req *http.Request, body []byte, resp *http.Response, clientVirtualHosted bool) error {
+	kind := objectWriteKind(req)
+	if kind == writeNone {
+		return nil
 	}
 
-	// Get table name for this bucket
-	tableName := sanitizeDBName(bucket)
+	// Get or create the bucket's storage
+	if err := inventory.EnsureBucket(bucket); err != nil {
+		return err
+	}
+	inventoryKnownBuckets.Store(bucket, true)
 
-	// Log to database
-	_, err := bucketDB.Exec(fmt.Sprintf(`
-		INSERT INTO %s (path, size, content_type, is_backed_up, last_modified, deleted)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (path)
-		DO UPDATE SET
-			size = $2,
-			content_type = $3,
-			is_backed_up = $4,
-			last_modified = $5,
-			deleted = $6
-	`, tableName), key, size, contentType, false, time.Now(), false)
+	// Usage counters need the record being replaced
+	var previous *ObjectRecord
+	if quotaApplies(bucket, key) {
+		var err error
+		if previous, err = inventory.GetObject(bucket, key); err != nil {
+			return err
+		}
+	}
 
-	if err != nil {
-		log.Errorf("Failed to insert file record: %v", err)
-		return
+	rec := ObjectRecord{
+		Key:          key,
+		IsBackedUp:   false,
+		LastModified: inventoryTime(),
+		Deleted:      false,
 	}
 
-	// Mirror to backup S3
-	if err := mirrorToBackupS3(bucket, key, req.Method, body, req.Header, isVirtualHosted); err != nil {
-		log.Errorf("Failed to mirror to backup S3: %v", err)
+	if kind == writePut {
+		// Extract file info from the request, main only returns the ETag
+		headers := req.Header.Clone()
+		for _, k := range []string{"X-Amz-Version-Id", "X-Amz-Server-Side-Encryption"} {
+			if v := resp.Header.Get(k); v != "" {
+				headers.Set(k, v)
+			}
+		}
+		rec.Size = putObjectSize(req, body)
+		rec.ContentType = req.Header.Get("Content-Type")
+		rec.ETag = resp.Header.Get("ETag")
+		rec.Metadata = inventoryMetadata(headers)
 	} else {
-		// Mark as backed up
-		_, err = bucketDB.Exec(fmt.Sprintf(`
-			UPDATE %s SET is_backed_up = true WHERE path = $1
-		`, tableName), key)
+		// Copies and multipart uploads are assembled by main, ask it for the result
+		creds, err := requestIdentity(req).mainCredentials(mainBackendFor(bucket))
+		if err != nil {
+			return err
+		}
+		head, err := headMainObject(bucket, key, req.Header, creds, clientVirtualHosted)
 		if err != nil {
-			log.Errorf("Failed to update backup status: %v", err)
+			return err
 		}
+		rec.Size = head.ContentLength
+		rec.ContentType = head.Header.Get("Content-Type")
+		rec.ETag = head.Header.Get("ETag")
+		rec.Metadata = inventoryMetadata(head.Header)
 	}
-}
 
-func handleDeleteRequest(bucket, key string, req *http.Request, isVirtualHosted bool) {
-	// Skip database operations if disabled
-	if disableDatabase {
-		// Just mirror delete to backup S3
-		if err := mirrorToBackupS3(bucket, key, "DELETE", nil, req.Header, isVirtualHosted); err != nil {
-			log.Errorf("Failed to mirror delete to backup S3: %v", err)
+	// Every target the object is mirrored to is pending until it reports
+	rule := matchReplicationRule(bucket, key, writtenObjectAttributes(req, rec.Size, rec.ContentType))
+	rec.MirrorRule = rule.id()
+	if mirrorKey, err := rule.mirrorKey(bucket, key, requestTime(req)); err == nil && mirrorKey != key {
+		rec.MirrorKey = mirrorKey
+	}
+	if requestIdentity(req).mirrorsWrites() {
+		rec.MirrorStatus = make(map[string]string)
+		for _, target := range rule.targets(bucket) {
+			rec.MirrorStatus[target.Name] = mirrorStatusPending
 		}
-		return
 	}
 
-	// Get database connection for bucket
-	bucketDB := getOrCreateBucketDB(bucket)
-	if bucketDB == nil {
-		log.Errorf("Failed to get database for bucket %s", bucket)
-		return
+	if rec.ContentType == "" {
+		rec.ContentType = "application/octet-stream"
 	}
 
-	// Get table name for this bucket
-	tableName := sanitizeDBName(bucket)
-
-	// Mark as deleted in database
-	_, err := bucketDB.Exec(fmt.Sprintf(`
-		UPDATE %s SET deleted = true, last_modified = $1 WHERE path = $2
-	`, tableName), time.Now(), key)
+	// Log to inventory
+	if err := inventory.UpsertObject(bucket, rec); err != nil {
+		return fmt.Errorf("failed to insert file record: %w", err)
+	}
+	recordQuotaUsage(bucket, key, previous, &rec)
+	return nil
+}
 
-	if err != nil {
-		log.Errorf("Failed to mark file as deleted: %v", err)
-		return
+func recordDeleteRequest(bucket string, keys []string) error {
+	// Get or create the bucket's storage
+	if err := inventory.EnsureBucket(bucket); err != nil {
+		return err
 	}
+	inventoryKnownBuckets.Store(bucket, true)
+
+	// Mark as deleted in inventory
+	now := inventoryTime()
+	for _, key := range keys {
+		var previous *ObjectRecord
+		if quotaApplies(bucket, key) {
+			var err error
+			if previous, err = inventory.GetObject(bucket, key); err != nil {
+				return err
+			}
+		}
 
-	// Mirror delete to backup S3
-	if err := mirrorToBackupS3(bucket, key, "DELETE", nil, req.Header, isVirtualHosted); err != nil {
-		log.Errorf("Failed to mirror delete to backup S3: %v", err)
+		if err := inventory.MarkDeleted(bucket, key, now); err != nil {
+			return fmt.Errorf("failed to mark file as deleted: %w", err)
+		}
+		recordQuotaUsage(bucket, key, previous, nil)
 	}
+	return nil
+}
+
+// mirrorWrite is an object write to mirror with the rule it matched
+type mirrorWrite struct {
+	bucket    string
+	key       string
+	mirrorKey string
+	body      []byte
+	headers   http.Header
+	rule      *replicationRule
+	targets   []*mirrorTarget
 }
 
-func mirrorToBackupS3(bucket, key, method string, body []byte, headers http.Header, isVirtualHosted bool) error {
-	// Apply bucket prefix if configured
-	mirrorBucket := bucket
-	if mirrorBucketPrefix != "" {
-		mirrorBucket = mirrorBucketPrefix + bucket
-		log.Debugf("Mirroring to prefixed bucket: %s (original: %s)", mirrorBucket, bucket)
+// prepareMirrorWrite returns the object written by a request and the targets
+// receiving it, nil when nothing is mirrored
+func prepareMirrorWrite(bucket, key string, req *http.Request, body []byte, clientVirtualHosted bool) (*mirrorWrite, error) {
+	// Subresources and multipart parts are not mirrored, completed uploads are
+	kind := objectWriteKind(req)
+	if kind == writeNone {
+		return nil, nil
 	}
 
-	// Construct mirror URL
-	mirrorURL, err := url.Parse(mirrorS3Endpoint)
+	headers := req.Header.Clone()
+	attrs := writtenObjectAttributes(req, putObjectSize(req, body), req.Header.Get("Content-Type"))
+	if kind != writePut {
+		// Copies and multipart uploads are assembled by main, mirror the result
+		mainCreds, err := requestIdentity(req).mainCredentials(mainBackendFor(bucket))
+		if err != nil {
+			return nil, err
+		}
+		object, objectBody, err := getMainObject(bucket, key, req.Header, mainCreds, clientVirtualHosted)
+		if err != nil {
+			return nil, err
+		}
+		body = objectBody
+		headers = mainObjectHeaders(object.Header, req.Header)
+		attrs = writtenObjectAttributes(req, int64(len(body)), object.Header.Get("Content-Type"))
+	}
+
+	rule := matchReplicationRule(bucket, key, attrs)
+	targets := rule.targets(bucket)
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	mirrorKey, err := rule.mirrorKey(bucket, key, requestTime(req))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	rule.applyStorageClass(headers)
 
-	// Use the same request style (path-style or virtual-hosted) as the original request
-	if isVirtualHosted {
-		// Virtual-hosted style: bucket is in hostname, key is in path
-		if key != "" {
-			mirrorURL.Path = "/" + key
-		} else {
-			mirrorURL.Path = "/"
+	return &mirrorWrite{bucket: bucket, key: key, mirrorKey: mirrorKey, body: body, headers: headers, rule: rule, targets: targets}, nil
+}
+
+// run writes the object to every target and waits for all of them. Targets
+// are written independently, a slow one does not delay the others.
+func (m *mirrorWrite) run(identity *clientCredential, clientVirtualHosted bool) error {
+	errs := make([]error, len(m.targets))
+	var wg sync.WaitGroup
+	for i, target := range m.targets {
+		wg.Add(1)
+		go func(i int, target *mirrorTarget) {
+			defer wg.Done()
+			creds, err := identity.mirrorCredentials(target)
+			if err == nil {
+				err = mirrorToBackupS3(target, m.bucket, m.rule.mirrorBucket(target, m.bucket, m.key), m.mirrorKey, "PUT", m.body, m.headers, creds, clientVirtualHosted)
+			}
+			// Fallbacks taken by the write are remembered by the target
+			storageClass := target.copyStorageClass(m.headers.Get(storageClassHeader))
+			recordMirrorCopy(target, m.bucket, m.key, storageClass, err)
+			errs[i] = err
+		}(i, target)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
-		// Set Host to include bucket
-		mirrorHost := mirrorURL.Host
-		if mirrorHost == "" {
-			mirrorHost = mirrorURL.Hostname()
+	}
+	return nil
+}
+
+func handlePutRequest(bucket, key string, req *http.Request, body []byte, clientVirtualHosted bool) {
+	write, err := prepareMirrorWrite(bucket, key, req, body, clientVirtualHosted)
+	if err != nil {
+		log.Errorf("Failed to mirror %s/%s to backup S3: %v", bucket, key, err)
+		// Objects too large to be mirrored are failed on every target
+		var tooLarge *assembledObjectTooLargeError
+		if errors.As(err, &tooLarge) {
+			rule := matchReplicationRule(bucket, key, writtenObjectAttributes(req, tooLarge.size, tooLarge.contentType))
+			for _, target := range rule.targets(bucket) {
+				recordMirrorCopy(target, bucket, key, "", err)
+			}
 		}
-		mirrorURL.Host = mirrorBucket + "." + mirrorHost
-		log.Debugf("Using virtual-hosted style for mirror: %s%s", mirrorURL.Host, mirrorURL.Path)
-	} else {
-		// Path-style: both bucket and key in path
-		mirrorURL.Path = fmt.Sprintf("/%s/%s", mirrorBucket, key)
-		log.Debugf("Using path-style for mirror: %s%s", mirrorURL.Host, mirrorURL.Path)
+		return
 	}
+	if write != nil {
+		write.run(requestIdentity(req), clientVirtualHosted)
+	}
+}
 
-	// Create new request for mirror
-	req, err := http.NewRequest(method, mirrorURL.String(), bytes.NewReader(body))
+func handleDeleteRequest(bucket, key string, req *http.Request, clientVirtualHosted bool) {
+	identity := requestIdentity(req)
+	rule, mirrorKey, err := mirroredObject(bucket, key)
 	if err != nil {
-		return err
+		// Deleting a guessed key would leave the real copy behind
+		log.Warnf("Skipped mirroring the delete of %s/%s: %v", bucket, key, err)
+		return
+	}
+	targets := rule.targets(bucket)
+	if len(targets) == 0 {
+		return
 	}
 
-	// Copy relevant headers
-	for k, v := range headers {
-		if strings.HasPrefix(k, "Content-") || strings.HasPrefix(k, "X-Amz-") {
-			req.Header[k] = v
-		}
+	// The delete policy may keep the copies for a while, or forever
+	policy := matchDeletePolicy(bucket)
+	tombstone := policy.tombstone(mirrorKey, requestTime(req))
+	recordTombstone(bucket, key, tombstone)
+	if !policy.deletesNow() {
+		return
 	}
 
-	// Sign request with mirror credentials using the same style as the original request
-	signRequestV4WithBucket(req, mirrorAccessKey, mirrorSecretKey, "us-east-1", "s3", body, mirrorBucket, isVirtualHosted)
+	for _, target := range targets {
+		go func(target *mirrorTarget) {
+			creds, err := identity.mirrorCredentials(target)
+			if err == nil {
+				err = policy.deleteMirrorCopy(target, bucket, rule.mirrorBucket(target, bucket, key), mirrorKey, tombstone, req.Header, creds, clientVirtualHosted)
+			}
+			recordMirrorStatus(target, bucket, key, policy.operation(), err)
+		}(target)
+	}
+}
 
-	// Send request using shared client
-	resp, err := httpClient.Do(req)
+func handleDeleteObjectsRequest(bucket string, req *http.Request, body, respBody []byte, clientVirtualHosted bool) {
+	keys, err := deletedObjectKeys(body, respBody)
 	if err != nil {
-		return err
+		log.Errorf("Failed to parse DeleteObjects for bucket %s: %v", bucket, err)
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 300 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("mirror request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	// Keys may match different rules, group the deletes per target
+	type mirrorDelete struct {
+		key          string
+		mirrorBucket string
+		mirrorKey    string
+		tombstone    *Tombstone
+	}
+	policy := matchDeletePolicy(bucket)
+	deletes := make(map[*mirrorTarget][]mirrorDelete)
+	for _, key := range keys {
+		rule, mirrorKey, err := mirroredObject(bucket, key)
+		if err != nil {
+			log.Warnf("Skipped mirroring the delete of %s/%s: %v", bucket, key, err)
+			continue
+		}
+		targets := rule.targets(bucket)
+		if len(targets) == 0 {
+			continue
+		}
+		tombstone := policy.tombstone(mirrorKey, requestTime(req))
+		recordTombstone(bucket, key, tombstone)
+		if !policy.deletesNow() {
+			continue
+		}
+		for _, target := range targets {
+			deletes[target] = append(deletes[target], mirrorDelete{key, rule.mirrorBucket(target, bucket, key), mirrorKey, tombstone})
+		}
 	}
 
-	return nil
+	// Mirror each delete individually, the request headers describe the XML body
+	identity := requestIdentity(req)
+	for target, targetDeletes := range deletes {
+		go func(target *mirrorTarget, targetDeletes []mirrorDelete) {
+			creds, credsErr := identity.mirrorCredentials(target)
+			for _, d := range targetDeletes {
+				err := credsErr
+				if err == nil {
+					err = policy.deleteMirrorCopy(target, bucket, d.mirrorBucket, d.mirrorKey, d.tombstone, nil, creds, clientVirtualHosted)
+				}
+				recordMirrorStatus(target, bucket, d.key, policy.operation(), err)
+			}
+		}(target, targetDeletes)
+	}
+}
+
+// mirrorToBackupS3 sends a write or delete of an object of bucket (as seen by
+// clients) to mirrorBucket and the mirror key on a target
+func mirrorToBackupS3(target *mirrorTarget, bucket, mirrorBucket, key, method string, body []byte, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) error {
+	if mirrorBucket != bucket {
+		log.Debugf("Mirroring to bucket %s of %s (original: %s)", mirrorBucket, target.Name, bucket)
+	}
+
+	if method == "DELETE" {
+		return target.store.deleteObject(mirrorBucket, key, headers, creds, clientVirtualHosted)
+	}
+
+	// Keep the mirror provider from reading the copies
+	if mirrorKeyring != nil {
+		var err error
+		if body, headers, err = encryptMirrorObject(body, headers); err != nil {
+			return fmt.Errorf("failed to encrypt mirror copy: %w", err)
+		}
+	}
+	return target.store.putObject(bucket, mirrorBucket, key, body, headers, creds, clientVirtualHosted)
 }
 
-func signRequestV4WithBucket(req *http.Request, accessKey, secretKey, region, service string, payload []byte, bucket string, isVirtualHosted bool) {
+func signRequestV4WithBucket(req *http.Request, creds upstreamCredentials, region, service string, payload []byte, bucket string, isVirtualHosted bool) {
 	// AWS Signature Version 4 signing
 	now := time.Now().UTC()
 	dateStamp := now.Format("20060102")
@@ -474,6 +826,14 @@ func signRequestV4WithBucket(req *http.Request, accessKey, secretKey, region, se
 
 	req.Header.Set("X-Amz-Date", amzDate)
 
+	// Temporary credentials sign their session token, a token sent by the
+	// client belongs to its own credentials and is never forwarded
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	} else {
+		req.Header.Del("X-Amz-Security-Token")
+	}
+
 	// Calculate payload hash
 	payloadHash := sha256.Sum256(payload)
 	payloadHashStr := hex.EncodeToString(payloadHash[:])
@@ -489,8 +849,9 @@ func signRequestV4WithBucket(req *http.Request, accessKey, secretKey, region, se
 	canonicalHeaders := createCanonicalHeaders(req)
 	signedHeaders := createSignedHeaders(req)
 
-	// Normalize the path for signature (empty path should be "/")
-	canonicalURI := req.URL.Path
+	// Normalize the path for signature (empty path should be "/"), S3 expects
+	// every character but unreserved ones percent-encoded
+	canonicalURI := awsURIEncode(req.URL.Path, false)
 	if canonicalURI == "" {
 		canonicalURI = "/"
 	}
@@ -521,13 +882,13 @@ func signRequestV4WithBucket(req *http.Request, accessKey, secretKey, region, se
 	)
 
 	// Calculate signature
-	signingKey := getSigningKey(secretKey, dateStamp, region, service)
+	signingKey := getSigningKey(creds.SecretKey, dateStamp, region, service)
 	signature := hmacSHA256(signingKey, []byte(stringToSign))
 
 	// Add authorization header
 	authorizationHeader := fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
 		algorithm,
-		accessKey,
+		creds.AccessKey,
 		credentialScope,
 		signedHeaders,
 		hex.EncodeToString(signature),
@@ -601,10 +962,10 @@ func createCanonicalQueryString(req *http.Request) string {
 		paramValues := values[k]
 		sort.Strings(paramValues)
 
-		// AWS SigV4 requires proper URL encoding
-		encodedKey := url.QueryEscape(k)
+		// AWS SigV4 requires proper URL encoding (%20 rather than +)
+		encodedKey := awsURIEncode(k, true)
 		for _, v := range paramValues {
-			encodedValue := url.QueryEscape(v)
+			encodedValue := awsURIEncode(v, true)
 			if v == "" {
 				parts = append(parts, encodedKey+"=")
 			} else {
@@ -630,132 +991,30 @@ func hmacSHA256(key, data []byte) []byte {
 	return h.Sum(nil)
 }
 
-func extractBucketAndKey(urlPath, hostHeader string) (string, string) {
-	// Remove port from host if present
-	host := hostHeader
-	if colonIndex := strings.Index(host, ":"); colonIndex > 0 {
-		host = host[:colonIndex]
-	}
-
-	// Check if this is virtual-hosted style
-	// Virtual-hosted: bucket.domain/key (e.g., my-bucket.s3.local/file.txt)
-	// Path-style: domain/bucket/key (e.g., s3.local/my-bucket/file.txt)
-
-	if proxyDomain != "" && strings.HasSuffix(host, proxyDomain) {
-		// We have a configured proxy domain
-		// Check if host is exactly the proxy domain (path-style) or a subdomain (virtual-hosted)
-		if host == proxyDomain {
-			// Exact match: path-style (e.g., s3.local/bucket/key)
-			urlPath = strings.TrimPrefix(urlPath, "/")
-			parts := strings.SplitN(urlPath, "/", 2)
-			if len(parts) < 1 || parts[0] == "" {
-				return "", ""
-			}
-			if len(parts) == 1 {
-				return parts[0], ""
-			}
-			return parts[0], parts[1]
-		} else {
-			// Subdomain: virtual-hosted (e.g., bucket.s3.local/key)
-			bucket := strings.TrimSuffix(host, "."+proxyDomain)
-			key := strings.TrimPrefix(urlPath, "/")
-			return bucket, key
-		}
-	}
-
-	// No proxy domain configured, try to detect based on host structure
-	hostParts := strings.Split(host, ".")
-	if len(hostParts) >= 2 {
-		// Has subdomain, assume virtual-hosted
-		bucket := hostParts[0]
-		key := strings.TrimPrefix(urlPath, "/")
-		if bucket != "" && key != "" {
-			return bucket, key
-		}
-		if bucket != "" && urlPath == "/" {
-			return bucket, ""
-		}
-	}
-
-	// Fall back to path-style parsing
-	urlPath = strings.TrimPrefix(urlPath, "/")
-	parts := strings.SplitN(urlPath, "/", 2)
-	if len(parts) < 1 || parts[0] == "" {
-		return "", ""
-	}
-	if len(parts) == 1 {
-		return parts[0], ""
-	}
-	return parts[0], parts[1]
+func getEnv(key string) string {
+	return os.Getenv(key)
 }
 
-func getOrCreateBucketDB(bucket string) *sql.DB {
-	if disableDatabase {
-		return nil
-	}
-
-	// We use the main database connection for all buckets
-	// Each bucket gets its own table
-	tableName := sanitizeDBName(bucket)
-
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	// Check if we already verified this bucket's table
-	if _, exists := dbConnections[bucket]; exists {
-		return db
-	}
-
-	// Create table for this bucket if it doesn't exist
-	createTableSQL := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id SERIAL PRIMARY KEY,
-			path TEXT UNIQUE NOT NULL,
-			size BIGINT NOT NULL,
-			content_type TEXT NOT NULL,
-			is_backed_up BOOLEAN DEFAULT FALSE,
-			last_modified TIMESTAMP NOT NULL,
-			deleted BOOLEAN DEFAULT FALSE,
-			created_at TIMESTAMP DEFAULT NOW(),
-			updated_at TIMESTAMP DEFAULT NOW()
-		)
-	`, tableName)
-
-	_, err := db.Exec(createTableSQL)
+// loadConfigFile decodes a JSON configuration file into v, files named
+// .yaml or .yml are converted to JSON first so the same field names apply
+func loadConfigFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Errorf("Failed to create table %s: %v", tableName, err)
-		return nil
-	}
-
-	// Create indexes for performance
-	indexCommands := []string{
-		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_path ON %s(path)", tableName, tableName),
-		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_backup ON %s(is_backed_up)", tableName, tableName),
-		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_deleted ON %s(deleted)", tableName, tableName),
+		return err
 	}
-
-	for _, cmd := range indexCommands {
-		if _, err := db.Exec(cmd); err != nil {
-			log.Warnf("Failed to create index: %v", err)
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return fmt.Errorf("invalid %s: %w", path, err)
+		}
+		if data, err = json.Marshal(document); err != nil {
+			return fmt.Errorf("invalid %s: %w", path, err)
 		}
 	}
-
-	// Mark that we've initialized this bucket's table
-	dbConnections[bucket] = db
-
-	log.Debugf("Created/verified table %s for bucket %s", tableName, bucket)
-	return db
-}
-
-func sanitizeDBName(name string) string {
-	// Replace non-alphanumeric characters with underscores and prefix with bucket_
-	reg := regexp.MustCompile(`[^a-zA-Z0-9]+`)
-	sanitized := reg.ReplaceAllString(name, "_")
-	return "bucket_" + sanitized
-}
-
-func getEnv(key string) string {
-	return os.Getenv(key)
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return nil
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -763,4 +1022,4 @@ func getEnvOrDefault(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mainBackend is an S3 endpoint holding some of the buckets clients see
+// through the proxy
+type mainBackend struct {
+	Name            string            `json:"name"`
+	Endpoint        string            `json:"endpoint"`
+	Buckets         []string          `json:"buckets"`         // Bucket names or glob patterns routed to the backend, empty for the default backend
+	Region          string            `json:"region"`          // Defaults to the region of the endpoint or us-east-1
+	BucketRegions   map[string]string `json:"bucketRegions"`   // Region per bucket name
+	CredentialsEnv  string            `json:"credentialsEnv"`  // Prefix of the credential variables, MAIN_<NAME> by default
+	AddressingStyle string            `json:"addressingStyle"` // path, virtual or auto, the style of the client by default
+
+	endpointURL *url.URL
+	credentials *credentialProvider
+	regions     *upstreamRegions
+}
+
+type mainBackendsConfig struct {
+	Backends []*mainBackend `json:"backends"`
+}
+
+var (
+	// Every main backend, the first one is the primary backend receiving the
+	// main credentials of clients
+	mainBackends []*mainBackend
+
+	errUpstreamCredentials = errors.New("failed to obtain the credentials")
+)
+
+// loadMainBackends reads MAIN_BACKENDS_CONFIG, without it the single "main"
+// backend is configured by MAIN_S3_ENDPOINT and the other MAIN_ variables
+func loadMainBackends() {
+	configPath := getEnv("MAIN_BACKENDS_CONFIG")
+	if configPath == "" {
+		backend := &mainBackend{
+			Name:            "main",
+			Endpoint:        getEnvOrDefault("MAIN_S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:          getEnv("MAIN_REGION"),
+			BucketRegions:   parseBucketRegions("MAIN_BUCKET_REGIONS"),
+			CredentialsEnv:  "MAIN",
+			AddressingStyle: getEnv("MAIN_ADDRESSING_STYLE"),
+		}
+		if err := backend.init(); err != nil {
+			log.Fatal(err)
+		}
+		mainBackends = []*mainBackend{backend}
+		return
+	}
+
+	var config mainBackendsConfig
+	if err := loadConfigFile(configPath, &config); err != nil {
+		log.Fatalf("Failed to load MAIN_BACKENDS_CONFIG: %v", err)
+	}
+	if len(config.Backends) == 0 {
+		log.Fatal("MAIN_BACKENDS_CONFIG has no backends")
+	}
+
+	names := make(map[string]bool)
+	var fallback *mainBackend
+	for _, backend := range config.Backends {
+		if names[backend.Name] {
+			log.Fatalf("Duplicate main backend %q", backend.Name)
+		}
+		names[backend.Name] = true
+		if len(backend.Buckets) == 0 {
+			if fallback != nil {
+				log.Fatalf("Main backends %s and %s both have no buckets, only one can be the default backend", fallback.Name, backend.Name)
+			}
+			fallback = backend
+		}
+		if err := backend.init(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	mainBackends = config.Backends
+	log.Infof("Routing buckets to %d main backends", len(mainBackends))
+}
+
+// init validates a backend and sets up its credentials and regions
+func (b *mainBackend) init() error {
+	if !mirrorTargetName.MatchString(b.Name) {
+		return fmt.Errorf("invalid main backend name %q", b.Name)
+	}
+	endpointURL, err := url.Parse(b.Endpoint)
+	if err != nil || b.Endpoint == "" {
+		return fmt.Errorf("main backend %s has an invalid endpoint %q", b.Name, b.Endpoint)
+	}
+	b.endpointURL = endpointURL
+	for _, pattern := range b.Buckets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("main backend %s has an invalid bucket pattern %q: %w", b.Name, pattern, err)
+		}
+	}
+	if !validAddressingStyle(b.AddressingStyle) {
+		return fmt.Errorf("main backend %s has an invalid addressing style %q, expected path, virtual or auto", b.Name, b.AddressingStyle)
+	}
+
+	if b.CredentialsEnv == "" {
+		b.CredentialsEnv = "MAIN_" + strings.ToUpper(strings.NewReplacer("-", "_").Replace(b.Name))
+	}
+	credentials, err := newCredentialProvider(b.CredentialsEnv, b.Name)
+	if err != nil {
+		return err
+	}
+	b.credentials = credentials
+	b.regions = newUpstreamRegions(b.Name, b.Endpoint, b.Region, b.BucketRegions)
+	return nil
+}
+
+// routes tells if a bucket is routed to the backend by one of its patterns
+func (b *mainBackend) routes(bucket string) bool {
+	for _, pattern := range b.Buckets {
+		if ok, _ := path.Match(pattern, bucket); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mainBackendFor returns the backend holding a bucket: the first one routing
+// it, then the default backend. Nil means no backend holds the bucket.
+// Requests without a bucket go to the default backend, or the primary one.
+func mainBackendFor(bucket string) *mainBackend {
+	var fallback *mainBackend
+	for _, backend := range mainBackends {
+		if len(backend.Buckets) == 0 {
+			fallback = backend
+			continue
+		}
+		if bucket != "" && backend.routes(bucket) {
+			return backend
+		}
+	}
+	if fallback == nil && bucket == "" {
+		return mainBackends[0]
+	}
+	return fallback
+}
+
+// findMainBackend returns a backend by name, nil when there is none
+func findMainBackend(name string) *mainBackend {
+	for _, backend := range mainBackends {
+		if backend.Name == name {
+			return backend
+		}
+	}
+	return nil
+}
+
+// virtualHosted tells if requests to the backend for a bucket put it in the
+// hostname, given the style of the client request
+func (b *mainBackend) virtualHosted(bucket string, clientVirtualHosted bool) bool {
+	return upstreamVirtualHosted(b.AddressingStyle, b.endpointURL, bucket, clientVirtualHosted)
+}
+
+// requestURL returns the URL of a request for a bucket, objectPath is the
+// path below the bucket ("/" or "/key")
+func (b *mainBackend) requestURL(bucket, objectPath string, isVirtualHosted bool) *url.URL {
+	requestURL := *b.endpointURL
+	if requestURL.Host == "" {
+		requestURL.Host = b.endpointURL.Hostname()
+	}
+	switch {
+	case bucket == "":
+		requestURL.Path = "/"
+	case isVirtualHosted:
+		requestURL.Host = bucket + "." + requestURL.Host
+		requestURL.Path = objectPath
+	case objectPath == "/":
+		requestURL.Path = "/" + bucket
+	default:
+		requestURL.Path = "/" + bucket + objectPath
+	}
+	return &requestURL
+}
+
+// bucketObjectPath returns the path of a client request below its bucket
+func bucketObjectPath(requestPath, bucket string, isVirtualHosted bool) string {
+	if !isVirtualHosted {
+		requestPath = strings.TrimPrefix(requestPath, "/"+bucket)
+	}
+	if requestPath == "" {
+		return "/"
+	}
+	return requestPath
+}
+
+// send signs a request with credentials for the region of its bucket
+func (b *mainBackend) send(req *http.Request, creds upstreamCredentials, payload []byte, bucket string, isVirtualHosted bool) (*http.Response, error) {
+	return b.regions.send(req, creds, payload, bucket, isVirtualHosted)
+}
+
+// hasBucketRoutes tells if ListBuckets must be answered from the listings of
+// the backends, keeping the buckets each one holds
+func hasBucketRoutes() bool {
+	return len(mainBackends) > 1 || len(mainBackends[0].Buckets) > 0
+}
+
+// listBackendBuckets answers ListBuckets with the buckets of every backend,
+// each listing is limited to the buckets routed to its backend. A failing
+// backend fails the request rather than hiding its buckets. Continuation
+// tokens belong to a single backend, merged listings are never paginated.
+func listBackendBuckets(identity *clientCredential, query url.Values) (*http.Response, error) {
+	filters := make(url.Values)
+	for _, name := range []string{"prefix", "bucket-region"} {
+		if v := query.Get(name); v != "" {
+			filters.Set(name, v)
+		}
+	}
+
+	merged := listAllMyBucketsResult{Xmlns: s3Namespace}
+	for _, backend := range mainBackends {
+		// Backends the client has no credentials for hold none of its buckets
+		if !identity.usesMainBackend(backend) {
+			continue
+		}
+		listURL := backend.requestURL("", "/", false)
+		listURL.RawQuery = filters.Encode()
+		req, err := http.NewRequest("GET", listURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := identity.mainCredentials(backend)
+		if err != nil {
+			return nil, fmt.Errorf("%w of %s: %v", errUpstreamCredentials, backend.Name, err)
+		}
+		resp, err := backend.send(req, creds, nil, "", false)
+		if err != nil {
+			return nil, fmt.Errorf("main backend %s: %w", backend.Name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Errorf("Main backend %s failed to list buckets with status %d", backend.Name, resp.StatusCode)
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return resp, nil
+		}
+
+		var result listAllMyBucketsResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("invalid bucket list of main backend %s: %w", backend.Name, err)
+		}
+		if merged.Owner == nil {
+			merged.Owner = result.Owner
+		}
+		for _, bucket := range result.Buckets {
+			if mainBackendFor(bucket.Name) == backend {
+				merged.Buckets = append(merged.Buckets, bucket)
+			}
+		}
+	}
+	sort.Slice(merged.Buckets, func(i, j int) bool { return merged.Buckets[i].Name < merged.Buckets[j].Name })
+
+	encoded, err := xml.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	body := append([]byte(xml.Header), encoded...)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/xml"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
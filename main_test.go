@@ -0,0 +1,23 @@
+package main
+
+import "os"
+
+// Minimal configuration init requires, package variables are initialized
+// before any init function runs
+var _ = func() bool {
+	for name, value := range map[string]string{
+		"MAIN_ACCESS_KEY":    "main-access",
+		"MAIN_SECRET_KEY":    "main-secret",
+		"MIRROR_S3_ENDPOINT": "http://mirror.invalid",
+		"MIRROR_ACCESS_KEY":  "mirror-access",
+		"MIRROR_SECRET_KEY":  "mirror-secret",
+		"DISABLE_DATABASE":   "true",
+		"ADMIN_ADDR":         "off",
+		"LOG_LEVEL":          "off",
+	} {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, value)
+		}
+	}
+	return true
+}()
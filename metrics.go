@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is a Prometheus counter or gauge with a fixed set of label names
+type metric struct {
+	name   string
+	help   string
+	kind   string // counter or gauge
+	labels []string
+
+	values map[string]*metricValue
+	mutex  sync.Mutex
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+}
+
+var (
+	// Every metric, in registration order
+	metricsRegistry []*metric
+	metricsMutex    sync.Mutex
+)
+
+func newCounter(name, help string, labels ...string) *metric {
+	return registerMetric(&metric{name: name, help: help, kind: "counter", labels: labels})
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return registerMetric(&metric{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func registerMetric(m *metric) *metric {
+	m.values = make(map[string]*metricValue)
+	metricsMutex.Lock()
+	metricsRegistry = append(metricsRegistry, m)
+	metricsMutex.Unlock()
+	return m
+}
+
+// value returns the series for a set of label values, the caller must hold the lock
+func (m *metric) value(labelValues []string) *metricValue {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	id := strings.Join(labelValues, "\x00")
+	v := m.values[id]
+	if v == nil {
+		v = &metricValue{labels: append([]string(nil), labelValues...)}
+		m.values[id] = v
+	}
+	return v
+}
+
+func (m *metric) Add(delta float64, labelValues ...string) {
+	m.mutex.Lock()
+	m.value(labelValues).value += delta
+	m.mutex.Unlock()
+}
+
+func (m *metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metric) Set(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	m.value(labelValues).value = value
+	m.mutex.Unlock()
+}
+
+// writeMetrics renders every metric in the Prometheus text exposition format
+func writeMetrics(w io.Writer) {
+	metricsMutex.Lock()
+	metrics := append([]*metric(nil), metricsRegistry...)
+	metricsMutex.Unlock()
+
+	for _, m := range metrics {
+		m.mutex.Lock()
+		ids := make([]string, 0, len(m.values))
+		for id := range m.values {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, id := range ids {
+			v := m.values[id]
+			fmt.Fprintf(w, "%s%s %g\n", m.name, formatLabels(m.labels, v.labels), v.value)
+		}
+		m.mutex.Unlock()
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escaped)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+const requestTimeContextKey contextKey = "requestTime"
+
+// Template functions of destination keys, dates are those of the write
+var keyTemplateFuncs = []string{"bucket", "key", "trimPrefix", "trimSegments", "shard", "yyyy", "mm", "dd", "hh", "date"}
+
+// Template functions rendering the date of the write
+var dateTemplateFuncs = []string{"yyyy", "mm", "dd", "hh", "date"}
+
+// Template functions of destination buckets, which must not change over time
+// so that deletes find the objects
+var bucketTemplateFuncs = []string{"bucket", "key", "trimPrefix", "trimSegments", "shard", "target"}
+
+// mirrorTemplateData is what a destination template is executed with
+type mirrorTemplateData struct {
+	bucket string
+	key    string
+	target string
+	at     time.Time
+}
+
+func (d mirrorTemplateData) funcs(names []string) template.FuncMap {
+	all := template.FuncMap{
+		"bucket": func() string { return d.bucket },
+		"key":    func() string { return d.key },
+		"target": func() string { return d.target },
+		"yyyy":   func() string { return d.at.Format("2006") },
+		"mm":     func() string { return d.at.Format("01") },
+		"dd":     func() string { return d.at.Format("02") },
+		"hh":     func() string { return d.at.Format("15") },
+		"date":   func(layout string) string { return d.at.Format(layout) },
+		// {{key | trimPrefix "tenant-a/"}}
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		// {{key | trimSegments 1}} drops the first path segment
+		"trimSegments": func(n int, s string) string {
+			parts := strings.SplitN(s, "/", n+1)
+			if n < 0 || len(parts) <= n {
+				return ""
+			}
+			return parts[n]
+		},
+		// {{shard 2}} spreads keys over 256 prefixes
+		"shard": func(n int) string {
+			sum := sha256.Sum256([]byte(d.key))
+			encoded := hex.EncodeToString(sum[:])
+			if n < 0 || n > len(encoded) {
+				n = len(encoded)
+			}
+			return encoded[:n]
+		},
+	}
+
+	funcs := make(template.FuncMap, len(names))
+	for _, name := range names {
+		funcs[name] = all[name]
+	}
+	return funcs
+}
+
+// parseMirrorTemplate parses a destination template, executing it once so
+// errors surface at load
+func parseMirrorTemplate(name, text string, funcs []string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(mirrorTemplateData{}.funcs(funcs)).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// Some keys may legitimately render empty, only errors are checked
+	sample := mirrorTemplateData{bucket: "bucket", key: "prefix/object.txt", target: "target", at: time.Now().UTC()}
+	if _, err := renderMirrorTemplate(tmpl, funcs, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// templateUsesFuncs tells if a template calls one of the functions, in any
+// branch
+func templateUsesFuncs(tmpl *template.Template, names []string) bool {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var walk func(node parse.Node) bool
+	walk = func(node parse.Node) bool {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, child := range n.Nodes {
+					if walk(child) {
+						return true
+					}
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, cmd := range n.Cmds {
+					if walk(cmd) {
+						return true
+					}
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				if walk(arg) {
+					return true
+				}
+			}
+		case *parse.IdentifierNode:
+			return wanted[n.Ident]
+		case *parse.IfNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		case *parse.RangeNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		case *parse.WithNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		}
+		return false
+	}
+	return tmpl.Tree != nil && walk(tmpl.Tree.Root)
+}
+
+// executeMirrorTemplate renders a destination, which must not be empty
+func executeMirrorTemplate(tmpl *template.Template, funcs []string, data mirrorTemplateData) (string, error) {
+	rendered, err := renderMirrorTemplate(tmpl, funcs, data)
+	if err != nil {
+		return "", err
+	}
+	if rendered == "" {
+		return "", fmt.Errorf("%s is empty for %s/%s", tmpl.Name(), data.bucket, data.key)
+	}
+	return rendered, nil
+}
+
+func renderMirrorTemplate(tmpl *template.Template, funcs []string, data mirrorTemplateData) (string, error) {
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := clone.Funcs(data.funcs(funcs)).Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// withRequestTime records when a request was received, dates of destination
+// keys are those of the write wherever they are computed
+func withRequestTime(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestTimeContextKey, time.Now().UTC()))
+}
+
+func requestTime(req *http.Request) time.Time {
+	if at, ok := req.Context().Value(requestTimeContextKey).(time.Time); ok {
+		return at
+	}
+	return time.Now().UTC()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorKeyTemplates(t *testing.T) {
+	at := time.Date(2024, 3, 7, 9, 30, 0, 0, time.UTC)
+	data := mirrorTemplateData{bucket: "photos", key: "tenant-42/albums/a.jpg", target: "b2", at: at}
+
+	tests := []struct {
+		template string
+		want     string
+		dated    bool
+	}{
+		{"{{key}}", "tenant-42/albums/a.jpg", false},
+		{"{{bucket}}/{{key}}", "photos/tenant-42/albums/a.jpg", false},
+		{`{{key | trimPrefix "tenant-42/"}}`, "albums/a.jpg", false},
+		{`{{key | trimPrefix "other/"}}`, "tenant-42/albums/a.jpg", false},
+		{"{{key | trimSegments 1}}", "albums/a.jpg", false},
+		{"{{key | trimSegments 2}}", "a.jpg", false},
+		{"x{{key | trimSegments 3}}", "x", false},
+		{"{{shard 2}}/{{key}}", "0a/tenant-42/albums/a.jpg", false},
+		{"{{yyyy}}/{{mm}}/{{dd}}/{{hh}}/{{key}}", "2024/03/07/09/tenant-42/albums/a.jpg", true},
+		{`{{date "2006-01-02T15"}}/{{key}}`, "2024-03-07T09/tenant-42/albums/a.jpg", true},
+		{`{{if eq (bucket) "other"}}{{yyyy}}/{{end}}{{key}}`, "tenant-42/albums/a.jpg", true},
+		{`{{with key}}{{.}}{{else}}{{dd}}{{end}}`, "tenant-42/albums/a.jpg", true},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseMirrorTemplate("destinationKey", tt.template, keyTemplateFuncs)
+		if err != nil {
+			t.Errorf("parseMirrorTemplate(%s): %v", tt.template, err)
+			continue
+		}
+		got, err := executeMirrorTemplate(tmpl, keyTemplateFuncs, data)
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+		if dated := templateUsesFuncs(tmpl, dateTemplateFuncs); dated != tt.dated {
+			t.Errorf("%s uses dates = %v, want %v", tt.template, dated, tt.dated)
+		}
+	}
+
+	// Buckets must not change over time
+	if _, err := parseMirrorTemplate("destinationBucket", "backup-{{yyyy}}", bucketTemplateFuncs); err == nil {
+		t.Error("destinationBucket accepted a date function")
+	}
+	if _, err := parseMirrorTemplate("destinationKey", "{{target}}/{{key}}", keyTemplateFuncs); err == nil {
+		t.Error("destinationKey accepted the target function")
+	}
+
+	// Empty destinations are refused when rendered
+	tmpl, _ := parseMirrorTemplate("destinationKey", "{{key | trimSegments 5}}", keyTemplateFuncs)
+	if _, err := executeMirrorTemplate(tmpl, keyTemplateFuncs, data); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("empty destination error = %v", err)
+	}
+}
+
+// withReplicationRules replaces the replication rules for a test, with the
+// file inventory backend rules naming keys by date need
+func withReplicationRules(t *testing.T, rules ...*replicationRule) {
+	previousBackend := inventoryBackend
+	inventoryBackend = inventoryBackendFile
+	t.Cleanup(func() { inventoryBackend = previousBackend })
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			t.Fatalf("rule %s: %v", rule.ID, err)
+		}
+	}
+	previous := replicationRules
+	replicationRules = rules
+	t.Cleanup(func() { replicationRules = previous })
+}
+
+func TestRecordedReplication(t *testing.T) {
+	withReplicationRules(t,
+		&replicationRule{ID: "dated", Prefix: "logs/", DestinationKey: "{{yyyy}}/{{key}}"},
+		&replicationRule{ID: "tenants", Prefix: "tenant-", DestinationKey: "{{key | trimSegments 1}}"},
+		&replicationRule{ID: "skip", Prefix: "tmp/", Action: replicationActionSkip},
+	)
+
+	tests := []struct {
+		name      string
+		key       string
+		rec       *ObjectRecord
+		rule      string
+		mirrorKey string
+		err       bool
+	}{
+		{name: "recorded key", key: "logs/a", rec: &ObjectRecord{Key: "logs/a", MirrorRule: "dated", MirrorKey: "2023/logs/a"}, rule: "dated", mirrorKey: "2023/logs/a"},
+		{name: "recorded same key", key: "other/a", rec: &ObjectRecord{Key: "other/a"}, mirrorKey: "other/a"},
+		{name: "recorded rule removed", key: "tenant-1/a", rec: &ObjectRecord{Key: "tenant-1/a", MirrorRule: "gone", MirrorKey: "a"}, rule: "tenants", mirrorKey: "a"},
+		{name: "recorded trash", key: "logs/b", rec: &ObjectRecord{Key: "logs/b", MirrorRule: "dated", MirrorKey: "2023/logs/b", Deleted: true}, rule: "dated", mirrorKey: "2023/logs/b"},
+		{name: "unrecorded rendered key", key: "tenant-1/a/b", rule: "tenants", mirrorKey: "a/b"},
+		{name: "unrecorded no rule", key: "other/a", mirrorKey: "other/a"},
+		{name: "unrecorded skipped", key: "tmp/a", rule: "skip", mirrorKey: "tmp/a"},
+		{name: "unrecorded dated key", key: "logs/a", rule: "dated", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, mirrorKey, err := recordedReplication("bucket", tt.key, tt.rec)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("recordedReplication = %s, want an error rather than a guessed key", mirrorKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rule.id() != tt.rule || mirrorKey != tt.mirrorKey {
+				t.Errorf("recordedReplication = %s, %s, want %s, %s", rule.id(), mirrorKey, tt.rule, tt.mirrorKey)
+			}
+		})
+	}
+}
+
+func TestDatedKeyNeedsInventory(t *testing.T) {
+	defer func(backend string) { inventoryBackend = backend }(inventoryBackend)
+
+	inventoryBackend = inventoryBackendNone
+	if err := (&replicationRule{DestinationKey: `{{date "2006"}}/{{key}}`}).validate(); err == nil {
+		t.Error("dated destinationKey accepted without an inventory")
+	}
+	if err := (&replicationRule{DestinationKey: "{{shard 2}}/{{key}}"}).validate(); err != nil {
+		t.Errorf("undated destinationKey refused without an inventory: %v", err)
+	}
+
+	inventoryBackend = inventoryBackendFile
+	if err := (&replicationRule{DestinationKey: `{{date "2006"}}/{{key}}`}).validate(); err != nil {
+		t.Errorf("dated destinationKey refused with an inventory: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Kinds of mirror targets
+const (
+	mirrorTargetS3         = "s3"
+	mirrorTargetFilesystem = "filesystem"
+)
+
+// mirrorStore writes and reads the copies of a mirror target. Buckets named
+// bucket are as seen by clients, the copies live in mirrorBucket.
+type mirrorStore interface {
+	// putObject writes the copy of an object
+	putObject(bucket, mirrorBucket, key string, body []byte, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) error
+	// deleteObject deletes a copy, a missing copy is not an error
+	deleteObject(mirrorBucket, key string, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) error
+	// getObject reads a copy (HEAD or GET) as an S3 response, along with the
+	// SSE-C headers the read needed
+	getObject(method, bucket, mirrorBucket, key string) (*http.Response, http.Header, error)
+	// copyObject copies a copy to another key of its mirror bucket, keeping
+	// its metadata when metadata is nil and replacing it otherwise
+	copyObject(bucket, mirrorBucket, key, destKey string, metadata http.Header) error
+	// listObjects calls fn with the keys of a mirror bucket under a prefix
+	listObjects(mirrorBucket, prefix string, fn func(key string) error) error
+}
+
+// newMirrorStore returns the store of a target by its type
+func newMirrorStore(t *mirrorTarget) (mirrorStore, error) {
+	switch t.Type {
+	case mirrorTargetS3:
+		return &s3MirrorStore{target: t}, nil
+	case mirrorTargetFilesystem:
+		return newFilesystemMirrorStore(t)
+	}
+	return nil, fmt.Errorf("mirror target %s has an invalid type %q, expected s3 or filesystem", t.Name, t.Type)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Directory of the root holding the sidecars and temporary files, bucket
+// names can't start with a dot so it never collides with a mirror bucket
+const filesystemStateDir = ".s3mirror"
+
+// Headers of a copy kept in its sidecar, along with the X-Amz-Meta- ones
+var filesystemMetadataHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control", "Expires"}
+
+// errFilesystemKeyConflict fails writes of keys needing a file where a
+// directory already is, or the other way around (a and a/b). Retrying them
+// fails the same way until the other key is deleted.
+var errFilesystemKeyConflict = errors.New("key conflicts with another copy on the filesystem")
+
+// filesystemMirrorStore keeps the copies of a target as files under
+// root/bucket/key, on a mounted volume (NFS, CephFS, ...)
+type filesystemMirrorStore struct {
+	target *mirrorTarget
+	root   string
+}
+
+// filesystemObjectMeta is the sidecar of a copy, stored as JSON under
+// root/.s3mirror/meta/bucket/key.json
+type filesystemObjectMeta struct {
+	Headers      http.Header `json:"headers"`
+	ETag         string      `json:"etag"`
+	LastModified time.Time   `json:"lastModified"`
+}
+
+func newFilesystemMirrorStore(t *mirrorTarget) (*filesystemMirrorStore, error) {
+	if !filepath.IsAbs(t.Root) {
+		return nil, fmt.Errorf("mirror target %s needs an absolute root, got %q", t.Name, t.Root)
+	}
+	// A missing mount must not fill the node's disk
+	info, err := os.Stat(t.Root)
+	if err != nil {
+		return nil, fmt.Errorf("mirror target %s: %w", t.Name, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("mirror target %s: root %s is not a directory", t.Name, t.Root)
+	}
+	s := &filesystemMirrorStore{target: t, root: filepath.Clean(t.Root)}
+	for _, dir := range []string{s.stateDir("meta"), s.stateDir("tmp")} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("mirror target %s: %w", t.Name, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *filesystemMirrorStore) stateDir(name string) string {
+	return filepath.Join(s.root, filesystemStateDir, name)
+}
+
+// objectPath returns the file of a copy and of its sidecar. Keys that don't
+// map to a single file under the bucket directory are refused: empty, . and
+// .. segments, leading or trailing slashes and NUL bytes, and paths going
+// through a symbolic link that could point out of the root.
+func (s *filesystemMirrorStore) objectPath(mirrorBucket, key string) (string, string, error) {
+	if mirrorBucket == "" || strings.HasPrefix(mirrorBucket, ".") || strings.ContainsAny(mirrorBucket, "/\\\x00") {
+		return "", "", fmt.Errorf("invalid mirror bucket name %q for a filesystem target", mirrorBucket)
+	}
+	if key == "" || strings.ContainsRune(key, 0) {
+		return "", "", fmt.Errorf("invalid key %q for a filesystem target", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", "", fmt.Errorf("invalid key %q for a filesystem target", key)
+		}
+	}
+
+	bucketDir := filepath.Join(s.root, mirrorBucket)
+	file := filepath.Join(bucketDir, filepath.FromSlash(key))
+	if !strings.HasPrefix(file, bucketDir+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("key %q escapes mirror bucket %s", key, mirrorBucket)
+	}
+	metaFile := filepath.Join(s.stateDir("meta"), mirrorBucket, filepath.FromSlash(key)) + ".json"
+	for _, name := range []string{file, metaFile} {
+		if err := s.checkNoSymlink(name); err != nil {
+			return "", "", fmt.Errorf("key %q of mirror bucket %s: %w", key, mirrorBucket, err)
+		}
+	}
+	return file, metaFile, nil
+}
+
+// checkNoSymlink walks a path from the root without following links and
+// fails on the first symbolic link, the missing part is created as plain
+// directories
+func (s *filesystemMirrorStore) checkNoSymlink(name string) error {
+	rel, err := filepath.Rel(s.root, name)
+	if err != nil {
+		return err
+	}
+	current := s.root
+	for _, segment := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, segment)
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symbolic link", current)
+		}
+		// Nothing is under a file, writes report the conflicting key
+		if !info.IsDir() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// checkKeyConflict fails when a copy of a key can't be written because a
+// parent directory of its file is the copy of another key, or its file is
+// the directory of other keys
+func (s *filesystemMirrorStore) checkKeyConflict(mirrorBucket, key, file string) error {
+	segments := strings.Split(key, "/")
+	for i := 1; i < len(segments); i++ {
+		parent := strings.Join(segments[:i], "/")
+		info, err := os.Lstat(filepath.Join(s.root, mirrorBucket, filepath.FromSlash(parent)))
+		if err == nil && !info.IsDir() {
+			return fmt.Errorf("%w: %s/%s is stored as a file, %s can't be stored under it", errFilesystemKeyConflict, mirrorBucket, parent, key)
+		}
+	}
+	if info, err := os.Lstat(file); err == nil && info.IsDir() {
+		return fmt.Errorf("%w: %s/%s is a directory holding copies of keys under %s/", errFilesystemKeyConflict, mirrorBucket, key, key)
+	}
+	return nil
+}
+
+// writeFile replaces a file atomically: readers see the old or the new
+// content, never a partial one
+func (s *filesystemMirrorStore) writeFile(name string, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.stateDir("tmp"), "put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o640); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (s *filesystemMirrorStore) writeMeta(name string, meta filesystemObjectMeta) error {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(name, bytes.NewReader(encoded))
+}
+
+// readMeta reads the sidecar of a copy, copies written without one get the
+// defaults of S3
+func (s *filesystemMirrorStore) readMeta(name string, info fs.FileInfo) (filesystemObjectMeta, error) {
+	meta := filesystemObjectMeta{Headers: make(http.Header), LastModified: info.ModTime().UTC()}
+	encoded, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(encoded, &meta); err != nil {
+		return meta, fmt.Errorf("invalid sidecar %s: %w", name, err)
+	}
+	if meta.Headers == nil {
+		meta.Headers = make(http.Header)
+	}
+	return meta, nil
+}
+
+// storedMetadata returns the headers of a write kept in its sidecar
+func storedMetadata(headers http.Header) http.Header {
+	stored := make(http.Header)
+	for _, k := range filesystemMetadataHeaders {
+		if v := headers.Values(k); len(v) > 0 {
+			stored[k] = v
+		}
+	}
+	for k, v := range headers {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			stored[k] = v
+		}
+	}
+	return stored
+}
+
+// putObject ignores SSE and storage classes, Object Lock can't be enforced
+// on a filesystem so locked buckets fail the write
+func (s *filesystemMirrorStore) putObject(bucket, mirrorBucket, key string, body []byte, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) error {
+	if s.target.objectLockFor(bucket) != nil {
+		return fmt.Errorf("%w on filesystem target %s", errObjectLockDisabled, s.target.Name)
+	}
+	file, metaFile, err := s.objectPath(mirrorBucket, key)
+	if err != nil {
+		return err
+	}
+	if err := s.checkKeyConflict(mirrorBucket, key, file); err != nil {
+		return err
+	}
+
+	// Until both files are written the copy is FAILED and the write retried
+	if err := s.writeFile(file, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+	return s.writeMeta(metaFile, filesystemObjectMeta{
+		Headers:      storedMetadata(headers),
+		ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		LastModified: time.Now().UTC(),
+	})
+}
+
+func (s *filesystemMirrorStore) deleteObject(mirrorBucket, key string, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) error {
+	file, metaFile, err := s.objectPath(mirrorBucket, key)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{file, metaFile} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return err
+		}
+	}
+	s.removeEmptyDirs(filepath.Dir(file), filepath.Join(s.root, mirrorBucket))
+	s.removeEmptyDirs(filepath.Dir(metaFile), filepath.Join(s.stateDir("meta"), mirrorBucket))
+	return nil
+}
+
+// removeEmptyDirs removes the directories left empty by a delete, up to the
+// bucket directory
+func (s *filesystemMirrorStore) removeEmptyDirs(dir, bucketDir string) {
+	for dir != bucketDir && strings.HasPrefix(dir, bucketDir+string(filepath.Separator)) {
+		// Stops at the first directory still holding copies, or at the copy
+		// of another key when the deleted one was under it
+		if info, err := os.Lstat(dir); err != nil || !info.IsDir() || os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// getObject answers like S3 would, with a 404 for missing copies
+func (s *filesystemMirrorStore) getObject(method, bucket, mirrorBucket, key string) (*http.Response, http.Header, error) {
+	file, metaFile, err := s.objectPath(mirrorBucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header), Body: http.NoBody}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		f.Close()
+		return &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header), Body: http.NoBody}, nil, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	meta, err := s.readMeta(metaFile, info)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	header := meta.Headers.Clone()
+	header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	header.Set("Last-Modified", meta.LastModified.Format(http.TimeFormat))
+	if meta.ETag != "" {
+		header.Set("ETag", meta.ETag)
+	}
+	resp := &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: info.Size(), Body: f}
+	if method == "HEAD" {
+		f.Close()
+		resp.Body = http.NoBody
+	}
+	return resp, nil, nil
+}
+
+func (s *filesystemMirrorStore) copyObject(bucket, mirrorBucket, key, destKey string, metadata http.Header) error {
+	resp, _, err := s.getObject("GET", bucket, mirrorBucket, key)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("copy source %s/%s not found", mirrorBucket, key)
+	}
+
+	destFile, destMetaFile, err := s.objectPath(mirrorBucket, destKey)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		metadata = resp.Header
+	}
+	meta := filesystemObjectMeta{
+		Headers:      storedMetadata(metadata),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: time.Now().UTC(),
+	}
+	// Rewriting the metadata of a copy in place leaves its file as is
+	if destKey != key {
+		if err := s.checkKeyConflict(mirrorBucket, destKey, destFile); err != nil {
+			return err
+		}
+		if err := s.writeFile(destFile, resp.Body); err != nil {
+			return err
+		}
+	}
+	return s.writeMeta(destMetaFile, meta)
+}
+
+func (s *filesystemMirrorStore) listObjects(mirrorBucket, prefix string, fn func(key string) error) error {
+	bucketDir := filepath.Join(s.root, mirrorBucket)
+	if _, _, err := s.objectPath(mirrorBucket, "key"); err != nil {
+		return err
+	}
+	err := filepath.WalkDir(bucketDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Links are never followed, copies are only written as plain files
+		if d.IsDir() || d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, name)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			return fn(key)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
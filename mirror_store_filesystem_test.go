@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFilesystemStore(t *testing.T) *filesystemMirrorStore {
+	root := t.TempDir()
+	store, err := newFilesystemMirrorStore(&mirrorTarget{Name: "fs", Type: "filesystem", Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.target.store = store
+	return store
+}
+
+func TestFilesystemObjectPath(t *testing.T) {
+	store := newTestFilesystemStore(t)
+
+	tests := []struct {
+		bucket string
+		key    string
+		valid  bool
+	}{
+		{"bucket", "a/b.txt", true},
+		{"bucket", "a b/ü.txt", true},
+		{"bucket", "a/../b", false},
+		{"bucket", "../b", false},
+		{"bucket", "..", false},
+		{"bucket", "./a", false},
+		{"bucket", "a/./b", false},
+		{"bucket", "/x", false},
+		{"bucket", "a//b", false},
+		{"bucket", "a/", false},
+		{"bucket", "a\x00b", false},
+		{"bucket", "", false},
+		{"", "a", false},
+		{".s3mirror", "meta/x", false},
+		{"a/b", "c", false},
+		{"..", "c", false},
+	}
+	for _, tt := range tests {
+		file, _, err := store.objectPath(tt.bucket, tt.key)
+		switch {
+		case tt.valid && err != nil:
+			t.Errorf("objectPath(%q, %q): %v", tt.bucket, tt.key, err)
+		case !tt.valid && err == nil:
+			t.Errorf("objectPath(%q, %q) = %s, want an error", tt.bucket, tt.key, file)
+		}
+	}
+}
+
+func TestFilesystemSymlinks(t *testing.T) {
+	store := newTestFilesystemStore(t)
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bucketDir := filepath.Join(store.root, "bucket")
+	if err := os.MkdirAll(bucketDir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(bucketDir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(bucketDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes through a linked directory never reach it
+	if err := store.putObject("bucket", "bucket", "escape/written", []byte("x"), http.Header{}, upstreamCredentials{}, false); err == nil {
+		t.Error("putObject wrote through a symbolic link")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "written")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file created outside the root: %v", err)
+	}
+
+	// Reads of linked files or directories are refused
+	for _, key := range []string{"link", "escape/secret"} {
+		if _, _, err := store.getObject("GET", "bucket", "bucket", key); err == nil {
+			t.Errorf("getObject(%q) followed a symbolic link", key)
+		}
+	}
+	if err := store.deleteObject("bucket", "link", http.Header{}, upstreamCredentials{}, false); err == nil {
+		t.Error("deleteObject went through a symbolic link")
+	}
+
+	// A linked bucket directory is refused as a whole
+	if err := os.Symlink(outside, filepath.Join(store.root, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.getObject("GET", "linked", "linked", "secret"); err == nil {
+		t.Error("getObject followed a linked bucket directory")
+	}
+
+	// Listings skip links and only return plain copies
+	if err := store.putObject("bucket", "bucket", "plain/file", []byte("x"), http.Header{}, upstreamCredentials{}, false); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	if err := store.listObjects("bucket", "", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "plain/file" {
+		t.Errorf("listObjects = %v, want [plain/file]", keys)
+	}
+}
+
+func TestFilesystemKeyConflicts(t *testing.T) {
+	store := newTestFilesystemStore(t)
+	put := func(key string) error {
+		return store.putObject("bucket", "bucket", key, []byte(key), http.Header{}, upstreamCredentials{}, false)
+	}
+	for _, key := range []string{"a", "b/c", "a.txt"} {
+		if err := put(key); err != nil {
+			t.Fatalf("putObject(%s): %v", key, err)
+		}
+	}
+
+	// A key under a copy, or a key whose file is the directory of others
+	for _, key := range []string{"a/b", "a/b/c", "b"} {
+		if err := put(key); !errors.Is(err, errFilesystemKeyConflict) {
+			t.Errorf("putObject(%s) = %v, want errFilesystemKeyConflict", key, err)
+		}
+	}
+	if err := store.copyObject("bucket", "bucket", "a", "b", nil); !errors.Is(err, errFilesystemKeyConflict) {
+		t.Errorf("copyObject(a, b) = %v, want errFilesystemKeyConflict", err)
+	}
+	if resp, _, err := store.getObject("GET", "bucket", "bucket", "a/b"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("getObject(a/b) = %v, want a 404", err)
+	}
+	if err := store.deleteObject("bucket", "a/b", http.Header{}, upstreamCredentials{}, false); err != nil {
+		t.Errorf("deleteObject(a/b): %v", err)
+	}
+
+	// Existing copies are left as they were, and are written again once the
+	// conflicting key is deleted
+	if content, err := os.ReadFile(filepath.Join(store.root, "bucket", "a")); err != nil || string(content) != "a" {
+		t.Errorf("copy of a = %q, %v", content, err)
+	}
+	if err := put("b/c"); err != nil {
+		t.Errorf("putObject(b/c) again: %v", err)
+	}
+	if err := store.deleteObject("bucket", "a", http.Header{}, upstreamCredentials{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("a/b"); err != nil {
+		t.Errorf("putObject(a/b) after deleting a: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// s3MirrorStore keeps the copies of a target in buckets of an S3 endpoint
+type s3MirrorStore struct {
+	target *mirrorTarget
+}
+
+// mirrorURL returns the URL of a copy in the style of the target, the style
+// of the client request for targets without one
+func (s *s3MirrorStore) mirrorURL(mirrorBucket, key string, clientVirtualHosted bool) (*url.URL, bool) {
+	isVirtualHosted := s.target.virtualHosted(mirrorBucket, clientVirtualHosted)
+	mirrorURL := s.target.requestURL(mirrorBucket, key, isVirtualHosted)
+	log.Debugf("Mirroring to %s: %s%s", s.target.Name, mirrorURL.Host, mirrorURL.Path)
+	return mirrorURL, isVirtualHosted
+}
+
+// request sends a write of the mirror with the relevant headers of the client
+func (s *s3MirrorStore) request(method string, mirrorURL *url.URL, mirrorBucket string, body []byte, headers http.Header, creds upstreamCredentials, isVirtualHosted bool) (int, []byte, error) {
+	req, err := http.NewRequest(method, mirrorURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for k, v := range headers {
+		if strings.HasPrefix(k, "Content-") || strings.HasPrefix(k, "X-Amz-") {
+			req.Header[k] = v
+		}
+	}
+
+	resp, err := s.target.regions.send(req, creds, body, mirrorBucket, isVirtualHosted)
+	if err != nil {
+		return 0, nil, err
+	}
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, bodyBytes, nil
+}
+
+func (s *s3MirrorStore) putObject(bucket, mirrorBucket, key string, body []byte, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) error {
+	t := s.target
+	mirrorURL, isVirtualHosted := s.mirrorURL(mirrorBucket, key, clientVirtualHosted)
+
+	// Server-side encryption of the copy, keys of main may not exist on the mirror
+	headers = t.ssePolicyFor(bucket).apply(headers)
+
+	// Storage class in the target's names, headers are shared by the targets
+	if class := headers.Get(storageClassHeader); class != "" {
+		headers = headers.Clone()
+		setStorageClass(headers, t.storageClass(class))
+	}
+
+	// Immutable copies, a bucket without Object Lock fails the write rather
+	// than storing an unlocked copy
+	if rule := t.objectLockFor(bucket); rule != nil {
+		if err := t.checkObjectLock(mirrorBucket); err != nil {
+			return err
+		}
+		headers = rule.lockMirrorWrite(headers, body, time.Now().UTC())
+	}
+
+	for {
+		status, respBody, err := s.request("PUT", mirrorURL, mirrorBucket, body, headers, creds, isVirtualHosted)
+		if err != nil {
+			return err
+		}
+		if status < 300 {
+			return nil
+		}
+
+		// Providers without the class get its fallback, and every later write too
+		class := headers.Get(storageClassHeader)
+		if class == "" || !isStorageClassRejection(status, respBody) {
+			return fmt.Errorf("mirror request failed with status %d: %s", status, string(respBody))
+		}
+		fallback := t.rejectStorageClass(class)
+		log.Warnf("Mirror target %s rejected storage class %s, falling back to %s", t.Name, class, storedStorageClass(fallback))
+		setStorageClass(headers, fallback)
+	}
+}
+
+func (s *s3MirrorStore) deleteObject(mirrorBucket, key string, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) error {
+	mirrorURL, isVirtualHosted := s.mirrorURL(mirrorBucket, key, clientVirtualHosted)
+	status, respBody, err := s.request("DELETE", mirrorURL, mirrorBucket, nil, headers, creds, isVirtualHosted)
+	if err != nil {
+		return err
+	}
+	if status >= 300 && status != http.StatusNotFound {
+		return fmt.Errorf("mirror request failed with status %d: %s", status, string(respBody))
+	}
+	return nil
+}
+
+// getObject retries with the SSE-C key of the bucket's policy when the mirror
+// asks for it
+func (s *s3MirrorStore) getObject(method, bucket, mirrorBucket, key string) (*http.Response, http.Header, error) {
+	t := s.target
+	resp, err := t.send(method, mirrorBucket, key, nil, nil, nil)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		return resp, nil, err
+	}
+	customerKey := t.ssePolicyFor(bucket).customerKeyHeaders(sseHeader + "-")
+	if customerKey == nil {
+		return resp, nil, nil
+	}
+	resp.Body.Close()
+	resp, err = t.send(method, mirrorBucket, key, nil, customerKey, nil)
+	return resp, customerKey, err
+}
+
+// copyObject keeps the storage class and SSE of the source and locks the copy
+// like other copies. Sources over 5 GiB can't be copied in a single request.
+func (s *s3MirrorStore) copyObject(bucket, mirrorBucket, key, destKey string, metadata http.Header) error {
+	t := s.target
+	if rule := t.objectLockFor(bucket); rule != nil {
+		if err := t.checkObjectLock(mirrorBucket); err != nil {
+			return err
+		}
+	}
+	headers := make(http.Header)
+	var customerKey http.Header
+
+	if metadata == nil {
+		head, sourceKey, err := s.getObject("HEAD", bucket, mirrorBucket, key)
+		if err != nil {
+			return err
+		}
+		head.Body.Close()
+		if head.StatusCode != http.StatusOK {
+			return fmt.Errorf("HEAD failed with status %d", head.StatusCode)
+		}
+		customerKey = sourceKey
+
+		// Copies are written in STANDARD unless told otherwise
+		if storageClass := head.Header.Get(storageClassHeader); storageClass != "" {
+			headers.Set(storageClassHeader, storageClass)
+		}
+		if sse := head.Header.Get(sseHeader); sse != "" {
+			headers.Set(sseHeader, sse)
+			if keyID := head.Header.Get(sseKMSKeyIDHeader); keyID != "" {
+				headers.Set(sseKMSKeyIDHeader, keyID)
+			}
+		}
+	} else {
+		// Replacing the metadata requires sending all of it again
+		for k, v := range metadata {
+			if k != sseCustomerAlgorithm {
+				headers[k] = v
+			}
+		}
+		if metadata.Get(sseCustomerAlgorithm) != "" {
+			customerKey = t.ssePolicyFor(bucket).customerKeyHeaders(sseHeader + "-")
+		}
+		headers.Set("X-Amz-Metadata-Directive", "REPLACE")
+	}
+	headers.Set("X-Amz-Copy-Source", "/"+mirrorBucket+"/"+awsURIEncode(key, false))
+
+	// SSE-C copies need the key for reading the source and writing the copy
+	if customerKey != nil {
+		for k, v := range customerKey {
+			headers[k] = v
+		}
+		for k, v := range t.ssePolicyFor(bucket).customerKeyHeaders(sseCopySourceHeaderPrefix) {
+			headers[k] = v
+		}
+	}
+	if rule := t.objectLockFor(bucket); rule != nil {
+		rule.setHeaders(headers, time.Now().UTC())
+	}
+
+	resp, err := t.send("PUT", mirrorBucket, destKey, nil, headers, nil)
+	if err != nil {
+		return err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("copy failed with status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (s *s3MirrorStore) listObjects(mirrorBucket, prefix string, fn func(key string) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.target.send("GET", mirrorBucket, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("listing failed with status %d: %s", resp.StatusCode, body)
+		}
+
+		var listing listBucketResultV2
+		if err := xml.Unmarshal(body, &listing); err != nil {
+			return err
+		}
+		for _, obj := range listing.Contents {
+			if err := fn(obj.Key); err != nil {
+				return err
+			}
+		}
+
+		if !listing.IsTruncated || listing.NextContinuationToken == "" {
+			return nil
+		}
+		token = listing.NextContinuationToken
+	}
+}
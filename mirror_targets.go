@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mirror status of an object on a target
+const (
+	mirrorStatusPending   = "PENDING"
+	mirrorStatusCompleted = "COMPLETED"
+	mirrorStatusFailed    = "FAILED"
+
+	// The mirror bucket can't lock the copy, retrying won't help until
+	// Object Lock is enabled on it
+	mirrorStatusLockFailed = "LOCK_FAILED"
+)
+
+// mirrorTarget is a storage receiving a copy of every object written to main
+type mirrorTarget struct {
+	Name            string            `json:"name"`
+	Type            string            `json:"type"`            // s3 (default) or filesystem
+	Endpoint        string            `json:"endpoint"`        // S3 endpoint of s3 targets
+	AddressingStyle string            `json:"addressingStyle"` // path, virtual or auto, the style of the client by default
+	Root            string            `json:"root"`            // Directory of filesystem targets, a mounted volume
+	BucketPrefix    string            `json:"bucketPrefix"`    // Prepended to bucket names
+	BucketSuffix    string            `json:"bucketSuffix"`    // Appended to bucket names
+	BucketMap       map[string]string `json:"bucketMap"`       // Mirror bucket per bucket, prefix and suffix are not applied
+	Buckets         []string          `json:"buckets"`         // Bucket names or glob patterns mirrored, empty for every bucket
+	Region          string            `json:"region"`          // Defaults to the region of the endpoint or us-east-1
+	BucketRegions   map[string]string `json:"bucketRegions"`   // Region per mirror bucket name
+	CredentialsEnv  string            `json:"credentialsEnv"`  // Prefix of the credential variables, MIRROR_<NAME> by default
+	SSEPolicies     []*ssePolicy      `json:"ssePolicies"`     // Defaults to MIRROR_SSE_CONFIG
+	ObjectLock      []*objectLockRule `json:"objectLock"`      // Defaults to MIRROR_OBJECT_LOCK_CONFIG
+
+	StorageClassMap       map[string]string `json:"storageClassMap"`       // Provider name of storage classes
+	StorageClassFallback  map[string]string `json:"storageClassFallback"`  // Class replacing one the provider rejects, the bucket default when missing
+	ArchiveStorageClasses []string          `json:"archiveStorageClasses"` // Classes needing a restore before reads, GLACIER and DEEP_ARCHIVE by default
+
+	store           mirrorStore
+	endpointURL     *url.URL
+	credentials     *credentialProvider // Nil for filesystem targets
+	regions         *upstreamRegions
+	lockedBuckets   objectLockBuckets
+	rejectedClasses rejectedStorageClasses
+}
+
+type mirrorTargetsConfig struct {
+	Targets []*mirrorTarget `json:"targets"`
+}
+
+var (
+	// Every mirror target, the first one is the primary target used by
+	// maintenance commands and inventory reports by default
+	mirrorTargets []*mirrorTarget
+
+	mirrorOperations = newCounter("s3mirror_mirror_operations_total", "Operations mirrored per target.", "target", "operation", "result")
+
+	mirrorTargetName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+// loadMirrorTargets reads MIRROR_TARGETS_CONFIG, without it the single
+// "default" target is configured by MIRROR_S3_ENDPOINT and the other MIRROR_
+// variables
+func loadMirrorTargets() {
+	configPath := getEnv("MIRROR_TARGETS_CONFIG")
+	if configPath == "" {
+		if getEnv("MIRROR_S3_ENDPOINT") == "" {
+			log.Fatal("Required environment variable not set: MIRROR_S3_ENDPOINT (or MIRROR_TARGETS_CONFIG)")
+		}
+		target := &mirrorTarget{
+			Name:            "default",
+			Endpoint:        getEnv("MIRROR_S3_ENDPOINT"),
+			BucketPrefix:    getEnv("MIRROR_BUCKET_PREFIX"),
+			Region:          getEnv("MIRROR_REGION"),
+			BucketRegions:   parseBucketRegions("MIRROR_BUCKET_REGIONS"),
+			CredentialsEnv:  "MIRROR",
+			AddressingStyle: getEnv("MIRROR_ADDRESSING_STYLE"),
+		}
+		if err := target.init(); err != nil {
+			log.Fatal(err)
+		}
+		mirrorTargets = []*mirrorTarget{target}
+		return
+	}
+
+	var config mirrorTargetsConfig
+	if err := loadConfigFile(configPath, &config); err != nil {
+		log.Fatalf("Failed to load MIRROR_TARGETS_CONFIG: %v", err)
+	}
+	if len(config.Targets) == 0 {
+		log.Fatal("MIRROR_TARGETS_CONFIG has no targets")
+	}
+
+	names := make(map[string]bool)
+	for _, target := range config.Targets {
+		if names[target.Name] {
+			log.Fatalf("Duplicate mirror target %q", target.Name)
+		}
+		names[target.Name] = true
+		if err := target.init(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	mirrorTargets = config.Targets
+	log.Infof("Mirroring to %d targets", len(mirrorTargets))
+}
+
+// init validates a target and sets up its store, credentials and regions
+func (t *mirrorTarget) init() error {
+	if !mirrorTargetName.MatchString(t.Name) || t.Name == "main" {
+		return fmt.Errorf("invalid mirror target name %q", t.Name)
+	}
+	if findMainBackend(t.Name) != nil {
+		return fmt.Errorf("mirror target %s has the name of a main backend", t.Name)
+	}
+	if t.Type == "" {
+		t.Type = mirrorTargetS3
+	}
+	switch t.Type {
+	case mirrorTargetS3:
+		endpointURL, err := url.Parse(t.Endpoint)
+		if err != nil || t.Endpoint == "" {
+			return fmt.Errorf("mirror target %s has an invalid endpoint %q", t.Name, t.Endpoint)
+		}
+		t.endpointURL = endpointURL
+		if t.Root != "" {
+			return fmt.Errorf("mirror target %s: root only applies to filesystem targets", t.Name)
+		}
+		if !validAddressingStyle(t.AddressingStyle) {
+			return fmt.Errorf("mirror target %s has an invalid addressing style %q, expected path, virtual or auto", t.Name, t.AddressingStyle)
+		}
+	case mirrorTargetFilesystem:
+		if t.Endpoint != "" {
+			return fmt.Errorf("mirror target %s: endpoint does not apply to filesystem targets", t.Name)
+		}
+		if t.AddressingStyle != addressingStyleClient {
+			return fmt.Errorf("mirror target %s: addressing style does not apply to filesystem targets", t.Name)
+		}
+	}
+	for _, pattern := range t.Buckets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("mirror target %s has an invalid bucket pattern %q: %w", t.Name, pattern, err)
+		}
+	}
+	for i, policy := range t.SSEPolicies {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("mirror target %s, SSE policy %d: %w", t.Name, i+1, err)
+		}
+	}
+
+	for i, rule := range t.ObjectLock {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("mirror target %s, object lock rule %d: %w", t.Name, i+1, err)
+		}
+	}
+
+	if err := t.validateStorageClasses(); err != nil {
+		return err
+	}
+
+	store, err := newMirrorStore(t)
+	if err != nil {
+		return err
+	}
+	t.store = store
+	if t.Type == mirrorTargetFilesystem {
+		return nil
+	}
+
+	if t.CredentialsEnv == "" {
+		t.CredentialsEnv = "MIRROR_" + strings.ToUpper(strings.NewReplacer("-", "_").Replace(t.Name))
+	}
+	credentials, err := newCredentialProvider(t.CredentialsEnv, t.Name)
+	if err != nil {
+		return err
+	}
+	t.credentials = credentials
+	t.regions = newUpstreamRegions(t.Name, t.Endpoint, t.Region, t.BucketRegions)
+	return nil
+}
+
+// applies tells if the target mirrors a bucket
+func (t *mirrorTarget) applies(bucket string) bool {
+	if len(t.Buckets) == 0 {
+		return true
+	}
+	for _, pattern := range t.Buckets {
+		if ok, _ := path.Match(pattern, bucket); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketName returns the mirror bucket receiving the objects of a bucket
+func (t *mirrorTarget) bucketName(bucket string) string {
+	if mapped := t.BucketMap[bucket]; mapped != "" {
+		return mapped
+	}
+	return t.BucketPrefix + bucket + t.BucketSuffix
+}
+
+// ssePolicyFor returns the SSE policy of a bucket (as seen by clients)
+func (t *mirrorTarget) ssePolicyFor(bucket string) *ssePolicy {
+	if t.SSEPolicies != nil {
+		return matchSSEPolicy(t.SSEPolicies, bucket)
+	}
+	return matchSSEPolicy(ssePolicies, bucket)
+}
+
+// objectLockRules returns the Object Lock rules of the target
+func (t *mirrorTarget) objectLockRules() []*objectLockRule {
+	if t.ObjectLock != nil {
+		return t.ObjectLock
+	}
+	return objectLockRules
+}
+
+// objectLockFor returns the Object Lock rule of a bucket (as seen by
+// clients), nil when there is none
+func (t *mirrorTarget) objectLockFor(bucket string) *objectLockRule {
+	return matchObjectLockRule(t.objectLockRules(), bucket)
+}
+
+// retrieveCredentials returns the credentials of the target, filesystem
+// targets have none
+func (t *mirrorTarget) retrieveCredentials() (upstreamCredentials, error) {
+	if t.credentials == nil {
+		return upstreamCredentials{}, nil
+	}
+	return t.credentials.Retrieve()
+}
+
+// virtualHosted tells if requests to the target for a mirror bucket put it
+// in the hostname, given the style of the client request
+func (t *mirrorTarget) virtualHosted(bucket string, clientVirtualHosted bool) bool {
+	return upstreamVirtualHosted(t.AddressingStyle, t.endpointURL, bucket, clientVirtualHosted)
+}
+
+// requestURL returns the URL of a key of a mirror bucket, the bucket itself
+// for an empty key
+func (t *mirrorTarget) requestURL(bucket, key string, isVirtualHosted bool) *url.URL {
+	requestURL := *t.endpointURL
+	switch {
+	case isVirtualHosted:
+		requestURL.Host = bucket + "." + requestURL.Host
+		requestURL.Path = "/" + key
+	case key == "":
+		requestURL.Path = "/" + bucket
+	default:
+		requestURL.Path = "/" + bucket + "/" + key
+	}
+	return &requestURL
+}
+
+// send sends a request to the target in its style, path-style by default,
+// bucket is the mirror bucket
+func (t *mirrorTarget) send(method, bucket, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	if t.Type != mirrorTargetS3 {
+		return nil, fmt.Errorf("mirror target %s is not an S3 endpoint", t.Name)
+	}
+	isVirtualHosted := t.virtualHosted(bucket, false)
+	mirrorURL := t.requestURL(bucket, key, isVirtualHosted)
+	mirrorURL.RawQuery = canonicalClientQuery(query.Encode())
+
+	req, err := http.NewRequest(method, mirrorURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	creds, err := t.retrieveCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return t.regions.send(req, creds, body, bucket, isVirtualHosted)
+}
+
+// mirrorTargetsFor returns the targets mirroring a bucket
+func mirrorTargetsFor(bucket string) []*mirrorTarget {
+	var targets []*mirrorTarget
+	for _, target := range mirrorTargets {
+		if target.applies(bucket) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// findMirrorTarget returns a target by name, the primary one for an empty name
+func findMirrorTarget(name string) (*mirrorTarget, error) {
+	if name == "" {
+		return mirrorTargets[0], nil
+	}
+	for _, target := range mirrorTargets {
+		if target.Name == name {
+			return target, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown mirror target %q", name)
+}
+
+// isBackedUp tells if every target an object is mirrored to holds it
+func isBackedUp(status map[string]string) bool {
+	for _, s := range status {
+		if s != mirrorStatusCompleted {
+			return false
+		}
+	}
+	return len(status) > 0
+}
+
+// recordMirrorStatus counts a mirrored operation
+func recordMirrorStatus(target *mirrorTarget, bucket, key, operation string, err error) {
+	result := "success"
+	if err != nil {
+		log.Errorf("Failed to mirror %s of %s/%s to %s: %v", operation, bucket, key, target.Name, err)
+		result = "error"
+		if errors.Is(err, errObjectLockDisabled) {
+			result = "lock_disabled"
+		}
+	}
+	mirrorOperations.Inc(target.Name, operation, result)
+}
+
+// recordMirrorCopy counts a mirrored write and stores its outcome and the
+// storage class of the copy in the inventory
+func recordMirrorCopy(target *mirrorTarget, bucket, key, storageClass string, err error) {
+	recordMirrorStatus(target, bucket, key, "put", err)
+
+	if inventory == nil {
+		return
+	}
+	status := mirrorStatusCompleted
+	switch {
+	case errors.Is(err, errObjectLockDisabled):
+		status, storageClass = mirrorStatusLockFailed, ""
+	case err != nil:
+		status, storageClass = mirrorStatusFailed, ""
+	}
+	if err := inventory.SetMirrorStatus(bucket, key, target.Name, status, storageClass); err != nil {
+		log.Errorf("Failed to update mirror status of %s/%s on %s: %v", bucket, key, target.Name, err)
+	}
+}
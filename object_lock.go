@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Object Lock headers of writes
+const (
+	objectLockModeHeader        = "X-Amz-Object-Lock-Mode"
+	objectLockRetainUntilHeader = "X-Amz-Object-Lock-Retain-Until-Date"
+	objectLockLegalHoldHeader   = "X-Amz-Object-Lock-Legal-Hold"
+)
+
+// objectLockRule sets the Object Lock retention of the mirror copies of the
+// buckets it matches, whatever the client asked of main
+type objectLockRule struct {
+	Bucket    string `json:"bucket"`    // Bucket name or glob pattern, empty matches every bucket
+	Mode      string `json:"mode"`      // GOVERNANCE or COMPLIANCE, empty for a legal hold only
+	Days      int    `json:"days"`      // Retention from the mirror write, in days
+	Years     int    `json:"years"`     // Retention from the mirror write, in years
+	LegalHold bool   `json:"legalHold"` // Also place a legal hold
+}
+
+type objectLockConfig struct {
+	Rules []*objectLockRule `json:"rules"`
+}
+
+// Rules in order, the first matching one applies. Mirror targets may have
+// their own.
+var objectLockRules []*objectLockRule
+
+var errObjectLockDisabled = errors.New("object lock is not enabled")
+
+func loadObjectLockConfig() {
+	configPath := getEnv("MIRROR_OBJECT_LOCK_CONFIG")
+	if configPath == "" {
+		return
+	}
+
+	var config objectLockConfig
+	if err := loadConfigFile(configPath, &config); err != nil {
+		log.Fatalf("Failed to load MIRROR_OBJECT_LOCK_CONFIG: %v", err)
+	}
+
+	for i, rule := range config.Rules {
+		if err := rule.validate(); err != nil {
+			log.Fatalf("Object lock rule %d: %v", i+1, err)
+		}
+	}
+	objectLockRules = config.Rules
+	log.Infof("Loaded %d mirror object lock rules", len(objectLockRules))
+}
+
+func (r *objectLockRule) validate() error {
+	if _, err := path.Match(r.Bucket, ""); err != nil {
+		return fmt.Errorf("invalid bucket pattern %q: %w", r.Bucket, err)
+	}
+	if r.Days < 0 || r.Years < 0 {
+		return fmt.Errorf("days and years must not be negative")
+	}
+	switch r.Mode {
+	case "GOVERNANCE", "COMPLIANCE":
+		if (r.Days > 0) == (r.Years > 0) {
+			return fmt.Errorf("%s mode requires one of days or years", r.Mode)
+		}
+	case "":
+		if r.Days > 0 || r.Years > 0 {
+			return fmt.Errorf("days and years require a mode")
+		}
+		if !r.LegalHold {
+			return fmt.Errorf("a rule needs a mode, a legal hold or both")
+		}
+	default:
+		return fmt.Errorf("invalid mode %q, expected GOVERNANCE or COMPLIANCE", r.Mode)
+	}
+	return nil
+}
+
+// matchObjectLockRule returns the first rule matching a bucket (as seen by
+// clients), nil when copies keep the headers of the client
+func matchObjectLockRule(rules []*objectLockRule, bucket string) *objectLockRule {
+	for _, rule := range rules {
+		if rule.Bucket == "" {
+			return rule
+		}
+		if ok, _ := path.Match(rule.Bucket, bucket); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// setHeaders replaces the Object Lock headers of a mirror write with those
+// of the rule, retention starts at the write
+func (r *objectLockRule) setHeaders(headers http.Header, at time.Time) {
+	headers.Del(objectLockModeHeader)
+	headers.Del(objectLockRetainUntilHeader)
+	headers.Del(objectLockLegalHoldHeader)
+
+	if r.Mode != "" {
+		headers.Set(objectLockModeHeader, r.Mode)
+		headers.Set(objectLockRetainUntilHeader, at.AddDate(r.Years, 0, r.Days).UTC().Format(time.RFC3339))
+	}
+	if r.LegalHold {
+		headers.Set(objectLockLegalHoldHeader, "ON")
+	}
+}
+
+// lockMirrorWrite returns the headers of a locked upload, S3 requires an MD5
+// of the body sent with a retention
+func (r *objectLockRule) lockMirrorWrite(headers http.Header, body []byte, at time.Time) http.Header {
+	locked := make(http.Header, len(headers)+4)
+	for k, v := range headers {
+		if !strings.HasPrefix(k, "X-Amz-Checksum-") && k != "X-Amz-Sdk-Checksum-Algorithm" {
+			locked[k] = v
+		}
+	}
+	r.setHeaders(locked, at)
+	sum := md5.Sum(body)
+	locked.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	return locked
+}
+
+// objectLockBuckets caches the mirror buckets found with Object Lock enabled
+type objectLockBuckets struct {
+	enabled map[string]bool
+	mutex   sync.Mutex
+}
+
+// checkObjectLock fails unless a mirror bucket of the target has Object Lock
+// enabled, so copies are never silently written unlocked. Buckets without it
+// are checked again on every write since it can be enabled later.
+func (t *mirrorTarget) checkObjectLock(mirrorBucket string) error {
+	t.lockedBuckets.mutex.Lock()
+	enabled := t.lockedBuckets.enabled[mirrorBucket]
+	t.lockedBuckets.mutex.Unlock()
+	if enabled {
+		return nil
+	}
+
+	resp, err := t.send("GET", mirrorBucket, "", url.Values{"object-lock": {""}}, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read the object lock configuration of %s: %w", mirrorBucket, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w on mirror bucket %s of %s", errObjectLockDisabled, mirrorBucket, t.Name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to read the object lock configuration of %s: status %d: %s", mirrorBucket, resp.StatusCode, body)
+	}
+
+	var config struct {
+		ObjectLockEnabled string `xml:"ObjectLockEnabled"`
+	}
+	if err := xml.Unmarshal(body, &config); err != nil {
+		return fmt.Errorf("invalid object lock configuration of %s: %w", mirrorBucket, err)
+	}
+	if config.ObjectLockEnabled != "Enabled" {
+		return fmt.Errorf("%w on mirror bucket %s of %s", errObjectLockDisabled, mirrorBucket, t.Name)
+	}
+
+	t.lockedBuckets.mutex.Lock()
+	if t.lockedBuckets.enabled == nil {
+		t.lockedBuckets.enabled = make(map[string]bool)
+	}
+	t.lockedBuckets.enabled[mirrorBucket] = true
+	t.lockedBuckets.mutex.Unlock()
+	return nil
+}
+
+// verifyObjectLockBuckets checks the mirror buckets of rules naming a bucket
+// at startup, exiting when one has Object Lock disabled or is on a filesystem
+// target. Glob patterns and rule destinations are checked on their first write.
+func verifyObjectLockBuckets() {
+	for _, target := range mirrorTargets {
+		if target.Type == mirrorTargetFilesystem && len(target.objectLockRules()) > 0 {
+			log.Fatalf("Mirror target %s is a filesystem and can't lock copies, set its objectLock to []", target.Name)
+		}
+		for _, rule := range target.objectLockRules() {
+			if rule.Bucket == "" || strings.ContainsAny(rule.Bucket, `*?[\`) || !target.applies(rule.Bucket) {
+				continue
+			}
+			mirrorBucket := target.bucketName(rule.Bucket)
+			err := target.checkObjectLock(mirrorBucket)
+			if errors.Is(err, errObjectLockDisabled) {
+				log.Fatal(err)
+			}
+			if err != nil {
+				log.Warnf("Object lock of %s will be checked on the first write: %v", mirrorBucket, err)
+				continue
+			}
+			log.Infof("Object lock enabled on mirror bucket %s of %s", mirrorBucket, target.Name)
+		}
+	}
+}
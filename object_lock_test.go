@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestObjectLockDisabledFailure(t *testing.T) {
+	writes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			writes++
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	t.Setenv("MIRROR_LOCKED_ACCESS_KEY", "access")
+	t.Setenv("MIRROR_LOCKED_SECRET_KEY", "secret")
+	target := &mirrorTarget{
+		Name:            "locked",
+		Endpoint:        server.URL,
+		AddressingStyle: addressingStylePath,
+		ObjectLock:      []*objectLockRule{{Mode: "COMPLIANCE", Days: 1}},
+	}
+	if err := target.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retries of a write or a copy never reach the bucket unlocked
+	for i := 0; i < 2; i++ {
+		err := target.store.putObject("bucket", "mirror", "a", []byte("a"), http.Header{}, upstreamCredentials{}, false)
+		if !errors.Is(err, errObjectLockDisabled) {
+			t.Errorf("putObject = %v, want errObjectLockDisabled", err)
+		}
+	}
+	if err := target.store.copyObject("bucket", "mirror", "a", "a", nil); !errors.Is(err, errObjectLockDisabled) {
+		t.Errorf("copyObject = %v, want errObjectLockDisabled", err)
+	}
+	if writes != 0 {
+		t.Errorf("%d writes sent to a bucket without Object Lock", writes)
+	}
+
+	// The failure is recorded apart from transient ones
+	store := withInventory(t)
+	store.UpsertObject("bucket", ObjectRecord{Key: "a"})
+	store.UpsertObject("bucket", ObjectRecord{Key: "b"})
+	recordMirrorCopy(target, "bucket", "a", "", target.store.putObject("bucket", "mirror", "a", nil, http.Header{}, upstreamCredentials{}, false))
+	recordMirrorCopy(target, "bucket", "b", "", errors.New("connection reset"))
+
+	for key, want := range map[string]string{"a": mirrorStatusLockFailed, "b": mirrorStatusFailed} {
+		rec, err := store.GetObject("bucket", key)
+		if err != nil || rec == nil {
+			t.Fatalf("GetObject(%s) = %v, %v", key, rec, err)
+		}
+		if rec.MirrorStatus["locked"] != want || !rec.hasMirrorFailure() || rec.IsBackedUp {
+			t.Errorf("%s mirror status = %v, want %s", key, rec.MirrorStatus, want)
+		}
+	}
+}
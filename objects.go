@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Largest object main assembles (copies, multipart uploads) that is
+// downloaded in memory to be mirrored, 0 for no limit
+var mirrorMaxAssembledSize int64
+
+func loadAssembledObjectConfig() {
+	size, err := strconv.ParseInt(getEnvOrDefault("MIRROR_MAX_ASSEMBLED_SIZE", "536870912"), 10, 64)
+	if err != nil || size < 0 {
+		log.Fatalf("Invalid MIRROR_MAX_ASSEMBLED_SIZE: %v", err)
+	}
+	mirrorMaxAssembledSize = size
+}
+
+// assembledObjectTooLargeError is returned for an object main assembled that
+// is larger than MIRROR_MAX_ASSEMBLED_SIZE
+type assembledObjectTooLargeError struct {
+	bucket, key string
+	size        int64
+	contentType string
+}
+
+func (e *assembledObjectTooLargeError) Error() string {
+	return fmt.Sprintf("%s/%s is larger than MIRROR_MAX_ASSEMBLED_SIZE (%d bytes), it is not mirrored", e.bucket, e.key, mirrorMaxAssembledSize)
+}
+
+// Kinds of requests that create or replace an object
+const (
+	writeNone              = iota // Not an object write (subresource, multipart part, ...)
+	writePut                      // PutObject, the body is the object
+	writeCopy                     // CopyObject, the object is built by main
+	writeCompleteMultipart        // CompleteMultipartUpload, the object is built by main
+)
+
+// objectWriteKind classifies a PUT/POST on an object key
+func objectWriteKind(req *http.Request) int {
+	query := req.URL.Query()
+	switch req.Method {
+	case "PUT":
+		// Subresources (?tagging, ?acl, ...) and UploadPart (?partNumber&uploadId)
+		for k := range query {
+			if k != "x-id" {
+				return writeNone
+			}
+		}
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			return writeCopy
+		}
+		return writePut
+	case "POST":
+		if query.Has("uploadId") {
+			return writeCompleteMultipart
+		}
+	}
+	return writeNone
+}
+
+// putObjectSize returns the size of the object stored by a PutObject
+func putObjectSize(req *http.Request, body []byte) int64 {
+	// aws-chunked uploads carry the real size separately
+	if decoded := req.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+		if size, err := strconv.ParseInt(decoded, 10, 64); err == nil {
+			return size
+		}
+	}
+	return int64(len(body))
+}
+
+// isPostObjectUpload tells if a POST on a bucket is a browser-based upload
+func isPostObjectUpload(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// postObjectForm is the object a browser-based upload stores
+type postObjectForm struct {
+	key    string
+	fields http.Header
+	file   []byte
+}
+
+// parsePostObjectForm reads a browser-based upload, ${filename} in the key is
+// the name of the uploaded file
+func parsePostObjectForm(req *http.Request, body []byte) (*postObjectForm, error) {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	form := &postObjectForm{fields: make(http.Header)}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("upload form has no file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(part.FormName(), "file") {
+			// The file is the last field, later ones are ignored by S3
+			if form.file, err = io.ReadAll(part); err != nil {
+				return nil, err
+			}
+			key := form.fields.Get("Key")
+			if key == "" {
+				return nil, fmt.Errorf("upload form has no key")
+			}
+			form.key = strings.ReplaceAll(key, "${filename}", part.FileName())
+			return form, nil
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		form.fields.Set(part.FormName(), string(value))
+	}
+}
+
+// postObjectUpload returns the key and size of the object a browser-based
+// upload stores
+func postObjectUpload(req *http.Request, body []byte) (string, int64, error) {
+	form, err := parsePostObjectForm(req, body)
+	if err != nil {
+		return "", 0, err
+	}
+	return form.key, int64(len(form.file)), nil
+}
+
+// Form fields of a browser-based upload that authenticate it rather than
+// describe the object
+var postObjectAuthFields = map[string]bool{
+	"X-Amz-Algorithm":      true,
+	"X-Amz-Credential":     true,
+	"X-Amz-Signature":      true,
+	"X-Amz-Security-Token": true,
+}
+
+// postObjectAsPut returns the key, PutObject request and body equivalent to a
+// browser-based upload, so it is recorded and mirrored like one
+func postObjectAsPut(req *http.Request, body []byte, clientVirtualHosted bool) (string, *http.Request, []byte, error) {
+	form, err := parsePostObjectForm(req, body)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	put := req.Clone(req.Context())
+	put.Method = "PUT"
+	put.URL.RawQuery = ""
+	if clientVirtualHosted {
+		put.URL.Path = "/" + form.key
+	} else {
+		put.URL.Path = strings.TrimSuffix(req.URL.Path, "/") + "/" + form.key
+	}
+	put.Header = make(http.Header)
+	for name, values := range form.fields {
+		if postObjectAuthFields[name] {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name, "Content-"), strings.HasPrefix(name, "X-Amz-"),
+			name == "Cache-Control", name == "Expires":
+			put.Header[name] = values
+		}
+	}
+	put.Header.Set("Content-Length", strconv.Itoa(len(form.file)))
+	put.ContentLength = int64(len(form.file))
+	return form.key, put, form.file, nil
+}
+
+// completeMultipartUpload is the body of a CompleteMultipartUpload request
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int `xml:"PartNumber"`
+	} `xml:"Part"`
+}
+
+// listPartsResult is a page of a ListParts response
+type listPartsResult struct {
+	Parts []struct {
+		PartNumber int   `xml:"PartNumber"`
+		Size       int64 `xml:"Size"`
+	} `xml:"Part"`
+	IsTruncated          bool   `xml:"IsTruncated"`
+	NextPartNumberMarker string `xml:"NextPartNumberMarker"`
+}
+
+// listMainParts returns the size of every part of a multipart upload on main
+func listMainParts(backend *mainBackend, bucket, key, uploadID string, creds upstreamCredentials) (map[int]int64, error) {
+	isVirtualHosted := backend.virtualHosted(bucket, false)
+	sizes := make(map[int]int64)
+	marker := ""
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		listURL := backend.requestURL(bucket, "/"+key, isVirtualHosted)
+		listURL.RawQuery = canonicalClientQuery(query.Encode())
+		req, err := http.NewRequest("GET", listURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := backend.send(req, creds, nil, bucket, isVirtualHosted)
+		if err != nil {
+			return nil, err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("ListParts of %s/%s on main failed with status %d", bucket, key, resp.StatusCode)
+		}
+
+		var page listPartsResult
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			sizes[part.PartNumber] = part.Size
+		}
+		if !page.IsTruncated || page.NextPartNumberMarker == "" {
+			return sizes, nil
+		}
+		marker = page.NextPartNumberMarker
+	}
+}
+
+// deleteObjectsRequest is the body of a DeleteObjects (POST /?delete) request
+type deleteObjectsRequest struct {
+	Objects []struct {
+		Key       string `xml:"Key"`
+		VersionID string `xml:"VersionId"`
+	} `xml:"Object"`
+}
+
+// deleteObjectsResult is the body of a DeleteObjects response
+type deleteObjectsResult struct {
+	Deleted []struct {
+		Key string `xml:"Key"`
+	} `xml:"Deleted"`
+	Errors []struct {
+		Key string `xml:"Key"`
+	} `xml:"Error"`
+}
+
+// deletedObjectKeys returns the current-version keys removed by a DeleteObjects
+// request. Quiet mode only reports errors so every requested key that did not
+// fail is considered deleted.
+func deletedObjectKeys(reqBody, respBody []byte) ([]string, error) {
+	var request deleteObjectsRequest
+	if err := xml.Unmarshal(reqBody, &request); err != nil {
+		return nil, fmt.Errorf("invalid DeleteObjects request: %w", err)
+	}
+
+	var result deleteObjectsResult
+	if err := xml.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("invalid DeleteObjects response: %w", err)
+	}
+
+	failed := make(map[string]bool)
+	for _, e := range result.Errors {
+		failed[e.Key] = true
+	}
+
+	var keys []string
+	for _, obj := range request.Objects {
+		// Deleting a specific version leaves the current object in place
+		if obj.VersionID != "" || failed[obj.Key] {
+			continue
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+// headMainObject fetches the headers of an object from main, SSE-C key
+// headers from the original request are passed along
+func headMainObject(bucket, key string, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) (*http.Response, error) {
+	resp, _, err := fetchMainObject("HEAD", bucket, key, headers, creds, clientVirtualHosted)
+	return resp, err
+}
+
+// getMainObject downloads an object from main, used to mirror the objects
+// main assembles itself (copies and multipart uploads). Objects larger than
+// MIRROR_MAX_ASSEMBLED_SIZE fail with an assembledObjectTooLargeError.
+func getMainObject(bucket, key string, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) (*http.Response, []byte, error) {
+	return fetchMainObject("GET", bucket, key, headers, creds, clientVirtualHosted)
+}
+
+func fetchMainObject(method, bucket, key string, headers http.Header, creds upstreamCredentials, clientVirtualHosted bool) (*http.Response, []byte, error) {
+	backend := mainBackendFor(bucket)
+	if backend == nil {
+		return nil, nil, fmt.Errorf("no main backend holds bucket %s", bucket)
+	}
+	isVirtualHosted := backend.virtualHosted(bucket, clientVirtualHosted)
+	objectURL := backend.requestURL(bucket, "/"+key, isVirtualHosted)
+
+	req, err := http.NewRequest(method, objectURL.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range headers {
+		if strings.HasPrefix(k, "X-Amz-Server-Side-Encryption-Customer-") {
+			req.Header[k] = v
+		}
+	}
+
+	resp, err := backend.send(req, creds, nil, bucket, isVirtualHosted)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	// Refuse large objects before reading them, or once past the limit
+	// without a Content-Length
+	if method == "GET" && resp.StatusCode == http.StatusOK && mirrorMaxAssembledSize > 0 && resp.ContentLength > mirrorMaxAssembledSize {
+		return nil, nil, &assembledObjectTooLargeError{bucket, key, resp.ContentLength, resp.Header.Get("Content-Type")}
+	}
+	reader := io.Reader(resp.Body)
+	if method == "GET" && mirrorMaxAssembledSize > 0 {
+		reader = io.LimitReader(resp.Body, mirrorMaxAssembledSize+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if method == "GET" && resp.StatusCode == http.StatusOK && mirrorMaxAssembledSize > 0 && int64(len(body)) > mirrorMaxAssembledSize {
+		return nil, nil, &assembledObjectTooLargeError{bucket, key, int64(len(body)), resp.Header.Get("Content-Type")}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s %s/%s on main failed with status %d", method, bucket, key, resp.StatusCode)
+	}
+	return resp, body, nil
+}
+
+// mainObjectHeaders returns the headers recreating an object downloaded from
+// main: content headers, user metadata, storage class and encryption
+func mainObjectHeaders(object, request http.Header) http.Header {
+	headers := make(http.Header)
+	for k, v := range object {
+		switch {
+		case k == "Content-Type" || k == "Content-Encoding" || k == "Content-Disposition" || k == "Content-Language",
+			k == "Cache-Control" || k == "Expires",
+			strings.HasPrefix(k, "X-Amz-Meta-"), strings.HasPrefix(k, sseHeader),
+			k == "X-Amz-Storage-Class", k == "X-Amz-Website-Redirect-Location":
+			headers[k] = v
+		}
+	}
+	// Responses never include the SSE-C key itself
+	for _, k := range []string{sseCustomerKey, sseCustomerKeyMD5} {
+		if v := request.Get(k); v != "" {
+			headers.Set(k, v)
+		}
+	}
+	return headers
+}
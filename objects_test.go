@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestPostObjectAsPut(t *testing.T) {
+	req, body := postUploadRequest(t, map[string]string{
+		"key":                   "uploads/${filename}",
+		"Content-Type":          "image/jpeg",
+		"cache-control":         "max-age=60",
+		"x-amz-meta-owner":      "alice",
+		"x-amz-storage-class":   "STANDARD_IA",
+		"x-amz-credential":      "AKID/20240101/us-east-1/s3/aws4_request",
+		"x-amz-signature":       "abcdef",
+		"policy":                "eyJ9",
+		"success_action_status": "201",
+	}, []byte("jpeg"))
+
+	key, put, file, err := postObjectAsPut(req, body, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "uploads/photo.jpg" || string(file) != "jpeg" {
+		t.Errorf("postObjectAsPut = %q, %q, want uploads/photo.jpg, jpeg", key, file)
+	}
+	if put.Method != "PUT" || put.URL.Path != "/bucket/uploads/photo.jpg" || objectWriteKind(put) != writePut {
+		t.Errorf("request = %s %s, want a PutObject of /bucket/uploads/photo.jpg", put.Method, put.URL.Path)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":        "image/jpeg",
+		"Content-Length":      "4",
+		"Cache-Control":       "max-age=60",
+		"X-Amz-Meta-Owner":    "alice",
+		"X-Amz-Storage-Class": "STANDARD_IA",
+		"X-Amz-Credential":    "",
+		"X-Amz-Signature":     "",
+		"Policy":              "",
+	} {
+		if got := put.Header.Get(name); got != want {
+			t.Errorf("header %s = %q, want %q", name, got, want)
+		}
+	}
+
+	// Virtual-hosted requests have no bucket in their path
+	if _, put, _, _ = postObjectAsPut(req, body, true); put.URL.Path != "/uploads/photo.jpg" {
+		t.Errorf("virtual-hosted path = %s, want /uploads/photo.jpg", put.URL.Path)
+	}
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// policyDocument is an identity policy written in the AWS IAM JSON grammar
+type policyDocument struct {
+	Version   string           `json:"Version"`
+	Statement policyStatements `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid         string                              `json:"Sid"`
+	Effect      string                              `json:"Effect"`
+	Principal   json.RawMessage                     `json:"Principal"` // Ignored, policies are attached to clients
+	Action      policyStrings                       `json:"Action"`
+	NotAction   policyStrings                       `json:"NotAction"`
+	Resource    policyStrings                       `json:"Resource"`
+	NotResource policyStrings                       `json:"NotResource"`
+	Condition   map[string]map[string]policyStrings `json:"Condition"`
+}
+
+// policyStatements accepts a single statement or a list
+type policyStatements []*policyStatement
+
+func (s *policyStatements) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var statement policyStatement
+		if err := json.Unmarshal(data, &statement); err != nil {
+			return err
+		}
+		*s = policyStatements{&statement}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]*policyStatement)(s))
+}
+
+// policyStrings accepts a single value or a list, numbers and booleans are
+// kept as strings like IAM does
+type policyStrings []string
+
+func (s *policyStrings) UnmarshalJSON(data []byte) error {
+	var values []interface{}
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+	} else {
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		values = []interface{}{value}
+	}
+
+	*s = make(policyStrings, 0, len(values))
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			*s = append(*s, v)
+		case bool:
+			*s = append(*s, strconv.FormatBool(v))
+		case float64:
+			*s = append(*s, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			return fmt.Errorf("unsupported policy value %v", v)
+		}
+	}
+	return nil
+}
+
+// Condition operators, without their IfExists suffix and set prefixes
+var policyConditionOperators = map[string]bool{
+	"StringEquals": true, "StringNotEquals": true, "StringEqualsIgnoreCase": true, "StringNotEqualsIgnoreCase": true,
+	"StringLike": true, "StringNotLike": true,
+	"NumericEquals": true, "NumericNotEquals": true, "NumericLessThan": true, "NumericLessThanEquals": true,
+	"NumericGreaterThan": true, "NumericGreaterThanEquals": true,
+	"DateEquals": true, "DateNotEquals": true, "DateLessThan": true, "DateLessThanEquals": true,
+	"DateGreaterThan": true, "DateGreaterThanEquals": true,
+	"Bool": true, "IpAddress": true, "NotIpAddress": true, "Null": true,
+}
+
+// Whether requests forwarded by an ingress are attributed to the first
+// address of X-Forwarded-For
+var trustForwardedFor bool
+
+func loadPolicyFile(path string) (*policyDocument, error) {
+	var policy policyDocument
+	if err := loadConfigFile(path, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, policy.validate()
+}
+
+func (p *policyDocument) validate() error {
+	if len(p.Statement) == 0 {
+		return fmt.Errorf("policy has no statement")
+	}
+	for i, st := range p.Statement {
+		name := st.Sid
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if st.Effect != "Allow" && st.Effect != "Deny" {
+			return fmt.Errorf("statement %s: Effect must be Allow or Deny", name)
+		}
+		if (len(st.Action) == 0) == (len(st.NotAction) == 0) {
+			return fmt.Errorf("statement %s: exactly one of Action and NotAction is required", name)
+		}
+		if (len(st.Resource) == 0) == (len(st.NotResource) == 0) {
+			return fmt.Errorf("statement %s: exactly one of Resource and NotResource is required", name)
+		}
+		for operator, conditions := range st.Condition {
+			base, _, _ := parseConditionOperator(operator)
+			if !policyConditionOperators[base] {
+				return fmt.Errorf("statement %s: unsupported condition operator %s", name, operator)
+			}
+			if base == "IpAddress" || base == "NotIpAddress" {
+				for _, values := range conditions {
+					for _, v := range values {
+						if parseCIDR(v) == nil {
+							return fmt.Errorf("statement %s: invalid IP address %q", name, v)
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseConditionOperator splits "ForAllValues:StringLikeIfExists" into its
+// base operator, set qualifier and IfExists flag
+func parseConditionOperator(operator string) (base, set string, ifExists bool) {
+	if i := strings.Index(operator, ":"); i >= 0 {
+		set, operator = operator[:i], operator[i+1:]
+	}
+	if operator != "Null" && strings.HasSuffix(operator, "IfExists") {
+		operator, ifExists = strings.TrimSuffix(operator, "IfExists"), true
+	}
+	return operator, set, ifExists
+}
+
+// policyRequest is one action on one resource checked against the policies
+type policyRequest struct {
+	action   string
+	resource string
+	context  map[string][]string // Condition keys (lowercase) and their values
+}
+
+// authorizePolicies evaluates the client's policies for every action a request
+// performs, copies also read their source and DeleteObjects deletes each key
+func authorizePolicies(req *http.Request, identity *clientCredential, bucket, key string, body []byte) (bool, string) {
+	context := policyContext(req, identity)
+	action := s3Action(req, bucket, key)
+	if action == "" {
+		return false, req.Method + " is not supported on this subresource"
+	}
+	requests := []policyRequest{{action, s3Resource(bucket, key), context}}
+
+	if copySource := req.Header.Get("X-Amz-Copy-Source"); copySource != "" && key != "" {
+		source, err := url.PathUnescape(strings.SplitN(copySource, "?", 2)[0])
+		if err != nil {
+			return false, "invalid copy source"
+		}
+		parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+		if len(parts) != 2 {
+			return false, "invalid copy source"
+		}
+		requests = append(requests, policyRequest{"s3:GetObject", s3Resource(parts[0], parts[1]), context})
+	}
+
+	if action == "s3:DeleteObject" && key == "" {
+		var deletes deleteObjectsRequest
+		if err := xml.Unmarshal(body, &deletes); err != nil {
+			return false, "invalid DeleteObjects body"
+		}
+		requests = requests[:0]
+		for _, obj := range deletes.Objects {
+			deleteAction := "s3:DeleteObject"
+			if obj.VersionID != "" {
+				deleteAction = "s3:DeleteObjectVersion"
+			}
+			requests = append(requests, policyRequest{deleteAction, s3Resource(bucket, obj.Key), context})
+		}
+	}
+
+	for _, r := range requests {
+		if allowed, reason := evaluatePolicies(identity, r); !allowed {
+			return false, fmt.Sprintf("%s on %s: %s", r.action, r.resource, reason)
+		}
+	}
+	return true, ""
+}
+
+// evaluatePolicies applies the IAM logic: an explicit deny wins over any
+// allow, and anything not explicitly allowed is denied
+func evaluatePolicies(identity *clientCredential, r policyRequest) (bool, string) {
+	allowedBy := ""
+	for i, policy := range identity.policies {
+		for j, st := range policy.Statement {
+			name := st.Sid
+			if name == "" {
+				name = fmt.Sprintf("policy %d statement %d", i+1, j+1)
+			}
+
+			matched, why := st.matches(r)
+			log.Debugf("Policy trace for %s, %s on %s: %s %s %s", identity.Name, r.action, r.resource, st.Effect, name, why)
+			if !matched {
+				continue
+			}
+			if st.Effect == "Deny" {
+				return false, "explicitly denied by " + name
+			}
+			if allowedBy == "" {
+				allowedBy = name
+			}
+		}
+	}
+
+	if allowedBy == "" {
+		return false, "no statement allows it"
+	}
+	return true, "allowed by " + allowedBy
+}
+
+// matches tells if a statement applies to a request, with a trace of why
+func (st *policyStatement) matches(r policyRequest) (bool, string) {
+	if len(st.Action) > 0 && !matchAny(st.Action, r.action, true, nil) {
+		return false, "skipped (action)"
+	}
+	if len(st.NotAction) > 0 && matchAny(st.NotAction, r.action, true, nil) {
+		return false, "skipped (NotAction)"
+	}
+	if len(st.Resource) > 0 && !matchAny(st.Resource, r.resource, false, r.context) {
+		return false, "skipped (resource)"
+	}
+	if len(st.NotResource) > 0 && matchAny(st.NotResource, r.resource, false, r.context) {
+		return false, "skipped (NotResource)"
+	}
+	for operator, conditions := range st.Condition {
+		for key, values := range conditions {
+			if !evaluateCondition(operator, r.context[strings.ToLower(key)], values, r.context) {
+				return false, fmt.Sprintf("skipped (condition %s %s)", operator, key)
+			}
+		}
+	}
+	return true, "matched"
+}
+
+func matchAny(patterns []string, value string, ignoreCase bool, context map[string][]string) bool {
+	if ignoreCase {
+		value = strings.ToLower(value)
+	}
+	for _, pattern := range patterns {
+		pattern, ok := substitutePolicyVariables(pattern, context)
+		if !ok {
+			continue
+		}
+		if ignoreCase {
+			pattern = strings.ToLower(pattern)
+		}
+		if wildcardMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+var policyVariablePattern = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// substitutePolicyVariables replaces ${aws:username} style variables, a
+// pattern using an unknown variable never matches
+func substitutePolicyVariables(pattern string, context map[string][]string) (string, bool) {
+	if context == nil || !strings.Contains(pattern, "${") {
+		return pattern, true
+	}
+	ok := true
+	result := policyVariablePattern.ReplaceAllStringFunc(pattern, func(v string) string {
+		name := v[2 : len(v)-1]
+		switch name {
+		case "*", "?", "$":
+			// Escaped special characters
+			return name
+		}
+		values := context[strings.ToLower(name)]
+		if len(values) == 0 {
+			ok = false
+			return ""
+		}
+		return values[0]
+	})
+	return result, ok
+}
+
+// wildcardMatch matches IAM patterns where * matches any sequence and ? any character
+func wildcardMatch(pattern, value string) bool {
+	p, v := 0, 0
+	star, mark := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]):
+			p++
+			v++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, v
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			v = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// evaluateCondition checks one condition key. Values of a key are ORed,
+// negated operators match when no value matches.
+func evaluateCondition(operator string, requestValues, policyValues []string, context map[string][]string) bool {
+	base, set, ifExists := parseConditionOperator(operator)
+
+	if base == "Null" {
+		absent := len(requestValues) == 0
+		for _, v := range policyValues {
+			if strings.EqualFold(v, strconv.FormatBool(absent)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	negated := strings.Contains(base, "Not")
+	if len(requestValues) == 0 {
+		return ifExists || negated || set == "ForAllValues"
+	}
+
+	matchesValue := func(requestValue string) bool {
+		for _, policyValue := range policyValues {
+			policyValue, ok := substitutePolicyVariables(policyValue, context)
+			if ok && conditionMatches(base, requestValue, policyValue) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if set == "ForAllValues" {
+		for _, v := range requestValues {
+			if matchesValue(v) == negated {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, v := range requestValues {
+		if matchesValue(v) {
+			return !negated
+		}
+	}
+	return negated
+}
+
+// conditionMatches compares one request value to one policy value, negated
+// operators are compared like their positive counterpart
+func conditionMatches(operator, requestValue, policyValue string) bool {
+	switch operator {
+	case "StringEquals", "StringNotEquals":
+		return requestValue == policyValue
+	case "StringEqualsIgnoreCase", "StringNotEqualsIgnoreCase":
+		return strings.EqualFold(requestValue, policyValue)
+	case "StringLike", "StringNotLike":
+		return wildcardMatch(policyValue, requestValue)
+	case "Bool":
+		return strings.EqualFold(requestValue, policyValue)
+	case "IpAddress", "NotIpAddress":
+		ip := net.ParseIP(requestValue)
+		network := parseCIDR(policyValue)
+		return ip != nil && network != nil && network.Contains(ip)
+	}
+
+	if strings.HasPrefix(operator, "Numeric") {
+		a, errA := strconv.ParseFloat(requestValue, 64)
+		b, errB := strconv.ParseFloat(policyValue, 64)
+		if errA != nil || errB != nil {
+			return false
+		}
+		return compareOrdered(strings.TrimPrefix(operator, "Numeric"), a, b)
+	}
+
+	if strings.HasPrefix(operator, "Date") {
+		a, okA := parsePolicyDate(requestValue)
+		b, okB := parsePolicyDate(policyValue)
+		if !okA || !okB {
+			return false
+		}
+		return compareOrdered(strings.TrimPrefix(operator, "Date"), float64(a.UnixNano()), float64(b.UnixNano()))
+	}
+	return false
+}
+
+func compareOrdered(comparison string, a, b float64) bool {
+	switch comparison {
+	case "Equals", "NotEquals":
+		return a == b
+	case "LessThan":
+		return a < b
+	case "LessThanEquals":
+		return a <= b
+	case "GreaterThan":
+		return a > b
+	case "GreaterThanEquals":
+		return a >= b
+	}
+	return false
+}
+
+// parsePolicyDate accepts ISO 8601 dates and epoch seconds
+func parsePolicyDate(value string) (time.Time, bool) {
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(epoch, 0), true
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseCIDR accepts a network or a single address
+func parseCIDR(value string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// policyContext collects the condition keys of a request
+func policyContext(req *http.Request, identity *clientCredential) map[string][]string {
+	now := time.Now().UTC()
+	context := map[string][]string{
+		"aws:username":        {identity.Name},
+		"aws:userid":          {identity.AccessKey},
+		"aws:currenttime":     {now.Format(time.RFC3339)},
+		"aws:epochtime":       {strconv.FormatInt(now.Unix(), 10)},
+		"aws:securetransport": {strconv.FormatBool(requestIsSecure(req))},
+		"s3:signatureversion": {"AWS4-HMAC-SHA256"},
+	}
+	if ip := requestSourceIP(req); ip != "" {
+		context["aws:sourceip"] = []string{ip}
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		context["aws:useragent"] = []string{ua}
+	}
+	if req.URL.Query().Has("X-Amz-Signature") {
+		context["s3:authtype"] = []string{"REST-QUERY-STRING"}
+	} else {
+		context["s3:authtype"] = []string{"REST-HEADER"}
+	}
+
+	// Listing parameters and the version being accessed
+	query := req.URL.Query()
+	for param, key := range map[string]string{"prefix": "s3:prefix", "delimiter": "s3:delimiter", "max-keys": "s3:max-keys", "versionId": "s3:versionid"} {
+		if query.Has(param) {
+			context[key] = []string{query.Get(param)}
+		}
+	}
+
+	// Request headers such as s3:x-amz-server-side-encryption or s3:x-amz-acl
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") && lower != "x-amz-date" && lower != "x-amz-content-sha256" {
+			context["s3:"+lower] = values
+		}
+	}
+	return context
+}
+
+// requestSourceIP returns the client address, taken from X-Forwarded-For
+// when the proxy sits behind a trusted ingress
+func requestSourceIP(req *http.Request) string {
+	if trustForwardedFor {
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func requestIsSecure(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+	return trustForwardedFor && strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// s3Resource returns the ARN of a bucket or object
+func s3Resource(bucket, key string) string {
+	switch {
+	case bucket == "":
+		return "arn:aws:s3:::*"
+	case key == "":
+		return "arn:aws:s3:::" + bucket
+	}
+	return "arn:aws:s3:::" + bucket + "/" + key
+}
+
+// subresourceActions are the actions reading (GET) and writing (PUT, DELETE)
+// a subresource, an empty action is a method the subresource does not support
+type subresourceActions struct {
+	name    string
+	actions [3]string
+}
+
+// Bucket subresources in matching order
+var bucketSubresourceActions = []subresourceActions{
+	{"acl", [3]string{"s3:GetBucketAcl", "s3:PutBucketAcl", ""}},
+	{"policy", [3]string{"s3:GetBucketPolicy", "s3:PutBucketPolicy", "s3:DeleteBucketPolicy"}},
+	{"policyStatus", [3]string{"s3:GetBucketPolicyStatus", "", ""}},
+	{"cors", [3]string{"s3:GetBucketCORS", "s3:PutBucketCORS", "s3:PutBucketCORS"}},
+	{"lifecycle", [3]string{"s3:GetLifecycleConfiguration", "s3:PutLifecycleConfiguration", "s3:PutLifecycleConfiguration"}},
+	{"tagging", [3]string{"s3:GetBucketTagging", "s3:PutBucketTagging", "s3:PutBucketTagging"}},
+	{"versioning", [3]string{"s3:GetBucketVersioning", "s3:PutBucketVersioning", ""}},
+	{"website", [3]string{"s3:GetBucketWebsite", "s3:PutBucketWebsite", "s3:DeleteBucketWebsite"}},
+	{"logging", [3]string{"s3:GetBucketLogging", "s3:PutBucketLogging", ""}},
+	{"notification", [3]string{"s3:GetBucketNotification", "s3:PutBucketNotification", ""}},
+	{"encryption", [3]string{"s3:GetEncryptionConfiguration", "s3:PutEncryptionConfiguration", "s3:PutEncryptionConfiguration"}},
+	{"replication", [3]string{"s3:GetReplicationConfiguration", "s3:PutReplicationConfiguration", "s3:PutReplicationConfiguration"}},
+	{"object-lock", [3]string{"s3:GetBucketObjectLockConfiguration", "s3:PutBucketObjectLockConfiguration", ""}},
+	{"publicAccessBlock", [3]string{"s3:GetBucketPublicAccessBlock", "s3:PutBucketPublicAccessBlock", "s3:PutBucketPublicAccessBlock"}},
+	{"ownershipControls", [3]string{"s3:GetBucketOwnershipControls", "s3:PutBucketOwnershipControls", "s3:PutBucketOwnershipControls"}},
+	{"requestPayment", [3]string{"s3:GetBucketRequestPayment", "s3:PutBucketRequestPayment", ""}},
+	{"accelerate", [3]string{"s3:GetAccelerateConfiguration", "s3:PutAccelerateConfiguration", ""}},
+	{"location", [3]string{"s3:GetBucketLocation", "", ""}},
+	{"uploads", [3]string{"s3:ListBucketMultipartUploads", "", ""}},
+	{"versions", [3]string{"s3:ListBucketVersions", "", ""}},
+	{"intelligent-tiering", [3]string{"s3:GetIntelligentTieringConfiguration", "s3:PutIntelligentTieringConfiguration", "s3:PutIntelligentTieringConfiguration"}},
+	{"inventory", [3]string{"s3:GetInventoryConfiguration", "s3:PutInventoryConfiguration", "s3:PutInventoryConfiguration"}},
+	{"metrics", [3]string{"s3:GetMetricsConfiguration", "s3:PutMetricsConfiguration", "s3:PutMetricsConfiguration"}},
+	{"analytics", [3]string{"s3:GetAnalyticsConfiguration", "s3:PutAnalyticsConfiguration", "s3:PutAnalyticsConfiguration"}},
+}
+
+// Object subresources in matching order
+var objectSubresourceActions = []subresourceActions{
+	{"acl", [3]string{"s3:GetObjectAcl", "s3:PutObjectAcl", ""}},
+	{"tagging", [3]string{"s3:GetObjectTagging", "s3:PutObjectTagging", "s3:DeleteObjectTagging"}},
+	{"retention", [3]string{"s3:GetObjectRetention", "s3:PutObjectRetention", ""}},
+	{"legal-hold", [3]string{"s3:GetObjectLegalHold", "s3:PutObjectLegalHold", ""}},
+	{"attributes", [3]string{"s3:GetObjectAttributes", "", ""}},
+	{"torrent", [3]string{"s3:GetObject", "", ""}},
+}
+
+// s3Action maps a request to the IAM action it performs, empty for a
+// subresource the method does not apply to (DELETE /bucket?versioning)
+func s3Action(req *http.Request, bucket, key string) string {
+	query := req.URL.Query()
+	versioned := query.Get("versionId") != ""
+
+	// The first subresource of the request decides, found even without an action
+	subresourceAction := func(subresources []subresourceActions) (string, bool) {
+		for _, sub := range subresources {
+			if !query.Has(sub.name) {
+				continue
+			}
+			switch req.Method {
+			case "GET", "HEAD":
+				return sub.actions[0], true
+			case "PUT":
+				return sub.actions[1], true
+			case "DELETE":
+				return sub.actions[2], true
+			}
+			return "", true
+		}
+		return "", false
+	}
+
+	switch {
+	case bucket == "":
+		return "s3:ListAllMyBuckets"
+
+	case key == "":
+		if action, found := subresourceAction(bucketSubresourceActions); found {
+			return action
+		}
+		switch req.Method {
+		case "PUT":
+			return "s3:CreateBucket"
+		case "DELETE":
+			return "s3:DeleteBucket"
+		case "POST":
+			if query.Has("delete") {
+				return "s3:DeleteObject"
+			}
+			// Browser-based POST uploads
+			return "s3:PutObject"
+		}
+		return "s3:ListBucket"
+	}
+
+	if action, found := subresourceAction(objectSubresourceActions); found {
+		// Only ACLs and tags have versioned actions (s3:GetObjectVersionAcl)
+		if action != "" && versioned && (query.Has("acl") || query.Has("tagging")) {
+			action = strings.Replace(action, "Object", "ObjectVersion", 1)
+		}
+		return action
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		if query.Has("uploadId") {
+			return "s3:ListMultipartUploadParts"
+		}
+		if versioned {
+			return "s3:GetObjectVersion"
+		}
+		return "s3:GetObject"
+	case "DELETE":
+		if query.Has("uploadId") {
+			return "s3:AbortMultipartUpload"
+		}
+		if versioned {
+			return "s3:DeleteObjectVersion"
+		}
+		return "s3:DeleteObject"
+	case "POST":
+		if query.Has("restore") {
+			return "s3:RestoreObject"
+		}
+		if query.Has("select") {
+			return "s3:GetObject"
+		}
+	}
+	// PutObject, CopyObject and every multipart upload step
+	return "s3:PutObject"
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Where a presigned URL points to
+const (
+	presignTargetProxy  = "proxy"
+	presignTargetMain   = "main"
+	presignTargetMirror = "mirror"
+)
+
+var (
+	presignProxyURL      string            // Public URL of the proxy, used for proxy URLs
+	presignDefaultExpiry time.Duration     // Expiry when none is requested
+	presignMaxExpiry     time.Duration     // Longest expiry that can be requested
+	presignTokens        map[string]string // Admin API bearer tokens, mapped to the issuer name
+
+	presignIssued = newCounter("s3mirror_presign_issued_total", "Presigned URLs issued.", "target", "method")
+)
+
+// presignRequest asks for a presigned URL
+type presignRequest struct {
+	Target  string `json:"target"`  // proxy, main or mirror
+	Method  string `json:"method"`  // GET or PUT
+	Bucket  string `json:"bucket"`  // Bucket as seen by clients, the mirror naming rule is applied for the mirror
+	Key     string `json:"key"`     //
+	Expires string `json:"expires"` // Go duration, defaults to PRESIGN_DEFAULT_EXPIRY
+	Client  string `json:"client"`  // Client name or access key whose credentials sign the URL
+
+	MirrorTarget string `json:"mirrorTarget"` // Mirror target name, defaults to the primary one
+}
+
+type presignResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func loadPresignConfig() {
+	presignProxyURL = getEnv("PRESIGN_PROXY_URL")
+	if presignProxyURL == "" && len(proxyDomains) > 0 {
+		presignProxyURL = "http://" + proxyDomains[0]
+	}
+
+	var err error
+	if presignDefaultExpiry, err = time.ParseDuration(getEnvOrDefault("PRESIGN_DEFAULT_EXPIRY", "1h")); err != nil || presignDefaultExpiry <= 0 {
+		log.Fatalf("Invalid PRESIGN_DEFAULT_EXPIRY: %v", err)
+	}
+	if presignMaxExpiry, err = time.ParseDuration(getEnvOrDefault("PRESIGN_MAX_EXPIRY", "24h")); err != nil || presignMaxExpiry <= 0 {
+		log.Fatalf("Invalid PRESIGN_MAX_EXPIRY: %v", err)
+	}
+	if presignMaxExpiry > maxPresignExpiry {
+		log.Fatalf("PRESIGN_MAX_EXPIRY cannot exceed %s", maxPresignExpiry)
+	}
+	if presignDefaultExpiry > presignMaxExpiry {
+		presignDefaultExpiry = presignMaxExpiry
+	}
+
+	// Inline "NAME:TOKEN" pairs, separated by commas
+	presignTokens = make(map[string]string)
+	for _, pair := range strings.Split(getEnv("PRESIGN_ADMIN_TOKENS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatal("Invalid PRESIGN_ADMIN_TOKENS, expected NAME:TOKEN pairs separated by commas")
+		}
+		presignTokens[parts[1]] = parts[0]
+	}
+}
+
+// issuePresignedURL validates a request, signs the URL and audits it
+func issuePresignedURL(request presignRequest, issuer string) (*presignResponse, error) {
+	request.Method = strings.ToUpper(request.Method)
+	if request.Method == "" {
+		request.Method = "GET"
+	}
+	if request.Method != "GET" && request.Method != "PUT" {
+		return nil, fmt.Errorf("method must be GET or PUT")
+	}
+	if request.Bucket == "" || request.Key == "" {
+		return nil, fmt.Errorf("bucket and key are required")
+	}
+
+	expires := presignDefaultExpiry
+	if request.Expires != "" {
+		var err error
+		if expires, err = time.ParseDuration(request.Expires); err != nil || expires <= 0 {
+			return nil, fmt.Errorf("invalid expires %q", request.Expires)
+		}
+	}
+	if expires > presignMaxExpiry {
+		return nil, fmt.Errorf("expires cannot exceed %s", presignMaxExpiry)
+	}
+
+	var client *clientCredential
+	if request.Client != "" {
+		if client = findClientCredential(request.Client); client == nil {
+			return nil, fmt.Errorf("unknown client %q", request.Client)
+		}
+		if !client.allowsBucket(request.Bucket) {
+			return nil, fmt.Errorf("client %q may not access bucket %s", client.Name, request.Bucket)
+		}
+	}
+
+	var endpoint string
+	var isVirtualHosted bool
+	var creds upstreamCredentials
+	region := "us-east-1" // The proxy accepts any region in client signatures
+	var err error
+	bucket, key := request.Bucket, request.Key
+	switch request.Target {
+	case presignTargetProxy:
+		if client == nil {
+			return nil, fmt.Errorf("proxy URLs are signed with client credentials, client is required")
+		}
+		if presignProxyURL == "" {
+			return nil, fmt.Errorf("PRESIGN_PROXY_URL is not configured")
+		}
+		endpoint = presignProxyURL
+		creds = upstreamCredentials{AccessKey: client.AccessKey, SecretKey: client.SecretKey}
+	case presignTargetMain:
+		backend := mainBackendFor(bucket)
+		if backend == nil {
+			return nil, fmt.Errorf("no main backend holds bucket %s", bucket)
+		}
+		endpoint = backend.Endpoint
+		isVirtualHosted = backend.virtualHosted(bucket, false)
+		creds, err = client.mainCredentials(backend)
+		region = backend.regions.region(bucket)
+	case presignTargetMirror:
+		target, targetErr := findMirrorTarget(request.MirrorTarget)
+		if targetErr != nil {
+			return nil, targetErr
+		}
+		if target.Type != mirrorTargetS3 {
+			return nil, fmt.Errorf("mirror target %s is not an S3 endpoint", target.Name)
+		}
+		// The copy lives where its replication rule put it, like restores
+		if bucket, key, _, err = restoreSource(target, bucket, key); err != nil {
+			return nil, err
+		}
+		// URLs of copies only the proxy can read would return unreadable bytes
+		if request.Method == "GET" {
+			if err := checkPresignableCopy(target, request.Bucket, bucket, key); err != nil {
+				return nil, err
+			}
+		} else if mirrorKeyring != nil {
+			return nil, fmt.Errorf("uploads to mirror target %s would not be encrypted with MIRROR_ENCRYPTION_KEYRING", target.Name)
+		}
+		endpoint = target.Endpoint
+		creds, err = client.mirrorCredentials(target)
+		isVirtualHosted = target.virtualHosted(bucket, false)
+		region = target.regions.region(bucket)
+	default:
+		return nil, fmt.Errorf("target must be proxy, main or mirror")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	presigned, err := presignURL(request.Method, endpoint, bucket, key, isVirtualHosted, creds, region, expires, now)
+	if err != nil {
+		return nil, err
+	}
+
+	presignIssued.Inc(request.Target, request.Method)
+	recordAudit("presign", issuer, log.Fields{
+		"target":  request.Target,
+		"method":  request.Method,
+		"bucket":  bucket,
+		"key":     key,
+		"expires": expires.String(),
+		"client":  request.Client,
+		"mirror":  request.MirrorTarget,
+	})
+	return &presignResponse{URL: presigned, ExpiresAt: now.Add(expires)}, nil
+}
+
+// checkPresignableCopy refuses the copies a presigned URL can't read: copies
+// encrypted with the keyring and SSE-C copies, they are read with restore
+func checkPresignableCopy(target *mirrorTarget, bucket, mirrorBucket, key string) error {
+	head, customerKey, err := target.store.getObject("HEAD", bucket, mirrorBucket, key)
+	if err != nil {
+		return err
+	}
+	head.Body.Close()
+	switch {
+	case head.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("mirror target %s has no copy at %s/%s", target.Name, mirrorBucket, key)
+	case customerKey != nil || head.StatusCode == http.StatusBadRequest:
+		// S3 answers a HEAD of an SSE-C object without its key with 400
+		return fmt.Errorf("the copy at %s/%s is encrypted with a customer key (SSE-C), use restore to read it", mirrorBucket, key)
+	case head.StatusCode != http.StatusOK:
+		return fmt.Errorf("HEAD of the copy at %s/%s failed with status %d", mirrorBucket, key, head.StatusCode)
+	case isEncryptedMirrorObject(head.Header):
+		return fmt.Errorf("the copy at %s/%s is encrypted with MIRROR_ENCRYPTION_KEYRING, use restore to read it", mirrorBucket, key)
+	}
+	return nil
+}
+
+// presignURL builds a SigV4 query-string authenticated URL, in the style of
+// the upstream
+func presignURL(method, endpoint, bucket, key string, isVirtualHosted bool, creds upstreamCredentials, region string, expires time.Duration, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/" + bucket + "/" + key
+	if isVirtualHosted {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.Host = regionalHost(u.Host, region)
+
+	dateStamp := now.Format("20060102")
+	credentialScope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, region)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", signatureAlgorithm)
+	query.Set("X-Amz-Credential", creds.AccessKey+"/"+credentialScope)
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if creds.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	canonicalQuery := canonicalClientQuery(query.Encode())
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		awsURIEncode(u.Path, false),
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	log.Debugf("Presign Canonical Request:\n%s", canonicalRequest)
+
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		signatureAlgorithm,
+		now.Format("20060102T150405Z"),
+		credentialScope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := getSigningKey(creds.SecretKey, dateStamp, region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, []byte(stringToSign)))
+
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// findClientCredential returns a client by name or access key
+func findClientCredential(nameOrKey string) *clientCredential {
+	if client := lookupClientCredential(nameOrKey); client != nil {
+		return client
+	}
+	clientCredentialsMutex.RLock()
+	defer clientCredentialsMutex.RUnlock()
+	for _, client := range clientCredentials {
+		if client.Name == nameOrKey {
+			return client
+		}
+	}
+	return nil
+}
+
+// handlePresign serves POST /presign on the admin port, callers authenticate
+// with one of PRESIGN_ADMIN_TOKENS which also identifies them in the audit log
+func handlePresign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(presignTokens) == 0 {
+		http.Error(w, "presign API disabled, set PRESIGN_ADMIN_TOKENS", http.StatusForbidden)
+		return
+	}
+
+	issuer := ""
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for candidate, name := range presignTokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			issuer = name
+		}
+	}
+	if issuer == "" {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request presignRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := issuePresignedURL(request, issuer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// runPresignCommand implements "k8s-s3-mirror presign", meant to be run with
+// kubectl exec inside a proxy pod so it shares its configuration
+func runPresignCommand(args []string) {
+	flags := flag.NewFlagSet("presign", flag.ExitOnError)
+	var request presignRequest
+	flags.StringVar(&request.Target, "target", presignTargetMirror, "proxy, main or mirror")
+	flags.StringVar(&request.Method, "method", "GET", "GET or PUT")
+	flags.StringVar(&request.Bucket, "bucket", "", "bucket name (without the mirror prefix)")
+	flags.StringVar(&request.Key, "key", "", "object key")
+	flags.StringVar(&request.Expires, "expires", "", "validity, defaults to PRESIGN_DEFAULT_EXPIRY")
+	flags.StringVar(&request.Client, "client", "", "client whose credentials sign the URL")
+	flags.StringVar(&request.MirrorTarget, "mirror-target", "", "mirror target, defaults to the primary one")
+	issuer := flags.String("issuer", os.Getenv("USER"), "name recorded in the audit log")
+	flags.Parse(args)
+
+	if *issuer == "" {
+		fmt.Fprintln(os.Stderr, "presign: -issuer is required to audit the URL")
+		os.Exit(2)
+	}
+
+	response, err := issuePresignedURL(request, *issuer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "presign: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(response.URL)
+	fmt.Fprintf(os.Stderr, "Expires at %s\n", response.ExpiresAt.Format(time.RFC3339))
+}
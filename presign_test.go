@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckPresignableCopy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mirror/plain":
+		case "/mirror/encrypted":
+			w.Header().Set(encryptionMetaAlgorithm, encryptionAlgorithm)
+		case "/mirror/ssec":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("MIRROR_PRESIGN_ACCESS_KEY", "access")
+	t.Setenv("MIRROR_PRESIGN_SECRET_KEY", "secret")
+	target := &mirrorTarget{Name: "presign", Endpoint: server.URL, AddressingStyle: addressingStylePath}
+	if err := target.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key   string
+		error string
+	}{
+		{"plain", ""},
+		{"encrypted", "MIRROR_ENCRYPTION_KEYRING"},
+		{"ssec", "SSE-C"},
+		{"missing", "has no copy"},
+	}
+	for _, tt := range tests {
+		err := checkPresignableCopy(target, "bucket", "mirror", tt.key)
+		switch {
+		case tt.error == "" && err != nil:
+			t.Errorf("checkPresignableCopy(%s): %v", tt.key, err)
+		case tt.error != "" && (err == nil || !strings.Contains(err.Error(), tt.error)):
+			t.Errorf("checkPresignableCopy(%s) = %v, want an error about %s", tt.key, err, tt.error)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Domains of the proxy, PROXY_DOMAIN first: requests to a domain are
+	// path-style, requests to bucket.domain virtual-hosted
+	proxyDomains []string
+	// Host names or glob patterns only receiving path-style requests
+	// (in-cluster service names, ingress hosts without wildcard DNS)
+	proxyPathStyleHosts []string
+
+	// Bucket names that can appear in a hostname, dotted ones included
+	virtualHostedBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+)
+
+// loadProxyHostConfig reads PROXY_DOMAINS (and the older PROXY_DOMAIN) and
+// PROXY_PATH_STYLE_HOSTS. Without any, only hosts without dots are served,
+// as path-style.
+func loadProxyHostConfig() {
+	domains := append([]string{getEnv("PROXY_DOMAIN")}, strings.Split(getEnv("PROXY_DOMAINS"), ",")...)
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain == "" || seen[domain] {
+			continue
+		}
+		if strings.ContainsAny(domain, "*?[/:") {
+			log.Fatalf("Invalid PROXY_DOMAINS entry %q, expected a domain name", domain)
+		}
+		seen[domain] = true
+		proxyDomains = append(proxyDomains, domain)
+	}
+	for _, pattern := range strings.Split(getEnv("PROXY_PATH_STYLE_HOSTS"), ",") {
+		pattern = strings.Trim(strings.ToLower(strings.TrimSpace(pattern)), ".")
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid PROXY_PATH_STYLE_HOSTS pattern %q: %v", pattern, err)
+		}
+		proxyPathStyleHosts = append(proxyPathStyleHosts, pattern)
+	}
+
+	if len(proxyDomains) == 0 && len(proxyPathStyleHosts) == 0 {
+		log.Info("No PROXY_DOMAINS or PROXY_PATH_STYLE_HOSTS configured, only IP addresses and hosts without dots are served, as path-style")
+	}
+}
+
+// requestHostname returns the lowercase host name of a Host header, without
+// its port and IPv6 brackets
+func requestHostname(hostHeader string) string {
+	host := hostHeader
+	if h, _, err := net.SplitHostPort(hostHeader); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+// matchProxyHost tells how requests to a host address their bucket: the
+// bucket of virtual-hosted hosts, or path-style. Hosts matching no rule are
+// refused rather than guessed.
+func matchProxyHost(host string) (bucket string, virtualHosted bool, ok bool) {
+	// Buckets are never addressed by IP
+	if net.ParseIP(host) != nil || host == "localhost" {
+		return "", false, true
+	}
+	// Without configuration a dotted host could be bucket.domain as well as a
+	// plain domain, parsing it path-style would write to the wrong bucket
+	if len(proxyDomains) == 0 && len(proxyPathStyleHosts) == 0 {
+		return "", false, !strings.Contains(host, ".")
+	}
+	for _, pattern := range proxyPathStyleHosts {
+		if matched, _ := path.Match(pattern, host); matched {
+			return "", false, true
+		}
+	}
+	// The most specific domain wins (eu.s3.local over s3.local)
+	matched := ""
+	for _, domain := range proxyDomains {
+		if host == domain {
+			return "", false, true
+		}
+		if strings.HasSuffix(host, "."+domain) && len(domain) > len(matched) {
+			matched = domain
+		}
+	}
+	if matched == "" {
+		return "", false, false
+	}
+	// Everything before the domain is the bucket, dots included
+	return strings.TrimSuffix(host, "."+matched), true, true
+}
+
+// extractBucketAndKey returns the bucket and key a client request addresses
+// and whether it is virtual-hosted, by the Host it was sent to
+func extractBucketAndKey(urlPath, hostHeader string) (string, string, bool, *s3Error) {
+	host := requestHostname(hostHeader)
+	bucket, virtualHosted, ok := matchProxyHost(host)
+	if !ok {
+		message := "The host " + host + " is not a domain of this proxy."
+		if len(proxyDomains) == 0 && len(proxyPathStyleHosts) == 0 {
+			message = "The host " + host + " needs PROXY_DOMAINS or PROXY_PATH_STYLE_HOSTS to be configured."
+		}
+		return "", "", false, &s3Error{Status: http.StatusBadRequest, Code: "InvalidRequest", Message: message}
+	}
+
+	// Virtual-hosted: bucket.domain/key (e.g., my.bucket.s3.local/file.txt)
+	if virtualHosted {
+		if !virtualHostedBucketName.MatchString(bucket) || strings.Contains(bucket, "..") {
+			return "", "", false, &s3Error{Status: http.StatusBadRequest, Code: "InvalidBucketName",
+				Message: "The specified bucket is not valid."}
+		}
+		return bucket, strings.TrimPrefix(urlPath, "/"), true, nil
+	}
+
+	// Path-style: domain/bucket/key (e.g., s3.local/my-bucket/file.txt)
+	parts := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+	if parts[0] == "" {
+		return "", "", false, nil
+	}
+	if len(parts) == 1 {
+		return parts[0], "", false, nil
+	}
+	return parts[0], parts[1], false, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestExtractBucketAndKey(t *testing.T) {
+	defer func(domains, hosts []string) {
+		proxyDomains, proxyPathStyleHosts = domains, hosts
+	}(proxyDomains, proxyPathStyleHosts)
+
+	tests := []struct {
+		name    string
+		domains []string
+		hosts   []string
+		host    string
+		path    string
+		bucket  string
+		key     string
+		virtual bool
+		errCode string
+	}{
+		// Nothing configured: undotted hosts and IPs are path-style, dotted
+		// hosts are refused rather than guessed
+		{name: "none undotted", host: "s3-mirror:8080", path: "/photos/a.jpg", bucket: "photos", key: "a.jpg"},
+		{name: "none localhost", host: "localhost", path: "/photos", bucket: "photos"},
+		{name: "none ipv4", host: "10.0.0.1:8080", path: "/photos/a/b.jpg", bucket: "photos", key: "a/b.jpg"},
+		{name: "none ipv6", host: "[::1]:8080", path: "/photos/a.jpg", bucket: "photos", key: "a.jpg"},
+		{name: "none dotted", host: "bucket.example.com", path: "/photos/a.jpg", errCode: "InvalidRequest"},
+		{name: "none root", host: "s3-mirror", path: "/"},
+
+		// One domain
+		{name: "domain path-style", domains: []string{"s3.local"}, host: "s3.local", path: "/photos/a.jpg", bucket: "photos", key: "a.jpg"},
+		{name: "domain virtual", domains: []string{"s3.local"}, host: "photos.s3.local:9000", path: "/a/b.jpg", bucket: "photos", key: "a/b.jpg", virtual: true},
+		{name: "domain dotted bucket", domains: []string{"s3.local"}, host: "logs.2024.s3.local", path: "/a", bucket: "logs.2024", key: "a", virtual: true},
+		{name: "domain bucket root", domains: []string{"s3.local"}, host: "photos.s3.local", path: "/", bucket: "photos", virtual: true},
+		{name: "domain invalid bucket", domains: []string{"s3.local"}, host: "a..b.s3.local", path: "/k", errCode: "InvalidBucketName"},
+		{name: "domain other host", domains: []string{"s3.local"}, host: "bucket.example.com", path: "/k", errCode: "InvalidRequest"},
+		{name: "domain suffix only", domains: []string{"s3.local"}, host: "bads3.local", path: "/k", errCode: "InvalidRequest"},
+		{name: "domain ip", domains: []string{"s3.local"}, host: "10.0.0.1", path: "/photos/a.jpg", bucket: "photos", key: "a.jpg"},
+
+		// Nested domains, the longest one wins
+		{name: "nested inner", domains: []string{"s3.local", "eu.s3.local"}, host: "photos.eu.s3.local", path: "/a", bucket: "photos", key: "a", virtual: true},
+		{name: "nested inner path-style", domains: []string{"s3.local", "eu.s3.local"}, host: "eu.s3.local", path: "/photos/a", bucket: "photos", key: "a"},
+		{name: "nested outer", domains: []string{"s3.local", "eu.s3.local"}, host: "photos.us.s3.local", path: "/a", bucket: "photos.us", key: "a", virtual: true},
+
+		// Path-style hosts
+		{name: "hosts exact", hosts: []string{"s3-mirror.s3-mirror.svc"}, host: "s3-mirror.s3-mirror.svc", path: "/photos/a", bucket: "photos", key: "a"},
+		{name: "hosts glob", hosts: []string{"s3-mirror.*.svc.cluster.local"}, host: "s3-mirror.ns.svc.cluster.local:80", path: "/photos/a", bucket: "photos", key: "a"},
+		{name: "hosts unmatched", hosts: []string{"s3-mirror.*.svc.cluster.local"}, host: "bucket.example.com", path: "/photos/a", errCode: "InvalidRequest"},
+		{name: "hosts before domain", domains: []string{"s3.local"}, hosts: []string{"ingress.s3.local"}, host: "ingress.s3.local", path: "/photos/a", bucket: "photos", key: "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyDomains, proxyPathStyleHosts = tt.domains, tt.hosts
+			bucket, key, virtual, err := extractBucketAndKey(tt.path, tt.host)
+			if tt.errCode != "" {
+				if err == nil || err.Code != tt.errCode {
+					t.Fatalf("extractBucketAndKey(%q, %q) = %q, %q, %v, want %s", tt.path, tt.host, bucket, key, err, tt.errCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractBucketAndKey(%q, %q): %v", tt.path, tt.host, err)
+			}
+			if bucket != tt.bucket || key != tt.key || virtual != tt.virtual {
+				t.Errorf("extractBucketAndKey(%q, %q) = %q, %q, %v, want %q, %q, %v",
+					tt.path, tt.host, bucket, key, virtual, tt.bucket, tt.key, tt.virtual)
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// quotaRule caps the bytes and objects stored under a bucket pattern and key prefix.
+// Usage is aggregated over every bucket matching the pattern.
+type quotaRule struct {
+	ID          string `json:"id"`
+	Bucket      string `json:"bucket"` // Bucket name or glob pattern (path.Match syntax)
+	Prefix      string `json:"prefix"` // Optional key prefix
+	HardBytes   int64  `json:"hardBytes"`
+	HardObjects int64  `json:"hardObjects"`
+	SoftBytes   int64  `json:"softBytes"`
+	SoftObjects int64  `json:"softObjects"`
+
+	// Usage counters, guarded by quotaMutex
+	bytes        int64
+	objects      int64
+	softExceeded bool
+}
+
+type quotaConfig struct {
+	Rules []*quotaRule `json:"rules"`
+}
+
+var (
+	quotaRules          []*quotaRule
+	quotaResyncInterval time.Duration
+	quotaMutex          sync.Mutex
+
+	quotaUsageBytes   = newGauge("s3mirror_quota_usage_bytes", "Bytes stored under a quota rule.", "rule")
+	quotaUsageObjects = newGauge("s3mirror_quota_usage_objects", "Objects stored under a quota rule.", "rule")
+	quotaLimit        = newGauge("s3mirror_quota_limit", "Configured quota limits.", "rule", "type", "unit")
+	quotaSoftExceeded = newGauge("s3mirror_quota_soft_exceeded", "Whether usage is above the soft quota (1) or not (0).", "rule")
+	quotaRejected     = newCounter("s3mirror_quota_rejected_total", "Writes rejected because of a hard quota.", "rule")
+)
+
+func loadQuotaConfig() {
+	configPath := getEnv("QUOTA_CONFIG")
+	if configPath == "" {
+		return
+	}
+
+	var config quotaConfig
+	if err := loadConfigFile(configPath, &config); err != nil {
+		log.Fatalf("Failed to load QUOTA_CONFIG: %v", err)
+	}
+
+	ids := make(map[string]bool)
+	for i, rule := range config.Rules {
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if ids[rule.ID] {
+			log.Fatalf("Duplicate quota rule id %q", rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if rule.Bucket == "" {
+			log.Fatalf("Quota rule %q has no bucket", rule.ID)
+		}
+		if _, err := path.Match(rule.Bucket, ""); err != nil {
+			log.Fatalf("Quota rule %q has an invalid bucket pattern: %v", rule.ID, err)
+		}
+
+		quotaLimit.Set(float64(rule.HardBytes), rule.ID, "hard", "bytes")
+		quotaLimit.Set(float64(rule.HardObjects), rule.ID, "hard", "objects")
+		quotaLimit.Set(float64(rule.SoftBytes), rule.ID, "soft", "bytes")
+		quotaLimit.Set(float64(rule.SoftObjects), rule.ID, "soft", "objects")
+	}
+	quotaRules = config.Rules
+
+	interval, err := time.ParseDuration(getEnvOrDefault("QUOTA_RESYNC_INTERVAL", "5m"))
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid QUOTA_RESYNC_INTERVAL: %v", err)
+	}
+	quotaResyncInterval = interval
+
+	if inventoryBackend == inventoryBackendNone && len(quotaRules) > 0 {
+		log.Fatal("QUOTA_CONFIG requires an inventory backend to track usage")
+	}
+
+	log.Infof("Loaded %d quota rules", len(quotaRules))
+}
+
+func (r *quotaRule) matches(bucket, key string) bool {
+	if ok, _ := path.Match(r.Bucket, bucket); !ok {
+		return false
+	}
+	return strings.HasPrefix(key, r.Prefix)
+}
+
+// startQuotaTracking computes the usage of every rule from the inventory and
+// periodically recomputes it to absorb writes made by other replicas
+func startQuotaTracking(store InventoryStore) {
+	if len(quotaRules) == 0 {
+		return
+	}
+
+	resyncQuotaUsage(store)
+
+	go func() {
+		ticker := time.NewTicker(quotaResyncInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			resyncQuotaUsage(store)
+		}
+	}()
+}
+
+func resyncQuotaUsage(store InventoryStore) {
+	buckets, err := store.Buckets()
+	if err != nil {
+		log.Errorf("Failed to list buckets for quota usage: %v", err)
+		return
+	}
+
+	for _, rule := range quotaRules {
+		var bytes, objects int64
+		failed := false
+		for _, bucket := range buckets {
+			if ok, _ := path.Match(rule.Bucket, bucket); !ok {
+				continue
+			}
+
+			startAfter := ""
+			for {
+				records, err := store.ListObjects(bucket, ObjectQuery{Prefix: rule.Prefix, StartAfter: startAfter, Limit: 1000})
+				if err != nil {
+					log.Errorf("Failed to compute quota usage of %s: %v", rule.ID, err)
+					failed = true
+					break
+				}
+				if len(records) == 0 {
+					break
+				}
+				for _, rec := range records {
+					bytes += rec.Size
+					objects++
+				}
+				startAfter = records[len(records)-1].Key
+			}
+		}
+		if failed {
+			continue
+		}
+
+		quotaMutex.Lock()
+		rule.bytes = bytes
+		rule.objects = objects
+		updateQuotaState(rule)
+		quotaMutex.Unlock()
+	}
+}
+
+// quotaApplies tells if any rule tracks a key
+func quotaApplies(bucket, key string) bool {
+	for _, rule := range quotaRules {
+		if rule.matches(bucket, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordQuotaUsage applies the change from previous to current (either may be
+// nil) to the counters of every matching rule
+func recordQuotaUsage(bucket, key string, previous, current *ObjectRecord) {
+	var deltaBytes, deltaObjects int64
+	if previous != nil && !previous.Deleted {
+		deltaBytes -= previous.Size
+		deltaObjects--
+	}
+	if current != nil && !current.Deleted {
+		deltaBytes += current.Size
+		deltaObjects++
+	}
+	if deltaBytes == 0 && deltaObjects == 0 {
+		return
+	}
+
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	for _, rule := range quotaRules {
+		if !rule.matches(bucket, key) {
+			continue
+		}
+		rule.bytes += deltaBytes
+		rule.objects += deltaObjects
+		updateQuotaState(rule)
+	}
+}
+
+// updateQuotaState publishes usage and warns when crossing the soft quota,
+// the caller must hold quotaMutex
+func updateQuotaState(rule *quotaRule) {
+	quotaUsageBytes.Set(float64(rule.bytes), rule.ID)
+	quotaUsageObjects.Set(float64(rule.objects), rule.ID)
+
+	exceeded := (rule.SoftBytes > 0 && rule.bytes > rule.SoftBytes) ||
+		(rule.SoftObjects > 0 && rule.objects > rule.SoftObjects)
+
+	if exceeded && !rule.softExceeded {
+		log.Warnf("Soft quota %s exceeded: %d bytes (soft %d), %d objects (soft %d)",
+			rule.ID, rule.bytes, rule.SoftBytes, rule.objects, rule.SoftObjects)
+	} else if !exceeded && rule.softExceeded {
+		log.Infof("Soft quota %s back under its limit", rule.ID)
+	}
+	rule.softExceeded = exceeded
+
+	if exceeded {
+		quotaSoftExceeded.Set(1, rule.ID)
+	} else {
+		quotaSoftExceeded.Set(0, rule.ID)
+	}
+}
+
+// errQuotaUnknownSize fails writes under a hard quota whose size can't be
+// determined, rather than letting them through unchecked
+var errQuotaUnknownSize = errors.New("the size of the write could not be determined")
+
+// checkQuota returns the hard quota a write would exceed, or nil when the
+// write is allowed. Concurrent writes may overshoot a quota by their own size.
+func checkQuota(req *http.Request, bucket, key string, body []byte) (*quotaRule, error) {
+	if len(quotaRules) == 0 || inventory == nil || (req.Method != "PUT" && req.Method != "POST") {
+		return nil, nil
+	}
+
+	var size int64
+	newObject := true
+	query := req.URL.Query()
+	switch {
+	case key == "" && req.Method == "POST" && isPostObjectUpload(req):
+		// Browser uploads name their key in the form
+		formKey, formSize, err := postObjectUpload(req, body)
+		if err != nil {
+			if !hasHardQuota(bucket) {
+				return nil, nil
+			}
+			log.Warnf("Failed to read the upload form of bucket %s for quota check: %v", bucket, err)
+			return nil, errQuotaUnknownSize
+		}
+		key, size = formKey, formSize
+	case key == "":
+		return nil, nil
+	case objectWriteKind(req) == writePut:
+		size = putObjectSize(req, body)
+	case objectWriteKind(req) == writeCopy:
+		if len(hardQuotaRules(bucket, key)) == 0 {
+			return nil, nil
+		}
+		source, err := copySourceSize(req)
+		if err != nil {
+			log.Warnf("Failed to size the copy source of %s/%s for quota check: %v", bucket, key, err)
+			return nil, errQuotaUnknownSize
+		}
+		size = source
+	case objectWriteKind(req) == writeCompleteMultipart:
+		if len(hardQuotaRules(bucket, key)) == 0 {
+			return nil, nil
+		}
+		parts, err := completedUploadSize(req, bucket, key, body)
+		if err != nil {
+			log.Warnf("Failed to size the multipart upload of %s/%s for quota check: %v", bucket, key, err)
+			return nil, errQuotaUnknownSize
+		}
+		size = parts
+	default:
+		// Parts only add bytes, the object is counted once completed
+		if req.Method != "PUT" || !query.Has("partNumber") || !query.Has("uploadId") {
+			return nil, nil
+		}
+		size = putObjectSize(req, body)
+		newObject = false
+	}
+
+	// Cheap check first, most writes are far from their quota
+	if !exceedsHardQuota(bucket, key, size, newObject) {
+		return nil, nil
+	}
+
+	// Overwrites free the space of the object they replace
+	var previous *ObjectRecord
+	if newObject {
+		var err error
+		if previous, err = inventory.GetObject(bucket, key); err != nil {
+			log.Warnf("Failed to read %s/%s for quota check: %v", bucket, key, err)
+		}
+	}
+
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	for _, rule := range hardQuotaRules(bucket, key) {
+		bytes, objects := projectedUsage(rule, size, newObject, previous)
+		if quotaExceeded(rule, bytes, objects) {
+			quotaRejected.Inc(rule.ID)
+			log.Warnf("Rejected %s %s/%s: hard quota %s exceeded (%d bytes, %d objects)", req.Method, bucket, key, rule.ID, bytes, objects)
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// exceedsHardQuota tells if any hard quota would be exceeded by a write
+func exceedsHardQuota(bucket, key string, size int64, newObject bool) bool {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	for _, rule := range hardQuotaRules(bucket, key) {
+		bytes, objects := projectedUsage(rule, size, newObject, nil)
+		if quotaExceeded(rule, bytes, objects) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHardQuota tells if a rule with a hard limit matches any key of a bucket
+func hasHardQuota(bucket string) bool {
+	for _, rule := range quotaRules {
+		if ok, _ := path.Match(rule.Bucket, bucket); ok && (rule.HardBytes > 0 || rule.HardObjects > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// hardQuotaRules returns the rules with a hard limit matching a key
+func hardQuotaRules(bucket, key string) []*quotaRule {
+	var rules []*quotaRule
+	for _, rule := range quotaRules {
+		if (rule.HardBytes > 0 || rule.HardObjects > 0) && rule.matches(bucket, key) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// projectedUsage returns the usage of a rule after a write, the caller must hold quotaMutex
+func projectedUsage(rule *quotaRule, size int64, newObject bool, previous *ObjectRecord) (int64, int64) {
+	bytes := rule.bytes + size
+	objects := rule.objects
+	if newObject {
+		objects++
+	}
+	if previous != nil && !previous.Deleted {
+		bytes -= previous.Size
+		objects--
+	}
+	return bytes, objects
+}
+
+func quotaExceeded(rule *quotaRule, bytes, objects int64) bool {
+	return (rule.HardBytes > 0 && bytes > rule.HardBytes) || (rule.HardObjects > 0 && objects > rule.HardObjects)
+}
+
+// copySourceSize returns the size of the source of a CopyObject from the
+// inventory, or from main when the inventory doesn't know it
+func copySourceSize(req *http.Request) (int64, error) {
+	copySource := req.Header.Get("X-Amz-Copy-Source")
+	if rec := copySourceRecord(copySource); rec != nil {
+		return rec.Size, nil
+	}
+
+	source, err := url.PathUnescape(strings.SplitN(copySource, "?", 2)[0])
+	if err != nil {
+		return 0, err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid copy source %q", copySource)
+	}
+	backend := mainBackendFor(parts[0])
+	if backend == nil {
+		return 0, fmt.Errorf("no main backend holds bucket %s", parts[0])
+	}
+	creds, err := requestIdentity(req).mainCredentials(backend)
+	if err != nil {
+		return 0, err
+	}
+
+	// Reading an SSE-C source needs its key
+	headers := make(http.Header)
+	for k, v := range req.Header {
+		if strings.HasPrefix(k, sseCopySourceHeaderPrefix) {
+			headers[sseHeader+"-"+strings.TrimPrefix(k, sseCopySourceHeaderPrefix)] = v
+		}
+	}
+	head, err := headMainObject(parts[0], parts[1], headers, creds, false)
+	if err != nil {
+		return 0, err
+	}
+	return head.ContentLength, nil
+}
+
+// completedUploadSize returns the size of the object a
+// CompleteMultipartUpload assembles, from the parts main holds
+func completedUploadSize(req *http.Request, bucket, key string, body []byte) (int64, error) {
+	var complete completeMultipartUpload
+	if err := xml.Unmarshal(body, &complete); err != nil {
+		return 0, fmt.Errorf("invalid CompleteMultipartUpload request: %w", err)
+	}
+	backend := mainBackendFor(bucket)
+	if backend == nil {
+		return 0, fmt.Errorf("no main backend holds bucket %s", bucket)
+	}
+	creds, err := requestIdentity(req).mainCredentials(backend)
+	if err != nil {
+		return 0, err
+	}
+	sizes, err := listMainParts(backend, bucket, key, req.URL.Query().Get("uploadId"), creds)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, part := range complete.Parts {
+		partSize, ok := sizes[part.PartNumber]
+		if !ok {
+			return 0, fmt.Errorf("part %d of the upload is missing", part.PartNumber)
+		}
+		size += partSize
+	}
+	return size, nil
+}
+
+// copySourceRecord looks up the source of a CopyObject ("bucket/key[?versionId=...]")
+func copySourceRecord(copySource string) *ObjectRecord {
+	source, err := url.PathUnescape(strings.SplitN(copySource, "?", 2)[0])
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	rec, err := inventory.GetObject(parts[0], parts[1])
+	if err != nil || rec == nil || rec.Deleted {
+		return nil
+	}
+	return rec
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withQuotaRules replaces the quota rules and inventory for a test
+func withQuotaRules(t *testing.T, rules ...*quotaRule) *fileStore {
+	store := withInventory(t)
+	previous := quotaRules
+	quotaRules = rules
+	t.Cleanup(func() { quotaRules = previous })
+	return store
+}
+
+// postUploadRequest builds a browser-based upload of a file with form fields
+func postUploadRequest(t *testing.T, fields map[string]string, file []byte) (*http.Request, []byte) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if file != nil {
+		part, err := form.CreateFormFile("file", "photo.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(file)
+	}
+	form.Close()
+
+	req := httptest.NewRequest("POST", "http://proxy.example.com/bucket", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, body.Bytes()
+}
+
+func TestCheckQuotaPostUpload(t *testing.T) {
+	withQuotaRules(t, &quotaRule{ID: "uploads", Bucket: "bucket", Prefix: "uploads/", HardBytes: 10})
+
+	req, body := postUploadRequest(t, map[string]string{"key": "uploads/${filename}"}, []byte("0123456789ab"))
+	if rule, err := checkQuota(req, "bucket", "", body); err != nil || rule == nil || rule.ID != "uploads" {
+		t.Errorf("checkQuota(12 bytes) = %v, %v, want quota uploads", rule, err)
+	}
+
+	req, body = postUploadRequest(t, map[string]string{"key": "uploads/a"}, []byte("0123"))
+	if rule, err := checkQuota(req, "bucket", "", body); err != nil || rule != nil {
+		t.Errorf("checkQuota(4 bytes) = %v, %v, want allowed", rule, err)
+	}
+
+	// Other prefixes are not limited
+	req, body = postUploadRequest(t, map[string]string{"key": "other/a"}, []byte("0123456789ab"))
+	if rule, err := checkQuota(req, "bucket", "", body); err != nil || rule != nil {
+		t.Errorf("checkQuota(other/a) = %v, %v, want allowed", rule, err)
+	}
+
+	// A form that can't be read is refused rather than let through
+	req, body = postUploadRequest(t, map[string]string{"key": "uploads/a"}, nil)
+	if _, err := checkQuota(req, "bucket", "", body); !errors.Is(err, errQuotaUnknownSize) {
+		t.Errorf("checkQuota(no file) = %v, want errQuotaUnknownSize", err)
+	}
+	req, _ = postUploadRequest(t, map[string]string{"key": "uploads/a"}, []byte("0123"))
+	if _, err := checkQuota(req, "bucket", "", []byte("truncated")); !errors.Is(err, errQuotaUnknownSize) {
+		t.Errorf("checkQuota(truncated) = %v, want errQuotaUnknownSize", err)
+	}
+	if _, err := checkQuota(req, "other-bucket", "", []byte("truncated")); err != nil {
+		t.Errorf("checkQuota(truncated, no quota) = %v, want allowed", err)
+	}
+}
+
+func TestQuotaAccounting(t *testing.T) {
+	photos := &quotaRule{ID: "photos", Bucket: "photos-*", SoftBytes: 10}
+	uploads := &quotaRule{ID: "uploads", Bucket: "photos-eu", Prefix: "uploads/", HardObjects: 2}
+	store := withQuotaRules(t, photos, uploads)
+
+	write := func(bucket, key string, size int64, deleted bool) {
+		previous, _ := store.GetObject(bucket, key)
+		current := &ObjectRecord{Key: key, Size: size, Deleted: deleted}
+		store.UpsertObject(bucket, *current)
+		recordQuotaUsage(bucket, key, previous, current)
+	}
+	usage := func(rule *quotaRule) (int64, int64) {
+		quotaMutex.Lock()
+		defer quotaMutex.Unlock()
+		return rule.bytes, rule.objects
+	}
+
+	tests := []struct {
+		name    string
+		write   func()
+		photos  [2]int64
+		uploads [2]int64
+		soft    bool
+	}{
+		{"new object", func() { write("photos-eu", "uploads/a", 4, false) }, [2]int64{4, 1}, [2]int64{4, 1}, false},
+		{"other bucket of the pattern", func() { write("photos-us", "b", 3, false) }, [2]int64{7, 2}, [2]int64{4, 1}, false},
+		{"other prefix", func() { write("photos-eu", "c", 1, false) }, [2]int64{8, 3}, [2]int64{4, 1}, false},
+		{"unmatched bucket", func() { write("videos", "uploads/a", 100, false) }, [2]int64{8, 3}, [2]int64{4, 1}, false},
+		{"overwrite", func() { write("photos-eu", "uploads/a", 6, false) }, [2]int64{10, 3}, [2]int64{6, 1}, false},
+		{"over the soft quota", func() { write("photos-eu", "uploads/d", 2, false) }, [2]int64{12, 4}, [2]int64{8, 2}, true},
+		{"delete", func() { write("photos-eu", "uploads/a", 6, true) }, [2]int64{6, 3}, [2]int64{2, 1}, false},
+		{"delete again", func() { write("photos-eu", "uploads/a", 6, true) }, [2]int64{6, 3}, [2]int64{2, 1}, false},
+	}
+	for _, tt := range tests {
+		tt.write()
+		if bytes, objects := usage(photos); bytes != tt.photos[0] || objects != tt.photos[1] {
+			t.Errorf("%s: photos usage = %d bytes, %d objects, want %v", tt.name, bytes, objects, tt.photos)
+		}
+		if bytes, objects := usage(uploads); bytes != tt.uploads[0] || objects != tt.uploads[1] {
+			t.Errorf("%s: uploads usage = %d bytes, %d objects, want %v", tt.name, bytes, objects, tt.uploads)
+		}
+		if photos.softExceeded != tt.soft {
+			t.Errorf("%s: soft quota exceeded = %v, want %v", tt.name, photos.softExceeded, tt.soft)
+		}
+	}
+
+	// A resync from the inventory finds the same usage
+	photos.bytes, photos.objects, uploads.bytes, uploads.objects = 0, 0, 0, 0
+	resyncQuotaUsage(store)
+	if bytes, objects := usage(photos); bytes != 6 || objects != 3 {
+		t.Errorf("resynced photos usage = %d bytes, %d objects, want 6, 3", bytes, objects)
+	}
+	if bytes, objects := usage(uploads); bytes != 2 || objects != 1 {
+		t.Errorf("resynced uploads usage = %d bytes, %d objects, want 2, 1", bytes, objects)
+	}
+
+	// Overwrites replace an object, parts add bytes but no object
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	live, deleted := &ObjectRecord{Size: 2}, &ObjectRecord{Size: 2, Deleted: true}
+	for _, tt := range []struct {
+		name      string
+		size      int64
+		newObject bool
+		previous  *ObjectRecord
+		bytes     int64
+		objects   int64
+		exceeded  bool
+	}{
+		{"new object", 1, true, nil, 3, 2, false},
+		{"overwrite", 5, true, live, 5, 1, false},
+		{"write over a deleted record", 1, true, deleted, 3, 2, false},
+		{"part", 7, false, nil, 9, 1, false},
+	} {
+		bytes, objects := projectedUsage(uploads, tt.size, tt.newObject, tt.previous)
+		if bytes != tt.bytes || objects != tt.objects {
+			t.Errorf("projectedUsage(%s) = %d, %d, want %d, %d", tt.name, bytes, objects, tt.bytes, tt.objects)
+		}
+	}
+	if !quotaExceeded(uploads, 0, 3) || quotaExceeded(uploads, 1<<40, 2) {
+		t.Error("uploads hard quota must only count objects")
+	}
+}
+
+func TestCheckQuotaOverwrite(t *testing.T) {
+	store := withQuotaRules(t, &quotaRule{ID: "bucket", Bucket: "bucket", HardBytes: 10})
+	store.UpsertObject("bucket", ObjectRecord{Key: "a", Size: 8})
+	recordQuotaUsage("bucket", "a", nil, &ObjectRecord{Key: "a", Size: 8})
+
+	put := func(key, body string) *http.Request {
+		return httptest.NewRequest("PUT", "http://proxy.example.com/bucket/"+key, strings.NewReader(body))
+	}
+	if rule, err := checkQuota(put("b", "0123"), "bucket", "b", []byte("0123")); err != nil || rule == nil {
+		t.Errorf("checkQuota(new 4 bytes) = %v, %v, want quota bucket", rule, err)
+	}
+	if rule, err := checkQuota(put("a", "0123456789"), "bucket", "a", []byte("0123456789")); err != nil || rule != nil {
+		t.Errorf("checkQuota(overwrite with 10 bytes) = %v, %v, want allowed", rule, err)
+	}
+	if rule, err := checkQuota(httptest.NewRequest("GET", "http://proxy.example.com/bucket/b", nil), "bucket", "b", nil); err != nil || rule != nil {
+		t.Errorf("checkQuota(GET) = %v, %v, want allowed", rule, err)
+	}
+}
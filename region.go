@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// upstreamRegions resolves the signing region of the buckets of an upstream:
+// learned regions first, then configured ones, then the upstream default
+type upstreamRegions struct {
+	upstream      string
+	defaultRegion string
+	configured    map[string]string
+	learned       map[string]string
+	mutex         sync.RWMutex
+}
+
+var (
+	regionRetries = newCounter("s3mirror_region_retries_total", "Requests retried after the upstream reported another bucket region.", "upstream")
+
+	// Global and legacy AWS S3 endpoints, rewritten to the regional endpoint of the bucket
+	awsS3Host = regexp.MustCompile(`(^|\.)s3([.-][a-z0-9-]+)?\.amazonaws\.com(:\d+)?$`)
+	// Transfer acceleration endpoints are global, left as configured
+	awsS3AccelerateHost = regexp.MustCompile(`(^|\.)s3-accelerate(\.dualstack)?\.amazonaws\.com(:\d+)?$`)
+	// Dual-stack endpoints are regional, their region is rewritten
+	awsS3DualStackHost = regexp.MustCompile(`(^|\.)s3\.dualstack\.[a-z0-9-]+\.amazonaws\.com(:\d+)?$`)
+	// Regional AWS endpoints, naming the default region of an upstream
+	awsRegionalHost = regexp.MustCompile(`(?:^|\.)s3(?:\.dualstack)?[.-]([a-z]{2}-[a-z]+-\d)\.amazonaws\.com$`)
+	// Providers without a Region element only name the region in the message
+	expectedRegion = regexp.MustCompile(`expecting '([a-z0-9-]+)'`)
+)
+
+// newUpstreamRegions resolves regions for an endpoint, an empty region
+// defaults to the region of a regional AWS endpoint or us-east-1
+func newUpstreamRegions(upstream, endpoint, region string, configured map[string]string) *upstreamRegions {
+	if region == "" {
+		region = "us-east-1"
+		if u, err := url.Parse(endpoint); err == nil {
+			if match := awsRegionalHost.FindStringSubmatch(u.Hostname()); match != nil {
+				region = match[1]
+			}
+		}
+	}
+	if configured == nil {
+		configured = make(map[string]string)
+	}
+	return &upstreamRegions{
+		upstream:      upstream,
+		defaultRegion: region,
+		configured:    configured,
+		learned:       make(map[string]string),
+	}
+}
+
+// parseBucketRegions reads "BUCKET:REGION" pairs separated by commas, bucket
+// names as seen by the upstream
+func parseBucketRegions(name string) map[string]string {
+	regions := make(map[string]string)
+	for _, pair := range strings.Split(getEnv(name), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Invalid %s, expected BUCKET:REGION pairs separated by commas", name)
+		}
+		regions[parts[0]] = parts[1]
+	}
+	return regions
+}
+
+// region returns the signing region of a bucket, the default one for
+// requests without a bucket
+func (u *upstreamRegions) region(bucket string) string {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	if region := u.learned[bucket]; region != "" {
+		return region
+	}
+	if region := u.configured[bucket]; region != "" {
+		return region
+	}
+	return u.defaultRegion
+}
+
+func (u *upstreamRegions) learn(bucket, region string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if configured := u.configured[bucket]; configured != "" && configured != region {
+		log.Warnf("Bucket %s of %s is configured in region %s but is in %s", bucket, u.upstream, configured, region)
+	}
+	u.learned[bucket] = region
+}
+
+// send signs a request with the region of its bucket and sends it. When the
+// upstream answers that the bucket lives in another region, the region is
+// cached and the request is retried once.
+func (u *upstreamRegions) send(req *http.Request, creds upstreamCredentials, payload []byte, bucket string, isVirtualHosted bool) (*http.Response, error) {
+	region := u.region(bucket)
+	for attempt := 0; ; attempt++ {
+		useRegionalHost(req, region)
+		signRequestV4WithBucket(req, creds, region, "s3", payload, bucket, isVirtualHosted)
+
+		resp, err := httpClient.Do(req)
+		if err != nil || bucket == "" || attempt > 0 ||
+			(resp.StatusCode != http.StatusMovedPermanently && resp.StatusCode != http.StatusBadRequest) {
+			return resp, err
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		discovered := responseRegion(resp, body)
+		if discovered == "" || discovered == region {
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return resp, nil
+		}
+
+		log.Infof("Bucket %s of %s is in region %s instead of %s, retrying", bucket, u.upstream, discovered, region)
+		u.learn(bucket, discovered)
+		regionRetries.Inc(u.upstream)
+		region = discovered
+
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// responseRegion extracts the region of a bucket from a redirect or a
+// region mismatch error, empty when the response does not name one
+func responseRegion(resp *http.Response, body []byte) string {
+	if region := resp.Header.Get("X-Amz-Bucket-Region"); region != "" {
+		return region
+	}
+
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+		Region  string `xml:"Region"`
+	}
+	if xml.Unmarshal(body, &s3Err) != nil {
+		return ""
+	}
+	if s3Err.Code != "AuthorizationHeaderMalformed" && s3Err.Code != "PermanentRedirect" {
+		return ""
+	}
+	if s3Err.Region != "" {
+		return s3Err.Region
+	}
+	if match := expectedRegion.FindStringSubmatch(s3Err.Message); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// useRegionalHost points requests to global AWS endpoints at the endpoint of
+// the region, which is the only one accepting path-style requests there
+func useRegionalHost(req *http.Request, region string) {
+	if host := regionalHost(req.URL.Host, region); host != req.URL.Host {
+		req.URL.Host = host
+		req.Host = host
+	}
+}
+
+// regionalHost rewrites an AWS S3 host to the endpoint of a region, in the
+// dual-stack flavour for dual-stack hosts. Other hosts (global accelerate
+// endpoints included) are returned unchanged.
+func regionalHost(host, region string) string {
+	if awsS3AccelerateHost.MatchString(host) {
+		return host
+	}
+	if loc := awsS3DualStackHost.FindStringSubmatchIndex(host); loc != nil {
+		port := ""
+		if loc[4] >= 0 {
+			port = host[loc[4]:loc[5]]
+		}
+		return host[:loc[3]] + "s3.dualstack." + region + ".amazonaws.com" + port
+	}
+	loc := awsS3Host.FindStringSubmatchIndex(host)
+	if loc == nil {
+		return host
+	}
+	port := ""
+	if loc[6] >= 0 {
+		port = host[loc[6]:loc[7]]
+	}
+	return host[:loc[3]] + "s3." + region + ".amazonaws.com" + port
+}
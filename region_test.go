@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestRegionalHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"s3.amazonaws.com", "s3.eu-west-1.amazonaws.com"},
+		{"bucket.s3.amazonaws.com", "bucket.s3.eu-west-1.amazonaws.com"},
+		{"s3.us-east-1.amazonaws.com:443", "s3.eu-west-1.amazonaws.com:443"},
+		{"s3-external-1.amazonaws.com", "s3.eu-west-1.amazonaws.com"},
+		{"s3-accelerate.amazonaws.com", "s3-accelerate.amazonaws.com"},
+		{"bucket.s3-accelerate.amazonaws.com", "bucket.s3-accelerate.amazonaws.com"},
+		{"bucket.s3-accelerate.dualstack.amazonaws.com", "bucket.s3-accelerate.dualstack.amazonaws.com"},
+		{"s3.dualstack.us-east-1.amazonaws.com", "s3.dualstack.eu-west-1.amazonaws.com"},
+		{"bucket.s3.dualstack.us-east-1.amazonaws.com:443", "bucket.s3.dualstack.eu-west-1.amazonaws.com:443"},
+		{"s3.dualstack.eu-west-1.amazonaws.com", "s3.dualstack.eu-west-1.amazonaws.com"},
+		{"minio.local:9000", "minio.local:9000"},
+	}
+	for _, tt := range tests {
+		if got := regionalHost(tt.host, "eu-west-1"); got != tt.want {
+			t.Errorf("regionalHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamDefaultRegion(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"https://s3.amazonaws.com", "us-east-1"},
+		{"https://s3.eu-west-3.amazonaws.com", "eu-west-3"},
+		{"https://s3-ap-southeast-2.amazonaws.com", "ap-southeast-2"},
+		{"https://s3.dualstack.us-west-2.amazonaws.com", "us-west-2"},
+		{"https://s3-accelerate.amazonaws.com", "us-east-1"},
+		{"http://minio.local:9000", "us-east-1"},
+	}
+	for _, tt := range tests {
+		if got := newUpstreamRegions("test", tt.endpoint, "", nil).defaultRegion; got != tt.want {
+			t.Errorf("default region of %s = %s, want %s", tt.endpoint, got, tt.want)
+		}
+	}
+}
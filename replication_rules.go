@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rule actions and modes
+const (
+	replicationActionMirror = "mirror" // Mirror matching objects (default)
+	replicationActionSkip   = "skip"   // Do not mirror matching objects
+
+	replicationModeAsync = "async" // Mirror in the background after answering (default)
+	replicationModeSync  = "sync"  // Answer once every target holds the object
+)
+
+// replicationRule decides how the objects it matches are mirrored, every
+// condition that is set must match
+type replicationRule struct {
+	ID          string            `json:"id"`
+	Bucket      string            `json:"bucket"`      // Bucket name or glob pattern, empty matches every bucket
+	Prefix      string            `json:"prefix"`      // Key prefix
+	Suffix      string            `json:"suffix"`      // Key suffix
+	MinSize     int64             `json:"minSize"`     // Smallest object size in bytes
+	MaxSize     int64             `json:"maxSize"`     // Largest object size in bytes, 0 for no limit
+	ContentType string            `json:"contentType"` // Content type or glob pattern ("image/*"), parameters are ignored
+	Tags        map[string]string `json:"tags"`        // Object tags sent with x-amz-tagging
+
+	Action            string   `json:"action"`            // mirror or skip
+	Targets           []string `json:"targets"`           // Mirror targets, empty for every target mirroring the bucket
+	DestinationBucket string   `json:"destinationBucket"` // Mirror bucket template, the target's naming rule by default
+	DestinationKey    string   `json:"destinationKey"`    // Mirror key template, the same key by default
+	StorageClass      string   `json:"storageClass"`      // Storage class of the copies, main's by default
+	Mode              string   `json:"mode"`              // async or sync
+
+	// Storage class of the copies per class on main (STANDARD when unset),
+	// classes not listed are kept
+	StorageClassMap map[string]string `json:"storageClassMap"`
+
+	bucketTemplate *template.Template
+	keyTemplate    *template.Template
+	datedKey       bool // The key template renders the date of the write
+}
+
+type replicationRulesConfig struct {
+	Rules []*replicationRule `json:"rules"`
+}
+
+// objectAttributes are the properties of an object rules can match on
+type objectAttributes struct {
+	Size        int64
+	ContentType string
+	Tags        map[string]string
+}
+
+var (
+	// Rules in order, the first matching one applies. Without a match objects
+	// are mirrored asynchronously to every target mirroring their bucket.
+	replicationRules      []*replicationRule
+	replicationRulesMutex sync.RWMutex
+
+	replicationRulesFile    string
+	replicationRulesModTime time.Time
+	replicationRulesReload  time.Duration
+
+	storageClassName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+func loadReplicationRules() {
+	replicationRulesFile = getEnv("MIRROR_RULES_CONFIG")
+	if replicationRulesFile == "" {
+		return
+	}
+
+	reload, err := time.ParseDuration(getEnvOrDefault("MIRROR_RULES_RELOAD_INTERVAL", "30s"))
+	if err != nil || reload < 0 {
+		log.Fatalf("Invalid MIRROR_RULES_RELOAD_INTERVAL: %v", err)
+	}
+	replicationRulesReload = reload
+
+	rules, modTime, err := readReplicationRules()
+	if err != nil {
+		log.Fatalf("Failed to load MIRROR_RULES_CONFIG: %v", err)
+	}
+	replicationRules = rules
+	replicationRulesModTime = modTime
+	log.Infof("Loaded %d replication rules", len(rules))
+}
+
+// readReplicationRules parses and validates MIRROR_RULES_CONFIG
+func readReplicationRules() ([]*replicationRule, time.Time, error) {
+	info, err := os.Stat(replicationRulesFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var config replicationRulesConfig
+	if err := loadConfigFile(replicationRulesFile, &config); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ids := make(map[string]bool)
+	for i, rule := range config.Rules {
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if ids[rule.ID] {
+			return nil, time.Time{}, fmt.Errorf("duplicate rule id %q", rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if err := rule.validate(); err != nil {
+			return nil, time.Time{}, fmt.Errorf("rule %q: %w", rule.ID, err)
+		}
+	}
+	return config.Rules, info.ModTime(), nil
+}
+
+func (r *replicationRule) validate() error {
+	if _, err := path.Match(r.Bucket, ""); err != nil {
+		return fmt.Errorf("invalid bucket pattern %q: %w", r.Bucket, err)
+	}
+	if _, err := path.Match(r.ContentType, ""); err != nil {
+		return fmt.Errorf("invalid content type pattern %q: %w", r.ContentType, err)
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 || (r.MaxSize > 0 && r.MaxSize < r.MinSize) {
+		return fmt.Errorf("invalid size range %d-%d", r.MinSize, r.MaxSize)
+	}
+
+	switch r.Action {
+	case "":
+		r.Action = replicationActionMirror
+	case replicationActionMirror:
+	case replicationActionSkip:
+		if len(r.Targets) > 0 || r.DestinationBucket != "" || r.DestinationKey != "" || r.StorageClass != "" || r.StorageClassMap != nil || r.Mode != "" {
+			return fmt.Errorf("skip rules cannot choose targets, destinations, storage classes or modes")
+		}
+	default:
+		return fmt.Errorf("invalid action %q, expected mirror or skip", r.Action)
+	}
+
+	switch r.Mode {
+	case "":
+		r.Mode = replicationModeAsync
+	case replicationModeAsync, replicationModeSync:
+	default:
+		return fmt.Errorf("invalid mode %q, expected async or sync", r.Mode)
+	}
+
+	for _, name := range r.Targets {
+		if _, err := findMirrorTarget(name); err != nil || name == "" {
+			return fmt.Errorf("unknown mirror target %q", name)
+		}
+	}
+	if r.DestinationBucket != "" {
+		tmpl, err := parseMirrorTemplate("destinationBucket", r.DestinationBucket, bucketTemplateFuncs)
+		if err != nil {
+			return err
+		}
+		r.bucketTemplate = tmpl
+	}
+	if r.DestinationKey != "" {
+		tmpl, err := parseMirrorTemplate("destinationKey", r.DestinationKey, keyTemplateFuncs)
+		if err != nil {
+			return err
+		}
+		r.keyTemplate = tmpl
+		// The key can't be rendered again later, only read from the inventory
+		r.datedKey = templateUsesFuncs(tmpl, dateTemplateFuncs)
+		if r.datedKey && inventoryBackend == inventoryBackendNone {
+			return fmt.Errorf("destinationKey uses the date of the write, which needs an inventory backend to find the copies again")
+		}
+	}
+	if r.StorageClass != "" && !storageClassName.MatchString(r.StorageClass) {
+		return fmt.Errorf("invalid storage class %q", r.StorageClass)
+	}
+	if r.StorageClass != "" && r.StorageClassMap != nil {
+		return fmt.Errorf("storageClass and storageClassMap are exclusive")
+	}
+	for class, mapped := range r.StorageClassMap {
+		if !storageClassName.MatchString(class) || !storageClassName.MatchString(mapped) {
+			return fmt.Errorf("invalid storage class mapping %q: %q", class, mapped)
+		}
+	}
+	return nil
+}
+
+// watchReplicationRules reloads MIRROR_RULES_CONFIG whenever it changes,
+// an invalid file keeps the previous rules
+func watchReplicationRules() {
+	if replicationRulesFile == "" || replicationRulesReload == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(replicationRulesReload)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(replicationRulesFile)
+			if err != nil || info.ModTime().Equal(replicationRulesModTime) {
+				continue
+			}
+
+			rules, modTime, err := readReplicationRules()
+			if err != nil {
+				log.Errorf("Failed to reload replication rules, keeping the previous ones: %v", err)
+				replicationRulesModTime = info.ModTime()
+				continue
+			}
+
+			replicationRulesMutex.Lock()
+			replicationRules = rules
+			replicationRulesMutex.Unlock()
+			replicationRulesModTime = modTime
+			log.Infof("Reloaded %d replication rules", len(rules))
+		}
+	}()
+}
+
+// matchReplicationRule returns the first rule matching an object, nil when
+// none does. Without attributes only bucket and key conditions can match.
+func matchReplicationRule(bucket, key string, attrs *objectAttributes) *replicationRule {
+	replicationRulesMutex.RLock()
+	defer replicationRulesMutex.RUnlock()
+	for _, rule := range replicationRules {
+		if rule.matches(bucket, key, attrs) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// findReplicationRule returns a rule by id, nil when it no longer exists
+func findReplicationRule(id string) *replicationRule {
+	replicationRulesMutex.RLock()
+	defer replicationRulesMutex.RUnlock()
+	for _, rule := range replicationRules {
+		if rule.ID == id {
+			return rule
+		}
+	}
+	return nil
+}
+
+// hasSyncReplicationRule tells if writes to a bucket may have to be mirrored
+// before answering
+func hasSyncReplicationRule(bucket string) bool {
+	replicationRulesMutex.RLock()
+	defer replicationRulesMutex.RUnlock()
+	for _, rule := range replicationRules {
+		if rule.Mode != replicationModeSync {
+			continue
+		}
+		if ok, _ := path.Match(rule.Bucket, bucket); rule.Bucket == "" || ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *replicationRule) matches(bucket, key string, attrs *objectAttributes) bool {
+	if ok, _ := path.Match(r.Bucket, bucket); r.Bucket != "" && !ok {
+		return false
+	}
+	if !strings.HasPrefix(key, r.Prefix) || !strings.HasSuffix(key, r.Suffix) {
+		return false
+	}
+
+	if r.MinSize == 0 && r.MaxSize == 0 && r.ContentType == "" && len(r.Tags) == 0 {
+		return true
+	}
+	if attrs == nil {
+		return false
+	}
+	if attrs.Size < r.MinSize || (r.MaxSize > 0 && attrs.Size > r.MaxSize) {
+		return false
+	}
+	if r.ContentType != "" {
+		contentType := strings.TrimSpace(strings.SplitN(attrs.ContentType, ";", 2)[0])
+		if ok, _ := path.Match(r.ContentType, contentType); !ok {
+			return false
+		}
+	}
+	for k, v := range r.Tags {
+		if attrs.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// id returns the rule id recorded in the inventory, empty without a rule
+func (r *replicationRule) id() string {
+	if r == nil {
+		return ""
+	}
+	return r.ID
+}
+
+// skips tells if objects matched by the rule are not mirrored
+func (r *replicationRule) skips() bool {
+	return r != nil && r.Action == replicationActionSkip
+}
+
+// sync tells if writes matched by the rule are mirrored before answering
+func (r *replicationRule) sync() bool {
+	return r != nil && r.Mode == replicationModeSync
+}
+
+// targets returns the targets receiving an object of a bucket matched by the
+// rule, nil rules use every target mirroring the bucket
+func (r *replicationRule) targets(bucket string) []*mirrorTarget {
+	if r.skips() {
+		return nil
+	}
+	if r == nil || len(r.Targets) == 0 {
+		return mirrorTargetsFor(bucket)
+	}
+
+	targets := make([]*mirrorTarget, 0, len(r.Targets))
+	for _, name := range r.Targets {
+		if target, err := findMirrorTarget(name); err == nil {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// mirrorBucket returns the bucket of a target receiving an object matched by
+// the rule
+func (r *replicationRule) mirrorBucket(target *mirrorTarget, bucket, key string) string {
+	if r == nil || r.bucketTemplate == nil {
+		return target.bucketName(bucket)
+	}
+	mirrorBucket, err := executeMirrorTemplate(r.bucketTemplate, bucketTemplateFuncs, mirrorTemplateData{bucket: bucket, key: key, target: target.Name})
+	if err != nil {
+		log.Errorf("Rule %s: %v, using the naming rule of %s", r.ID, err, target.Name)
+		return target.bucketName(bucket)
+	}
+	return mirrorBucket
+}
+
+// mirrorKey returns the key of the copy of an object matched by the rule and
+// written at a given time
+func (r *replicationRule) mirrorKey(bucket, key string, at time.Time) (string, error) {
+	if r == nil || r.keyTemplate == nil {
+		return key, nil
+	}
+	return executeMirrorTemplate(r.keyTemplate, keyTemplateFuncs, mirrorTemplateData{bucket: bucket, key: key, at: at})
+}
+
+// applyStorageClass sets the storage class of the copies when the rule
+// chooses one, headers hold the class of the object on main
+func (r *replicationRule) applyStorageClass(headers http.Header) {
+	if r == nil {
+		return
+	}
+	if r.StorageClass != "" {
+		headers.Set(storageClassHeader, r.StorageClass)
+		return
+	}
+	class := storedStorageClass(headers.Get(storageClassHeader))
+	if mapped, ok := r.StorageClassMap[class]; ok {
+		headers.Set(storageClassHeader, mapped)
+	}
+}
+
+// objectTags parses an x-amz-tagging header
+func objectTags(header string) map[string]string {
+	tags := make(map[string]string)
+	values, err := url.ParseQuery(header)
+	if err != nil {
+		return tags
+	}
+	for k, v := range values {
+		tags[k] = v[0]
+	}
+	return tags
+}
+
+// writtenObjectAttributes returns the attributes of an object written by a
+// request: main's headers describe copies and multipart uploads. Tags are only
+// known when sent with the request.
+func writtenObjectAttributes(req *http.Request, size int64, contentType string) *objectAttributes {
+	attrs := &objectAttributes{Size: size, ContentType: contentType}
+	if req.Header.Get("X-Amz-Copy-Source") == "" || req.Header.Get("X-Amz-Tagging-Directive") == "REPLACE" {
+		attrs.Tags = objectTags(req.Header.Get("X-Amz-Tagging"))
+	}
+	return attrs
+}
+
+// mirroredObject returns the rule and mirror key of an object already
+// written, from its inventory record when there is one. A recorded rule that
+// no longer exists is matched again with the recorded attributes.
+func mirroredObject(bucket, key string) (*replicationRule, string, error) {
+	var rec *ObjectRecord
+	if inventory != nil {
+		rec, _ = inventory.GetObject(bucket, key)
+	}
+	return recordedReplication(bucket, key, rec)
+}
+
+// recordedReplication is mirroredObject with the record already read, nil
+// when the object has none. Without a record the key of a rule naming keys
+// by the date of the write is unknown, rather than guessed.
+func recordedReplication(bucket, key string, rec *ObjectRecord) (*replicationRule, string, error) {
+	if rec == nil {
+		rule := matchReplicationRule(bucket, key, nil)
+		if rule != nil && rule.datedKey {
+			return rule, "", fmt.Errorf("%s/%s has no inventory record and rule %s names its copies by the date of the write", bucket, key, rule.ID)
+		}
+		mirrorKey, err := rule.mirrorKey(bucket, key, time.Now().UTC())
+		if err != nil {
+			return rule, "", err
+		}
+		return rule, mirrorKey, nil
+	}
+
+	mirrorKey := rec.MirrorKey
+	if mirrorKey == "" {
+		mirrorKey = key
+	}
+	if rec.MirrorRule == "" {
+		return nil, mirrorKey, nil
+	}
+	if rule := findReplicationRule(rec.MirrorRule); rule != nil {
+		return rule, mirrorKey, nil
+	}
+	return matchReplicationRule(bucket, key, &objectAttributes{Size: rec.Size, ContentType: rec.ContentType}), mirrorKey, nil
+}
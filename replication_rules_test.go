@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchReplicationRule(t *testing.T) {
+	withReplicationRules(t,
+		&replicationRule{ID: "tmp", Prefix: "tmp/", Action: replicationActionSkip},
+		&replicationRule{ID: "large", Bucket: "media-*", MinSize: 100},
+		&replicationRule{ID: "images", Bucket: "media-*", ContentType: "image/*", MaxSize: 50},
+		&replicationRule{ID: "pii", Tags: map[string]string{"class": "pii"}, Mode: replicationModeSync},
+		&replicationRule{ID: "logs", Bucket: "logs", Suffix: ".gz"},
+	)
+
+	tests := []struct {
+		name   string
+		bucket string
+		key    string
+		attrs  *objectAttributes
+		rule   string
+	}{
+		{"prefix in any bucket", "photos", "tmp/a", nil, "tmp"},
+		{"first rule wins", "media-eu", "tmp/a.jpg", &objectAttributes{Size: 200}, "tmp"},
+		{"minimum size", "media-eu", "a.mp4", &objectAttributes{Size: 100}, "large"},
+		{"under the minimum size", "media-eu", "a.mp4", &objectAttributes{Size: 99, ContentType: "video/mp4"}, ""},
+		{"content type pattern", "media-eu", "a.jpg", &objectAttributes{Size: 10, ContentType: "image/jpeg; charset=binary"}, "images"},
+		{"over the maximum size", "media-eu", "a.jpg", &objectAttributes{Size: 51, ContentType: "image/jpeg"}, ""},
+		{"bucket pattern", "media", "a.jpg", &objectAttributes{Size: 10, ContentType: "image/jpeg"}, ""},
+		{"tags", "photos", "a", &objectAttributes{Tags: map[string]string{"class": "pii", "team": "x"}}, "pii"},
+		{"other tag value", "photos", "a", &objectAttributes{Tags: map[string]string{"class": "public"}}, ""},
+		{"attributes unknown", "media-eu", "a.mp4", nil, ""},
+		{"suffix", "logs", "2024/a.gz", nil, "logs"},
+		{"other suffix", "logs", "2024/a.txt", nil, ""},
+	}
+	for _, tt := range tests {
+		if rule := matchReplicationRule(tt.bucket, tt.key, tt.attrs); rule.id() != tt.rule {
+			t.Errorf("%s: matchReplicationRule(%s, %s) = %q, want %q", tt.name, tt.bucket, tt.key, rule.id(), tt.rule)
+		}
+	}
+
+	if !hasSyncReplicationRule("any") {
+		t.Error("hasSyncReplicationRule missed a sync rule matching every bucket")
+	}
+	if rule := findReplicationRule("logs"); rule == nil || rule.skips() || rule.sync() {
+		t.Errorf("findReplicationRule(logs) = %+v, want an async mirror rule", rule)
+	}
+	if findReplicationRule("gone") != nil {
+		t.Error("findReplicationRule found a rule that does not exist")
+	}
+}
+
+func TestReplicationRuleValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  replicationRule
+		valid bool
+	}{
+		{"defaults", replicationRule{}, true},
+		{"bucket pattern", replicationRule{Bucket: "media-[a-z]*"}, true},
+		{"invalid bucket pattern", replicationRule{Bucket: "media-["}, false},
+		{"invalid content type pattern", replicationRule{ContentType: "image/["}, false},
+		{"size range", replicationRule{MinSize: 10, MaxSize: 10}, true},
+		{"inverted size range", replicationRule{MinSize: 10, MaxSize: 5}, false},
+		{"negative size", replicationRule{MinSize: -1}, false},
+		{"unknown action", replicationRule{Action: "copy"}, false},
+		{"skip with a destination", replicationRule{Action: replicationActionSkip, DestinationKey: "{{key}}"}, false},
+		{"unknown mode", replicationRule{Mode: "eventual"}, false},
+		{"invalid storage class", replicationRule{StorageClass: "glacier"}, false},
+		{"storage class and map", replicationRule{StorageClass: "GLACIER", StorageClassMap: map[string]string{"STANDARD": "GLACIER"}}, false},
+		{"invalid storage class map", replicationRule{StorageClassMap: map[string]string{"STANDARD": "cold"}}, false},
+		{"invalid key template", replicationRule{DestinationKey: "{{key"}, false},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		if err := rule.validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: validate = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	rule := replicationRule{}
+	rule.validate()
+	if rule.Action != replicationActionMirror || rule.Mode != replicationModeAsync {
+		t.Errorf("default action and mode = %s, %s, want mirror, async", rule.Action, rule.Mode)
+	}
+}
+
+func TestReplicationRuleStorageClass(t *testing.T) {
+	archive := &replicationRule{StorageClassMap: map[string]string{"STANDARD": "GLACIER_IR", "STANDARD_IA": "GLACIER"}}
+	tests := []struct {
+		rule  *replicationRule
+		class string
+		want  string
+	}{
+		{nil, "STANDARD_IA", "STANDARD_IA"},
+		{&replicationRule{StorageClass: "DEEP_ARCHIVE"}, "", "DEEP_ARCHIVE"},
+		{archive, "", "GLACIER_IR"},
+		{archive, "STANDARD_IA", "GLACIER"},
+		{archive, "ONEZONE_IA", "ONEZONE_IA"},
+	}
+	for _, tt := range tests {
+		headers := make(http.Header)
+		if tt.class != "" {
+			headers.Set(storageClassHeader, tt.class)
+		}
+		tt.rule.applyStorageClass(headers)
+		if got := headers.Get(storageClassHeader); got != tt.want {
+			t.Errorf("applyStorageClass(%+v, %q) = %q, want %q", tt.rule, tt.class, got, tt.want)
+		}
+	}
+}
+
+func TestWrittenObjectAttributes(t *testing.T) {
+	put := httptest.NewRequest("PUT", "http://proxy.example.com/bucket/a", nil)
+	put.Header.Set("X-Amz-Tagging", "class=pii&team=a%20b")
+	if attrs := writtenObjectAttributes(put, 3, "text/plain"); attrs.Size != 3 || attrs.Tags["class"] != "pii" || attrs.Tags["team"] != "a b" {
+		t.Errorf("attributes of a PUT = %+v", attrs)
+	}
+
+	// Copies keep the tags of their source unless replaced
+	put.Header.Set("X-Amz-Copy-Source", "/bucket/b")
+	if attrs := writtenObjectAttributes(put, 3, "text/plain"); attrs.Tags != nil {
+		t.Errorf("attributes of a copy = %+v, want unknown tags", attrs)
+	}
+	put.Header.Set("X-Amz-Tagging-Directive", "REPLACE")
+	if attrs := writtenObjectAttributes(put, 3, "text/plain"); attrs.Tags["class"] != "pii" {
+		t.Errorf("attributes of a copy replacing its tags = %+v", attrs)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// restoreSource returns where the copy of an object lives on a target and
+// its storage class: the bucket and key of the rule recorded in the inventory
+// (or the trash key of deleted objects), the target's naming rule and the
+// same key without a record. The class is empty when unknown.
+func restoreSource(target *mirrorTarget, bucket, key string) (string, string, string, error) {
+	store, err := openInventoryStore()
+	if err != nil {
+		return "", "", "", err
+	}
+	if store == nil {
+		return target.bucketName(bucket), key, "", nil
+	}
+	defer store.Close()
+
+	rec, err := store.GetObject(bucket, key)
+	if err != nil {
+		return "", "", "", err
+	}
+	if rec == nil {
+		return target.bucketName(bucket), key, "", nil
+	}
+
+	mirrorBucket, mirrorKey, err := recordedCopy(target, bucket, rec)
+	if err != nil {
+		return "", "", "", err
+	}
+	return mirrorBucket, mirrorKey, rec.MirrorStorageClass[target.Name], nil
+}
+
+// recordedCopy returns the bucket and key of the copy of a recorded object on
+// a target, the trash key once a delete moved it
+func recordedCopy(target *mirrorTarget, bucket string, rec *ObjectRecord) (string, string, error) {
+	mirrorKey := rec.MirrorKey
+	if mirrorKey == "" {
+		mirrorKey = rec.Key
+	}
+	// Copies of deleted objects may have been moved to the trash, or purged
+	if rec.Deleted && rec.Tombstone != nil {
+		switch rec.Tombstone.State {
+		case tombstoneTrashed:
+			mirrorKey = rec.Tombstone.TrashKey
+		case tombstonePurged:
+			return "", "", fmt.Errorf("the copies of %s/%s were purged after its delete", bucket, rec.Key)
+		}
+	}
+	var rule *replicationRule
+	if rec.MirrorRule != "" {
+		if rule = findReplicationRule(rec.MirrorRule); rule == nil {
+			log.Warnf("Rule %s of %s/%s no longer exists, using the naming rule of %s", rec.MirrorRule, bucket, rec.Key, target.Name)
+		}
+	}
+	return rule.mirrorBucket(target, bucket, rec.Key), mirrorKey, nil
+}
+
+// runRestoreCommand implements "s3-proxy restore": download an object from
+// the mirror, decrypt it if needed and write it to a file or back to main
+func runRestoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	bucket := flags.String("bucket", "", "bucket name (without the mirror naming rule)")
+	key := flags.String("key", "", "object key")
+	targetName := flags.String("target", "", "mirror target, defaults to the primary one")
+	mirrorKey := flags.String("mirror-key", "", "key of the copy when a replication rule rewrote it, read from the inventory by default")
+	output := flags.String("output", "", "file receiving the object, - for stdout")
+	toMain := flags.Bool("to-main", false, "upload the object back to main under the same bucket and key")
+	restoreDays := flags.Int("restore-days", 1, "days an archived copy stays readable once restored by the mirror")
+	restoreTier := flags.String("restore-tier", "Standard", "retrieval tier of archived copies: Expedited, Standard or Bulk")
+	issuer := flags.String("issuer", os.Getenv("USER"), "name recorded in the audit log")
+	flags.Parse(args)
+
+	if *bucket == "" || *key == "" || (*output == "") == !*toMain {
+		fmt.Fprintln(os.Stderr, "restore: -bucket, -key and one of -output or -to-main are required")
+		os.Exit(2)
+	}
+
+	target, err := findMirrorTarget(*targetName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		os.Exit(2)
+	}
+
+	mirrorBucket, sourceKey, storageClass, err := restoreSource(target, *bucket, *key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		os.Exit(1)
+	}
+	if *mirrorKey != "" {
+		sourceKey = *mirrorKey
+	}
+
+	// Archived copies are read once the mirror restored them
+	if target.isArchiveStorageClass(storageClass) {
+		waitArchiveRestore(target, mirrorBucket, sourceKey, storageClass, *restoreDays, *restoreTier)
+	}
+
+	resp, _, err := target.store.getObject("GET", *bucket, mirrorBucket, sourceKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		// The inventory did not know the copy was archived
+		if resp.StatusCode == http.StatusForbidden && bytes.Contains(body, []byte("<Code>InvalidObjectState</Code>")) {
+			waitArchiveRestore(target, mirrorBucket, sourceKey, "an archive class", *restoreDays, *restoreTier)
+		}
+		fmt.Fprintf(os.Stderr, "restore: mirror returned %d: %s\n", resp.StatusCode, body)
+		os.Exit(1)
+	}
+
+	var reader io.Reader = resp.Body
+	encrypted := isEncryptedMirrorObject(resp.Header)
+	if encrypted {
+		if reader, err = newDecryptingReader(resp.Body, resp.Header); err != nil {
+			fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *toMain {
+		err = restoreToMain(*bucket, *key, reader, resp.Header)
+	} else {
+		err = restoreToFile(*output, reader)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		os.Exit(1)
+	}
+
+	recordAudit("restore", *issuer, log.Fields{
+		"bucket":    *bucket,
+		"key":       *key,
+		"mirrorKey": sourceKey,
+		"target":    target.Name,
+		"encrypted": encrypted,
+		"toMain":    *toMain,
+	})
+}
+
+// waitArchiveRestore requests a restore of an archived copy and exits unless
+// it is already readable, the command is run again once the mirror is done
+func waitArchiveRestore(target *mirrorTarget, mirrorBucket, key, storageClass string, days int, tier string) {
+	ready, err := requestArchiveRestore(target, mirrorBucket, key, days, tier)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+		os.Exit(1)
+	}
+	if !ready {
+		fmt.Fprintf(os.Stderr, "restore: %s/%s is stored in %s on %s, the mirror is restoring it (%s tier), run the command again once it completes\n",
+			mirrorBucket, key, storageClass, target.Name, tier)
+		os.Exit(3)
+	}
+}
+
+func restoreToFile(output string, reader io.Reader) error {
+	if output == "-" {
+		_, err := io.Copy(os.Stdout, reader)
+		return err
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// restoreToMain uploads a restored object to main with its content type and
+// user metadata, the encryption metadata is left out
+func restoreToMain(bucket, key string, reader io.Reader, mirrorHeaders http.Header) error {
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	backend := mainBackendFor(bucket)
+	if backend == nil {
+		return fmt.Errorf("no main backend holds bucket %s", bucket)
+	}
+	isVirtualHosted := backend.virtualHosted(bucket, false)
+	mainURL := backend.requestURL(bucket, "/"+key, isVirtualHosted)
+
+	req, err := http.NewRequest("PUT", mainURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range mirrorHeaders {
+		if strings.HasPrefix(k, "X-Amz-Meta-S3mirror-") || strings.HasPrefix(k, sseHeader) {
+			continue
+		}
+		if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" || k == "Content-Disposition" || k == "Content-Language" || k == "Cache-Control" {
+			req.Header[k] = v
+		}
+	}
+
+	creds, err := backend.credentials.Retrieve()
+	if err != nil {
+		return err
+	}
+	resp, err := backend.send(req, creds, body, bucket, isVirtualHosted)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("upload to main failed with status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// runRotateKeysCommand implements "s3-proxy rotate-keys": rewrap the data key
+// of every mirror object encrypted with another key than the primary one. Only
+// the metadata changes, objects are copied onto themselves.
+func runRotateKeysCommand(args []string) {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	buckets := flags.String("bucket", "", "comma separated bucket names (without the mirror naming rule)")
+	targetName := flags.String("target", "", "mirror target, defaults to the primary one")
+	prefix := flags.String("prefix", "", "only rotate keys under this prefix")
+	dryRun := flags.Bool("dry-run", false, "only report the objects to rotate")
+	issuer := flags.String("issuer", os.Getenv("USER"), "name recorded in the audit log")
+	flags.Parse(args)
+
+	if mirrorKeyring == nil {
+		fmt.Fprintln(os.Stderr, "rotate-keys: MIRROR_ENCRYPTION_KEYRING is not set")
+		os.Exit(2)
+	}
+	if *buckets == "" {
+		fmt.Fprintln(os.Stderr, "rotate-keys: -bucket is required")
+		os.Exit(2)
+	}
+	target, err := findMirrorTarget(*targetName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate-keys: %v\n", err)
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, bucket := range strings.Split(*buckets, ",") {
+		rotated, skipped, err := rotateBucketKeys(target, strings.TrimSpace(bucket), *prefix, *dryRun)
+		log.Infof("Rotated %d objects of %s (%d already using %s)", rotated, bucket, skipped, mirrorKeyring.Primary)
+		if err != nil {
+			log.Errorf("Failed to rotate keys of %s: %v", bucket, err)
+			failed = true
+		}
+		if !*dryRun {
+			recordAudit("rotate-keys", *issuer, log.Fields{"bucket": bucket, "target": target.Name, "prefix": *prefix, "rotated": rotated, "key": mirrorKeyring.Primary})
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// rotateBucketKeys rotates the objects of a bucket (as seen by clients) on a
+// target, at the bucket and key recorded for each copy. Without an inventory
+// the target is listed under its naming rule.
+func rotateBucketKeys(target *mirrorTarget, bucket, prefix string, dryRun bool) (int, int, error) {
+	rotated, skipped := 0, 0
+	rotate := func(mirrorBucket, key string) error {
+		changed, err := rotateObjectKey(target, bucket, mirrorBucket, key, dryRun)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if changed {
+			rotated++
+		} else {
+			skipped++
+		}
+		return nil
+	}
+
+	store, err := openInventoryStore()
+	if err != nil {
+		return 0, 0, err
+	}
+	if store == nil {
+		mirrorBucket := target.bucketName(bucket)
+		err := target.store.listObjects(mirrorBucket, prefix, func(key string) error {
+			return rotate(mirrorBucket, key)
+		})
+		return rotated, skipped, err
+	}
+	defer store.Close()
+
+	startAfter := ""
+	for {
+		records, err := store.ListObjects(bucket, ObjectQuery{Prefix: prefix, StartAfter: startAfter, Limit: 1000, IncludeDeleted: true})
+		if err != nil {
+			return rotated, skipped, err
+		}
+		for i := range records {
+			rec := &records[i]
+			startAfter = rec.Key
+			// Only copies the target holds, purged ones are gone
+			if rec.MirrorStatus[target.Name] != mirrorStatusCompleted ||
+				(rec.Deleted && rec.Tombstone != nil && rec.Tombstone.State == tombstonePurged) {
+				continue
+			}
+			mirrorBucket, mirrorKey, err := recordedCopy(target, bucket, rec)
+			if err != nil {
+				return rotated, skipped, err
+			}
+			if err := rotate(mirrorBucket, mirrorKey); err != nil {
+				return rotated, skipped, err
+			}
+		}
+		if len(records) < 1000 {
+			return rotated, skipped, nil
+		}
+	}
+}
+
+// rotateObjectKey rewraps the data key of one copy with the primary key
+func rotateObjectKey(target *mirrorTarget, bucket, mirrorBucket, key string, dryRun bool) (bool, error) {
+	head, _, err := target.store.getObject("HEAD", bucket, mirrorBucket, key)
+	if err != nil {
+		return false, err
+	}
+	head.Body.Close()
+	if head.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HEAD failed with status %d", head.StatusCode)
+	}
+	if !isEncryptedMirrorObject(head.Header) || head.Header.Get(encryptionMetaKeyID) == mirrorKeyring.Primary {
+		return false, nil
+	}
+	if dryRun {
+		log.Infof("Would rotate %s/%s from key %s", mirrorBucket, key, head.Header.Get(encryptionMetaKeyID))
+		return true, nil
+	}
+
+	dataKey, err := mirrorKeyring.unwrap(head.Header.Get(encryptionMetaKeyID), head.Header.Get(encryptionMetaKey))
+	if err != nil {
+		return false, err
+	}
+	wrapped, err := mirrorKeyring.wrap(mirrorKeyring.Primary, dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	// Replacing the metadata requires sending all of it again, the SSE-C
+	// algorithm tells the copy needs the customer key
+	metadata := make(http.Header)
+	for k, v := range head.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" || k == "Content-Encoding" ||
+			k == "Content-Disposition" || k == "Content-Language" || k == "Cache-Control" || k == "Expires" ||
+			k == storageClassHeader || k == sseHeader || k == sseKMSKeyIDHeader || k == sseCustomerAlgorithm {
+			metadata[k] = v
+		}
+	}
+	metadata.Set(encryptionMetaKeyID, mirrorKeyring.Primary)
+	metadata.Set(encryptionMetaKey, wrapped)
+
+	if err := target.store.copyObject(bucket, mirrorBucket, key, key, metadata); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// s3Namespace is the XML namespace of every S3 response document
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3ErrorResponse is the body of an S3 error
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// listBucketResultV2 is the body of a ListObjectsV2 response
+type listBucketResultV2 struct {
+	XMLName               xml.Name          `xml:"ListBucketResult"`
+	Xmlns                 string            `xml:"xmlns,attr"`
+	Name                  string            `xml:"Name"`
+	Prefix                string            `xml:"Prefix"`
+	Delimiter             string            `xml:"Delimiter,omitempty"`
+	MaxKeys               int               `xml:"MaxKeys"`
+	KeyCount              int               `xml:"KeyCount"`
+	IsTruncated           bool              `xml:"IsTruncated"`
+	ContinuationToken     string            `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string            `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string            `xml:"StartAfter,omitempty"`
+	EncodingType          string            `xml:"EncodingType,omitempty"`
+	Contents              []listObjectEntry `xml:"Contents"`
+	CommonPrefixes        []commonPrefix    `xml:"CommonPrefixes"`
+}
+
+type listObjectEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag,omitempty"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listAllMyBucketsResult is the body of a ListBuckets response
+type listAllMyBucketsResult struct {
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	Owner   *bucketOwner  `xml:"Owner,omitempty"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+type bucketOwner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName,omitempty"`
+}
+
+type bucketEntry struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// s3Error is an error answered to the client as an S3 error document
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// writeS3Error answers with an S3-style XML error document
+func writeS3Error(w http.ResponseWriter, req *http.Request, status int, code, message string) {
+	requestID := newRequestID()
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Amz-Request-Id", requestID)
+	w.WriteHeader(status)
+
+	// HEAD responses never carry a body
+	if req.Method == "HEAD" {
+		return
+	}
+
+	writeXMLBody(w, s3ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Resource:  req.URL.Path,
+		RequestID: requestID,
+	})
+}
+
+// writeS3XML answers with a successful S3 XML document
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Amz-Request-Id", newRequestID())
+	w.WriteHeader(status)
+	writeXMLBody(w, v)
+}
+
+func writeXMLBody(w http.ResponseWriter, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		log.Errorf("Failed to encode XML response: %v", err)
+		return
+	}
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// newRequestID returns a random ID in the format used by S3
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return strings.ToUpper(hex.EncodeToString(b[:]))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How the server-side encryption of mirror copies is chosen
+const (
+	sseModeStrip       = "strip"       // No SSE headers, the mirror bucket default applies
+	sseModeMap         = "map"         // Follow main, translating KMS key ids and SSE-C keys
+	sseModeSSES3       = "sse-s3"      // Always SSE-S3 (AES256)
+	sseModeKMS         = "kms"         // Always SSE-KMS with kmsKeyId (mirror default key when empty)
+	sseModePassthrough = "passthrough" // Send main's headers unchanged, SSE-C keys included
+)
+
+// Server-side encryption headers
+const (
+	sseHeader                 = "X-Amz-Server-Side-Encryption"
+	sseKMSKeyIDHeader         = "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"
+	sseCustomerAlgorithm      = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	sseCustomerKey            = "X-Amz-Server-Side-Encryption-Customer-Key"
+	sseCustomerKeyMD5         = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+	sseCopySourceHeaderPrefix = "X-Amz-Copy-Source-Server-Side-Encryption-"
+)
+
+// ssePolicy decides the server-side encryption of the mirror copies of the
+// buckets it matches
+type ssePolicy struct {
+	Bucket      string            `json:"bucket"`      // Bucket name or glob pattern, empty matches every bucket
+	Mode        string            `json:"mode"`        // strip, map, sse-s3, kms or passthrough
+	KMSKeyID    string            `json:"kmsKeyId"`    // Mirror key for kms mode, and for unmapped keys in map mode
+	KMSKeyMap   map[string]string `json:"kmsKeyMap"`   // Main key id to mirror key id, for map mode
+	CustomerKey string            `json:"customerKey"` // Base64 256 bit key replacing SSE-C keys in map mode
+
+	customerKeyMD5 string
+}
+
+type sseConfig struct {
+	Policies []*ssePolicy `json:"policies"`
+}
+
+// Policies in order, the first matching one applies. Mirror targets may
+// have their own.
+var ssePolicies []*ssePolicy
+
+// Without a matching policy SSE headers are stripped, they may name keys
+// that only exist for main
+var defaultSSEPolicy = &ssePolicy{Mode: sseModeStrip}
+
+func loadSSEConfig() {
+	configPath := getEnv("MIRROR_SSE_CONFIG")
+	if configPath == "" {
+		return
+	}
+
+	var config sseConfig
+	if err := loadConfigFile(configPath, &config); err != nil {
+		log.Fatalf("Failed to load MIRROR_SSE_CONFIG: %v", err)
+	}
+
+	for i, policy := range config.Policies {
+		if err := policy.validate(); err != nil {
+			log.Fatalf("SSE policy %d: %v", i+1, err)
+		}
+	}
+	ssePolicies = config.Policies
+	log.Infof("Loaded %d mirror SSE policies", len(ssePolicies))
+}
+
+func (p *ssePolicy) validate() error {
+	switch p.Mode {
+	case sseModeStrip, sseModeMap, sseModeSSES3, sseModeKMS, sseModePassthrough:
+	default:
+		return fmt.Errorf("invalid mode %q, expected strip, map, sse-s3, kms or passthrough", p.Mode)
+	}
+	if _, err := path.Match(p.Bucket, ""); err != nil {
+		return fmt.Errorf("invalid bucket pattern %q: %w", p.Bucket, err)
+	}
+	if p.CustomerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(p.CustomerKey)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("customerKey must be 32 bytes encoded in base64")
+		}
+		sum := md5.Sum(key)
+		p.customerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return nil
+}
+
+// matchSSEPolicy returns the first policy matching a bucket (as seen by clients)
+func matchSSEPolicy(policies []*ssePolicy, bucket string) *ssePolicy {
+	for _, policy := range policies {
+		if policy.Bucket == "" {
+			return policy
+		}
+		if ok, _ := path.Match(policy.Bucket, bucket); ok {
+			return policy
+		}
+	}
+	return defaultSSEPolicy
+}
+
+// apply returns the headers of a mirror write with the encryption of the
+// policy. headers describe the object on main: the client's PutObject
+// headers, or the response of main for copies and multipart uploads.
+func (p *ssePolicy) apply(headers http.Header) http.Header {
+	if p.Mode == sseModePassthrough {
+		return headers
+	}
+
+	translated := make(http.Header)
+	for k, v := range headers {
+		if !strings.HasPrefix(k, sseHeader) && !strings.HasPrefix(k, sseCopySourceHeaderPrefix) {
+			translated[k] = v
+		}
+	}
+
+	switch p.Mode {
+	case sseModeSSES3:
+		translated.Set(sseHeader, "AES256")
+	case sseModeKMS:
+		translated.Set(sseHeader, "aws:kms")
+		if p.KMSKeyID != "" {
+			translated.Set(sseKMSKeyIDHeader, p.KMSKeyID)
+		}
+	case sseModeMap:
+		switch {
+		case headers.Get(sseCustomerAlgorithm) != "":
+			if p.CustomerKey == "" {
+				log.Debug("Dropping SSE-C from mirror copy, no customerKey configured")
+				break
+			}
+			translated.Set(sseCustomerAlgorithm, "AES256")
+			translated.Set(sseCustomerKey, p.CustomerKey)
+			translated.Set(sseCustomerKeyMD5, p.customerKeyMD5)
+		case strings.HasPrefix(headers.Get(sseHeader), "aws:kms"):
+			translated.Set(sseHeader, headers.Get(sseHeader))
+			keyID := p.KMSKeyMap[headers.Get(sseKMSKeyIDHeader)]
+			if keyID == "" {
+				keyID = p.KMSKeyID
+			}
+			if keyID != "" {
+				translated.Set(sseKMSKeyIDHeader, keyID)
+			}
+		case headers.Get(sseHeader) != "":
+			translated.Set(sseHeader, headers.Get(sseHeader))
+		}
+	}
+	return translated
+}
+
+// customerKeyHeaders returns the SSE-C headers reading mirror copies written
+// with the policy's customer key, nil when it has none
+func (p *ssePolicy) customerKeyHeaders(prefix string) http.Header {
+	if p.CustomerKey == "" || p.Mode != sseModeMap {
+		return nil
+	}
+	headers := make(http.Header)
+	headers.Set(prefix+"Customer-Algorithm", "AES256")
+	headers.Set(prefix+"Customer-Key", p.CustomerKey)
+	headers.Set(prefix+"Customer-Key-Md5", p.customerKeyMD5)
+	return headers
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const storageClassHeader = "X-Amz-Storage-Class"
+
+// Classes whose copies must be restored before they can be read, unless the
+// target lists its own
+var defaultArchiveStorageClasses = []string{"GLACIER", "DEEP_ARCHIVE"}
+
+// rejectedStorageClasses remembers the classes a target refused, later
+// writes go straight to their fallback
+type rejectedStorageClasses struct {
+	classes map[string]bool
+	mutex   sync.Mutex
+}
+
+// validateStorageClasses checks the storage class settings of a target
+func (t *mirrorTarget) validateStorageClasses() error {
+	for class, mapped := range t.StorageClassMap {
+		if !storageClassName.MatchString(class) || !storageClassName.MatchString(mapped) {
+			return fmt.Errorf("mirror target %s has an invalid storage class mapping %q: %q", t.Name, class, mapped)
+		}
+	}
+	for class, fallback := range t.StorageClassFallback {
+		if !storageClassName.MatchString(class) || (fallback != "" && !storageClassName.MatchString(fallback)) {
+			return fmt.Errorf("mirror target %s has an invalid storage class fallback %q: %q", t.Name, class, fallback)
+		}
+	}
+	return nil
+}
+
+// storageClass returns the class written on the target for a class chosen by
+// a rule or main: translated to the provider's name, then replaced by its
+// fallback while the target rejects it. Empty means the bucket default.
+func (t *mirrorTarget) storageClass(class string) string {
+	if mapped, ok := t.StorageClassMap[class]; ok {
+		class = mapped
+	}
+	return t.followStorageClassFallbacks(class)
+}
+
+func (t *mirrorTarget) followStorageClassFallbacks(class string) string {
+	t.rejectedClasses.mutex.Lock()
+	defer t.rejectedClasses.mutex.Unlock()
+
+	// Bounded, the fallbacks may loop
+	for i := 0; class != "" && t.rejectedClasses.classes[class]; i++ {
+		if i > len(t.StorageClassFallback) {
+			return ""
+		}
+		class = t.StorageClassFallback[class]
+	}
+	return class
+}
+
+// rejectStorageClass records that the target refused a class and returns
+// the one to use instead
+func (t *mirrorTarget) rejectStorageClass(class string) string {
+	t.rejectedClasses.mutex.Lock()
+	if t.rejectedClasses.classes == nil {
+		t.rejectedClasses.classes = make(map[string]bool)
+	}
+	t.rejectedClasses.classes[class] = true
+	t.rejectedClasses.mutex.Unlock()
+	return t.followStorageClassFallbacks(class)
+}
+
+// copyStorageClass names the class of a copy written with a class for the
+// inventory, filesystem targets have none
+func (t *mirrorTarget) copyStorageClass(class string) string {
+	if t.Type == mirrorTargetFilesystem {
+		return ""
+	}
+	return storedStorageClass(t.storageClass(class))
+}
+
+// isArchiveStorageClass tells if copies of a class need a RestoreObject
+// before they can be read
+func (t *mirrorTarget) isArchiveStorageClass(class string) bool {
+	archive := t.ArchiveStorageClasses
+	if archive == nil {
+		archive = defaultArchiveStorageClasses
+	}
+	for _, c := range archive {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// setStorageClass sets the class of a write, empty for the bucket default
+func setStorageClass(headers http.Header, class string) {
+	if class == "" {
+		headers.Del(storageClassHeader)
+		return
+	}
+	headers.Set(storageClassHeader, class)
+}
+
+// storedStorageClass names the class of a copy for the inventory
+func storedStorageClass(class string) string {
+	if class == "" {
+		return "STANDARD"
+	}
+	return class
+}
+
+// isStorageClassRejection tells if the mirror refused a write for its storage class
+func isStorageClassRejection(status int, body []byte) bool {
+	return status == http.StatusBadRequest && bytes.Contains(body, []byte("<Code>InvalidStorageClass</Code>"))
+}
+
+// requestArchiveRestore asks the target for a temporary readable copy of an
+// archived object, it tells if one is already available
+func requestArchiveRestore(target *mirrorTarget, mirrorBucket, key string, days int, tier string) (bool, error) {
+	body := []byte(fmt.Sprintf("<RestoreRequest><Days>%d</Days><GlacierJobParameters><Tier>%s</Tier></GlacierJobParameters></RestoreRequest>", days, tier))
+	resp, err := target.send("POST", mirrorBucket, key, url.Values{"restore": {""}}, http.Header{"Content-Type": {"application/xml"}}, body)
+	if err != nil {
+		return false, err
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusAccepted:
+		log.Infof("Requested a %s restore of %s/%s on %s", tier, mirrorBucket, key, target.Name)
+		return false, nil
+	case resp.StatusCode == http.StatusConflict && strings.Contains(string(respBody), "RestoreAlreadyInProgress"):
+		return false, nil
+	}
+	return false, fmt.Errorf("RestoreObject failed with status %d: %s", resp.StatusCode, respBody)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	tlsCertFile       string
+	tlsKeyFile        string
+	tlsClientCAFile   string        // CA bundle verifying client certificates, empty disables mTLS
+	tlsClientAuth     string        // require or optional
+	tlsReloadInterval time.Duration // How often mounted files are checked for changes
+)
+
+func loadTLSConfig() {
+	tlsCertFile = getEnv("TLS_CERT_FILE")
+	tlsKeyFile = getEnv("TLS_KEY_FILE")
+	tlsClientCAFile = getEnv("TLS_CLIENT_CA_FILE")
+	tlsClientAuth = getEnvOrDefault("TLS_CLIENT_AUTH", "require")
+
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if tlsClientCAFile != "" && tlsCertFile == "" {
+		log.Fatal("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if tlsClientAuth != "require" && tlsClientAuth != "optional" {
+		log.Fatalf("Invalid TLS_CLIENT_AUTH %q, expected require or optional", tlsClientAuth)
+	}
+
+	interval, err := time.ParseDuration(getEnvOrDefault("TLS_RELOAD_INTERVAL", "30s"))
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid TLS_RELOAD_INTERVAL: %v", err)
+	}
+	tlsReloadInterval = interval
+}
+
+// tlsReloader serves the current certificate and client CA pool, reloading
+// them when the mounted files change (cert-manager rotations, secret updates)
+type tlsReloader struct {
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modTimes    map[string]time.Time
+	mutex       sync.RWMutex
+}
+
+// newServerTLSConfig returns the TLS configuration of the proxy listener,
+// nil when TLS is disabled
+func newServerTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" {
+		return nil, nil
+	}
+
+	reloader := &tlsReloader{modTimes: make(map[string]time.Time)}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	go reloader.watch()
+
+	clientAuth := tls.NoClientCert
+	if tlsClientCAFile != "" {
+		clientAuth = tls.RequireAndVerifyClientCert
+		if tlsClientAuth == "optional" {
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	base := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			reloader.mutex.RLock()
+			defer reloader.mutex.RUnlock()
+			return reloader.certificate, nil
+		},
+		// Every handshake picks up the latest certificate and CA bundle
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			reloader.mutex.RLock()
+			defer reloader.mutex.RUnlock()
+			config := base.Clone()
+			config.Certificates = []tls.Certificate{*reloader.certificate}
+			config.ClientCAs = reloader.clientCAs
+			config.ClientAuth = clientAuth
+			return config, nil
+		},
+	}, nil
+}
+
+// load reads the certificate, key and CA bundle, keeping the previous ones on error
+func (r *tlsReloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if tlsClientCAFile != "" {
+		bundle, err := os.ReadFile(tlsClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS_CLIENT_CA_FILE: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("no certificate found in TLS_CLIENT_CA_FILE")
+		}
+	}
+
+	r.mutex.Lock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.mutex.Unlock()
+
+	for _, file := range []string{tlsCertFile, tlsKeyFile, tlsClientCAFile} {
+		if info, err := os.Stat(file); err == nil {
+			r.modTimes[file] = info.ModTime()
+		}
+	}
+	return nil
+}
+
+func (r *tlsReloader) watch() {
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed := false
+		for _, file := range []string{tlsCertFile, tlsKeyFile, tlsClientCAFile} {
+			if file == "" {
+				continue
+			}
+			if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(r.modTimes[file]) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		// The certificate and the key may be updated one after the other
+		if err := r.load(); err != nil {
+			log.Errorf("Failed to reload TLS files, keeping the previous ones: %v", err)
+			continue
+		}
+		log.Info("Reloaded TLS certificate")
+	}
+}
+
+// certificateIdentity returns the client mapped to the verified certificate
+// of the connection, nil when there is none. Subjects are matched in the
+// order of the configuration, the first client wins.
+func certificateIdentity(req *http.Request) *clientCredential {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	leaf := req.TLS.VerifiedChains[0][0]
+
+	names := []string{leaf.Subject.String(), "CN=" + leaf.Subject.CommonName}
+	names = append(names, leaf.DNSNames...)
+	for _, uri := range leaf.URIs {
+		names = append(names, uri.String())
+	}
+
+	clientCredentialsMutex.RLock()
+	defer clientCredentialsMutex.RUnlock()
+	var matched *clientCredential
+	for _, client := range clientCredentials {
+		if (matched == nil || client.order < matched.order) && client.matchesCertificate(names) {
+			matched = client
+		}
+	}
+	if matched == nil {
+		log.Debugf("No client mapped to certificate %s", strings.Join(names, ", "))
+	}
+	return matched
+}
+
+// matchesCertificate tells if one of the certificate names matches a subject of the client
+func (c *clientCredential) matchesCertificate(names []string) bool {
+	for _, pattern := range c.CertSubjects {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCertificateIdentityOrder(t *testing.T) {
+	// The DNS name matches the first client, the common name the second
+	first := &clientCredential{Name: "first", AccessKey: "FIRST", SecretKey: "s", CertSubjects: []string{"*.team-a.svc"}, order: 0}
+	second := &clientCredential{Name: "second", AccessKey: "SECOND", SecretKey: "s", CertSubjects: []string{"CN=worker"}, order: 1}
+	withClientCredentials(t, first, second)
+
+	req := httptest.NewRequest("GET", "https://proxy.example.com/bucket/key", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{
+		Subject:  pkix.Name{CommonName: "worker"},
+		DNSNames: []string{"worker.team-a.svc"},
+	}}}}
+	for i := 0; i < 20; i++ {
+		if got := certificateIdentity(req); got != first {
+			t.Fatalf("certificateIdentity = %v, want the first client of the configuration", got)
+		}
+	}
+}
+
+func TestCheckCertificateSubjects(t *testing.T) {
+	clients := []*clientCredential{
+		{Name: "a", CertSubjects: []string{"CN=team-a-*"}},
+		{Name: "b", CertSubjects: []string{"CN=team-b-*"}},
+	}
+	if err := checkCertificateSubjects(clients); err != nil {
+		t.Errorf("checkCertificateSubjects: %v", err)
+	}
+
+	clients = append(clients, &clientCredential{Name: "all", CertSubjects: []string{"CN=team-*"}})
+	if err := checkCertificateSubjects(clients); err == nil || !strings.Contains(err.Error(), "overlap") {
+		t.Errorf("checkCertificateSubjects = %v, want an overlap error", err)
+	}
+}